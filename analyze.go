@@ -0,0 +1,253 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image/png"
+	"io"
+
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+	"github.com/ideamans/go-l10n"
+	pngmetawebstrip "github.com/ideamans/go-png-meta-web-strip"
+	"github.com/ideamans/go-psnr"
+)
+
+func init() {
+	// Register Japanese translations for analyze.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"failed to decompress image data: %v":       "画像データの展開に失敗しました: %v",
+		"invalid filter type %d at row %d":          "行%[2]dのフィルタタイプが不正です: %[1]d",
+		"failed to decode PNG for analysis: %v":     "解析のためのPNGのデコードに失敗しました: %v",
+		"failed to calculate PSNR for estimate: %v": "見積もりのためのPSNR計算に失敗しました: %v",
+	})
+}
+
+// AlphaUsage は画像のアルファチャンネルの使われ方を表します。
+type AlphaUsage string
+
+const (
+	// AlphaNone はすべてのピクセルが不透明であることを示します
+	AlphaNone AlphaUsage = "none"
+	// AlphaBinary は完全な透明と不透明のピクセルのみで構成されていることを示します
+	AlphaBinary AlphaUsage = "binary"
+	// AlphaPartial は半透明のピクセルを含むことを示します
+	AlphaPartial AlphaUsage = "partial"
+)
+
+// ChunkUsage はチャンクタイプごとのファイル内のバイト数です。
+type ChunkUsage struct {
+	Type  string // チャンクタイプ
+	Count int    // チャンクの数
+	Bytes int64  // 長さ、タイプ、CRCの12バイトを含む合計バイト数
+}
+
+// StageEstimate は最適化の各ステージで削減できるサイズの見積もりです。
+type StageEstimate struct {
+	Stage   Stage   // ステージ（StageStrip、StagePNGQuant）
+	Size    int64   // ステージ適用後のサイズ
+	Savings int64   // ステージ適用前からの削減量
+	PSNR    float64 // ステージ適用前とのPSNR（pngquantのみ）
+}
+
+// Analysis はPNGのサイズの内訳と画像の特徴を解析した結果です。
+type Analysis struct {
+	FileSize   int64 // ファイル全体のサイズ
+	Width      int
+	Height     int
+	BitDepth   int
+	ColorType  int
+	Interlaced bool
+
+	// Chunks はチャンクタイプごとのバイト数で、ファイル内で最初に現れた順に並びます。
+	// 先頭8バイトのシグネチャは含みません。
+	Chunks []ChunkUsage
+
+	IDATSize         int64   // IDATチャンクのデータ部の合計（圧縮後）
+	RawDataSize      int64   // IDATを展開した後のサイズ（フィルタタイプのバイトを含む）
+	CompressionRatio float64 // IDATSize / RawDataSize
+
+	// FilterRows は行ごとのフィルタタイプの分布です。
+	// 添字はフィルタタイプ（0: None、1: Sub、2: Up、3: Average、4: Paeth）です。
+	FilterRows [5]int64
+
+	UniqueColors int        // 非乗算のRGBAで異なる色の数（透明なピクセルも色ごとに数える）
+	Alpha        AlphaUsage // アルファチャンネルの使われ方
+
+	// Estimates は各ステージで削減できるサイズの見積もりです。
+	// ステージが適用できない場合（インデックスカラーの画像に対するpngquantなど）は含まれません。
+	Estimates []StageEstimate
+}
+
+// Analyze はPNGデータのサイズの内訳と画像の特徴を解析し、
+// メタデータの削除と減色によって削減できるサイズを見積もります。
+// 見積もりのために実際に減色を行うため、画像サイズに応じた時間がかかります。
+// デコードの前にDefaultLimitsを適用し、上限を超える画像はコードがCodeLimitExceededのDataErrorになります。
+func Analyze(data []byte) (*Analysis, error) {
+	if err := (Limits{}).Check(data); err != nil {
+		return nil, err
+	}
+	analysis, err := analyzeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	analysis.Estimates, err = estimateStages(data)
+	if err != nil {
+		return nil, err
+	}
+	return analysis, nil
+}
+
+// analyzeImage はステージの見積もりを除くPNGデータの解析を行います。
+func analyzeImage(data []byte) (*Analysis, error) {
+	pmp := pngstructure.NewPngMediaParser()
+
+	mediaContext, err := pmp.ParseBytes(data)
+	if err != nil {
+		return nil, NewDataErrorCodef(structureErrorCode(err), l10n.T("failed to parse PNG structure: %v"), err)
+	}
+
+	cs, ok := mediaContext.(*pngstructure.ChunkSlice)
+	if !ok {
+		return nil, NewDataErrorCodef(CodeInvalidStructure, l10n.T("unexpected media context type"))
+	}
+	chunks := cs.Chunks()
+
+	if len(chunks) == 0 || chunks[0].Type != "IHDR" {
+		return nil, NewDataErrorCodef(CodeMissingChunk, l10n.T("png file missing IHDR chunk"))
+	}
+	header, err := parseIHDR(chunks[0].Data)
+	if err != nil {
+		return nil, err
+	}
+
+	analysis := &Analysis{
+		FileSize:   int64(len(data)),
+		Width:      header.Width,
+		Height:     header.Height,
+		BitDepth:   header.BitDepth,
+		ColorType:  header.ColorType,
+		Interlaced: header.Interlace != 0,
+	}
+
+	// チャンクタイプごとのバイト数を集計する
+	var compressed bytes.Buffer
+	usage := map[string]int{}
+	for _, chunk := range chunks {
+		index, found := usage[chunk.Type]
+		if !found {
+			index = len(analysis.Chunks)
+			usage[chunk.Type] = index
+			analysis.Chunks = append(analysis.Chunks, ChunkUsage{Type: chunk.Type})
+		}
+		analysis.Chunks[index].Count++
+		analysis.Chunks[index].Bytes += 12 + int64(len(chunk.Data))
+
+		if chunk.Type == "IDAT" {
+			compressed.Write(chunk.Data)
+		}
+	}
+	if compressed.Len() == 0 {
+		return nil, NewDataErrorCodef(CodeMissingChunk, l10n.T("png file missing IDAT chunk"))
+	}
+
+	analysis.IDATSize = int64(compressed.Len())
+	analysis.RawDataSize = header.rawDataSize()
+	analysis.CompressionRatio = float64(analysis.IDATSize) / float64(analysis.RawDataSize)
+
+	if err := countFilterRows(analysis, header, compressed.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := analyzePixels(analysis, data); err != nil {
+		return nil, err
+	}
+
+	return analysis, nil
+}
+
+// countFilterRows はIDATを展開し、各行の先頭のフィルタタイプを集計します。
+func countFilterRows(analysis *Analysis, header *pngHeader, compressed []byte) error {
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return NewDataErrorCodef(CodeDecodeFailed, l10n.T("failed to decompress image data: %v"), err)
+	}
+	defer zr.Close()
+
+	row := 0
+	for _, size := range header.passSizes() {
+		line := make([]byte, 1+header.rowBytes(size[0]))
+		for y := 0; y < size[1]; y++ {
+			if _, err := io.ReadFull(zr, line); err != nil {
+				return NewDataErrorCodef(CodeDecodeFailed, l10n.T("failed to decompress image data: %v"), err)
+			}
+			filter := int(line[0])
+			if filter >= len(analysis.FilterRows) {
+				return NewDataErrorCodef(CodeDecodeFailed, l10n.T("invalid filter type %d at row %d"), filter, row)
+			}
+			analysis.FilterRows[filter]++
+			row++
+		}
+	}
+	return nil
+}
+
+// analyzePixels は画像をデコードし、色数とアルファチャンネルの使われ方を調べます。
+func analyzePixels(analysis *Analysis, data []byte) error {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return NewDataErrorCodef(decodeErrorCode(err), l10n.T("failed to decode PNG for analysis: %v"), err)
+	}
+
+	nrgba := toNRGBA64(img)
+	colors := map[uint64]struct{}{}
+	analysis.Alpha = AlphaNone
+	for i := 0; i+8 <= len(nrgba.Pix); i += 8 {
+		colors[binary.BigEndian.Uint64(nrgba.Pix[i:i+8])] = struct{}{}
+
+		switch alpha := binary.BigEndian.Uint16(nrgba.Pix[i+6 : i+8]); {
+		case alpha == 0xffff:
+		case alpha == 0:
+			if analysis.Alpha == AlphaNone {
+				analysis.Alpha = AlphaBinary
+			}
+		default:
+			analysis.Alpha = AlphaPartial
+		}
+	}
+	analysis.UniqueColors = len(colors)
+
+	return nil
+}
+
+// estimateStages はメタデータの削除と減色を実際に行い、各ステージの削減量を見積もります。
+// 減色はメタデータを削除した後のデータに対して行います。
+func estimateStages(data []byte) ([]StageEstimate, error) {
+	var estimates []StageEstimate
+
+	current := data
+	if stripped, _, err := pngmetawebstrip.Strip(data); err == nil {
+		estimates = append(estimates, StageEstimate{
+			Stage:   StageStrip,
+			Size:    int64(len(stripped)),
+			Savings: int64(len(data) - len(stripped)),
+		})
+		current = stripped
+	}
+
+	quantized, wasQuantized, err := PNGQuant(current)
+	if err != nil || !wasQuantized {
+		return estimates, nil
+	}
+	psnrValue, err := psnr.Compute(current, quantized)
+	if err != nil {
+		return nil, NewDataErrorCodef(CodeMetricFailed, l10n.T("failed to calculate PSNR for estimate: %v"), err)
+	}
+	estimates = append(estimates, StageEstimate{
+		Stage:   StagePNGQuant,
+		Size:    int64(len(quantized)),
+		Savings: int64(len(current) - len(quantized)),
+		PSNR:    psnrValue,
+	})
+	return estimates, nil
+}
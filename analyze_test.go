@@ -0,0 +1,153 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	cases := []struct {
+		name           string
+		file           string
+		expectAlpha    AlphaUsage
+		expectColors   int
+		expectPNGQuant bool
+	}{
+		{"不透明", "testdata/variations/alpha_opaque.png", AlphaNone, 5125, true},
+		{"半透明", "testdata/variations/alpha_semitransparent.png", AlphaPartial, 16776, true},
+		{"インターレース", "testdata/variations/interlace_adam7.png", AlphaPartial, 27787, true},
+		{"パレット", "testdata/variations/colortype_palette.png", AlphaNone, 154, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+
+			analysis, err := Analyze(data)
+			if err != nil {
+				t.Fatalf("Analyze() = %v; want nil", err)
+			}
+
+			// シグネチャとチャンクの合計がファイルサイズに一致する
+			total := int64(len(pngSignature))
+			for _, usage := range analysis.Chunks {
+				total += usage.Bytes
+			}
+			if total != analysis.FileSize || analysis.FileSize != int64(len(data)) {
+				t.Errorf("chunk bytes = %d, FileSize = %d; want %d", total, analysis.FileSize, len(data))
+			}
+			if analysis.Chunks[0].Type != "IHDR" || analysis.Chunks[len(analysis.Chunks)-1].Type != "IEND" {
+				t.Errorf("Chunks = %+v; want IHDR first and IEND last", analysis.Chunks)
+			}
+
+			if analysis.CompressionRatio <= 0 || analysis.CompressionRatio >= 1 {
+				t.Errorf("CompressionRatio = %v; want between 0 and 1", analysis.CompressionRatio)
+			}
+
+			// すべての行のフィルタタイプが数えられている
+			header := &pngHeader{Width: analysis.Width, Height: analysis.Height, Interlace: 0}
+			if analysis.Interlaced {
+				header.Interlace = 1
+			}
+			var expectedRows, rows int64
+			for _, size := range header.passSizes() {
+				expectedRows += int64(size[1])
+			}
+			for _, n := range analysis.FilterRows {
+				rows += n
+			}
+			if rows != expectedRows {
+				t.Errorf("FilterRows = %v (total %d); want total %d", analysis.FilterRows, rows, expectedRows)
+			}
+
+			if analysis.Alpha != tc.expectAlpha {
+				t.Errorf("Alpha = %s; want %s", analysis.Alpha, tc.expectAlpha)
+			}
+			if analysis.UniqueColors != tc.expectColors {
+				t.Errorf("UniqueColors = %d; want %d", analysis.UniqueColors, tc.expectColors)
+			}
+
+			stages := map[Stage]StageEstimate{}
+			for _, estimate := range analysis.Estimates {
+				stages[estimate.Stage] = estimate
+			}
+			if strip, ok := stages[StageStrip]; !ok || strip.Savings <= 0 {
+				t.Errorf("strip estimate = %+v; want positive savings", strip)
+			}
+			if _, ok := stages[StagePNGQuant]; ok != tc.expectPNGQuant {
+				t.Errorf("pngquant estimate present = %v; want %v", ok, tc.expectPNGQuant)
+			}
+		})
+	}
+}
+
+func TestAnalyze_BinaryAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if (x+y)%2 == 0 {
+				img.Set(x, y, color.NRGBA{R: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode() = %v; want nil", err)
+	}
+
+	analysis, err := analyzeImage(buf.Bytes())
+	if err != nil {
+		t.Fatalf("analyzeImage() = %v; want nil", err)
+	}
+	if analysis.Alpha != AlphaBinary {
+		t.Errorf("Alpha = %s; want %s", analysis.Alpha, AlphaBinary)
+	}
+	if analysis.UniqueColors != 2 {
+		t.Errorf("UniqueColors = %d; want 2", analysis.UniqueColors)
+	}
+}
+
+func TestOptimize_Analyze(t *testing.T) {
+	t.Parallel()
+	destPath := filepath.Join(t.TempDir(), "analyzed.png")
+
+	optimizer := NewOptimizer("")
+	optimizer.Analyze = true
+	output, err := optimizer.Run("testdata/optimize/psnr-will-50.png", destPath)
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if output.Analysis == nil {
+		t.Fatal("Analysis = nil; want analysis")
+	}
+
+	if output.Analysis.FileSize != output.BeforeSize {
+		t.Errorf("Analysis.FileSize = %d; want %d", output.Analysis.FileSize, output.BeforeSize)
+	}
+	for _, estimate := range output.Analysis.Estimates {
+		switch estimate.Stage {
+		case StageStrip:
+			if estimate.Size != output.SizeAfterStrip {
+				t.Errorf("strip estimate size = %d; want %d", estimate.Size, output.SizeAfterStrip)
+			}
+		case StagePNGQuant:
+			if estimate.PSNR != output.PNGQuant.PSNR {
+				t.Errorf("pngquant estimate PSNR = %v; want %v", estimate.PSNR, output.PNGQuant.PSNR)
+			}
+			if output.PNGQuant.Applied && estimate.Size != output.SizeAfterPNGQuant {
+				t.Errorf("pngquant estimate size = %d; want %d", estimate.Size, output.SizeAfterPNGQuant)
+			}
+		}
+	}
+	if len(output.Analysis.Estimates) != 2 {
+		t.Errorf("Estimates = %+v; want strip and pngquant", output.Analysis.Estimates)
+	}
+}
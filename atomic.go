@@ -0,0 +1,118 @@
+package png
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultOutputMode はOptimizer.OutputModeが0の場合に出力ファイルに設定するパーミッションです。
+const DefaultOutputMode os.FileMode = 0600
+
+// outputAttributes は出力ファイルに設定する属性です。
+type outputAttributes struct {
+	mode  os.FileMode // パーミッション
+	owner os.FileInfo // 所有者をコピーする元のファイル（nilの場合はコピーしない）
+	mtime time.Time   // 更新日時（ゼロ値の場合は設定しない）
+}
+
+// writeFileAtomic は、同じディレクトリの一時ファイルに書き込んでfsyncした後、
+// 名前を変更して置き換えることで、途中で中断しても不完全なファイルが残らないようにします。
+// 属性は名前を変更する前の一時ファイルに設定するため、失敗した場合に既存のファイルは変更されません。
+//
+// pathがシンボリックリンクの場合はリンク先のファイルを置き換え、リンク自体は維持します。
+func writeFileAtomic(path string, data []byte, attrs outputAttributes) (err error) {
+	target, err := resolveSymlink(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(target)
+
+	temp, err := os.CreateTemp(dir, "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := temp.Name()
+	defer func() {
+		if err != nil {
+			temp.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	if _, err = temp.Write(data); err != nil {
+		return err
+	}
+	if err = temp.Chmod(attrs.mode); err != nil {
+		return err
+	}
+	if attrs.owner != nil {
+		if err = copyOwner(temp, attrs.owner); err != nil {
+			return err
+		}
+	}
+	if err = temp.Sync(); err != nil {
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	if !attrs.mtime.IsZero() {
+		if err = os.Chtimes(tempPath, attrs.mtime, attrs.mtime); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Rename(tempPath, target); err != nil {
+		return err
+	}
+
+	syncDir(dir)
+	return nil
+}
+
+// resolveSymlink はパスがシンボリックリンクの場合にリンク先のパスを返します。
+// ファイルが存在しない場合やシンボリックリンクでない場合はそのまま返します。
+// リンク先が存在しない場合は、リンクが指すパスに新しく作成します。
+func resolveSymlink(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return path, nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	// 壊れたリンク: リンク先を相対パスも考慮して解決する
+	link, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(path), link)
+	}
+	return link, nil
+}
+
+// syncDir は名前の変更を永続化するためにディレクトリをfsyncします。
+// ディレクトリのfsyncに対応していないプラットフォームもあるため、エラーは無視します。
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,195 @@
+package png
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// copyTestFile はテスト用にファイルを一時ディレクトリへコピーします
+func copyTestFile(t *testing.T, src, dest string, mode os.FileMode) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	if err := os.WriteFile(dest, data, mode); err != nil {
+		t.Fatalf("os.WriteFile() = %v; want nil", err)
+	}
+	if err := os.Chmod(dest, mode); err != nil {
+		t.Fatalf("os.Chmod() = %v; want nil", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	data := []byte("optimized")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		setup  func(t *testing.T, dir string) string // 書き込み先のパスを返す
+		target string                                // 内容が書き込まれるファイル（dirからの相対パス）
+	}{
+		{
+			name:   "新規ファイル",
+			setup:  func(t *testing.T, dir string) string { return filepath.Join(dir, "new.png") },
+			target: "new.png",
+		},
+		{
+			name: "既存ファイルの置き換え",
+			setup: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "existing.png")
+				if err := os.WriteFile(path, []byte("original content"), 0600); err != nil {
+					t.Fatalf("os.WriteFile() = %v; want nil", err)
+				}
+				return path
+			},
+			target: "existing.png",
+		},
+		{
+			name: "シンボリックリンク",
+			setup: func(t *testing.T, dir string) string {
+				if err := os.WriteFile(filepath.Join(dir, "real.png"), []byte("original"), 0600); err != nil {
+					t.Fatalf("os.WriteFile() = %v; want nil", err)
+				}
+				link := filepath.Join(dir, "link.png")
+				if err := os.Symlink("real.png", link); err != nil {
+					t.Skipf("os.Symlink() = %v", err)
+				}
+				return link
+			},
+			target: "real.png",
+		},
+		{
+			name: "リンク先が存在しないシンボリックリンク",
+			setup: func(t *testing.T, dir string) string {
+				link := filepath.Join(dir, "dangling.png")
+				if err := os.Symlink("missing.png", link); err != nil {
+					t.Skipf("os.Symlink() = %v", err)
+				}
+				return link
+			},
+			target: "missing.png",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := tc.setup(t, dir)
+
+			err := writeFileAtomic(path, data, outputAttributes{mode: 0644, mtime: mtime})
+			if err != nil {
+				t.Fatalf("writeFileAtomic() = %v; want nil", err)
+			}
+
+			target := filepath.Join(dir, tc.target)
+			written, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+			if !bytes.Equal(written, data) {
+				t.Errorf("content = %q; want %q", written, data)
+			}
+
+			info, err := os.Stat(target)
+			if err != nil {
+				t.Fatalf("os.Stat() = %v; want nil", err)
+			}
+			if info.Mode().Perm() != 0644 {
+				t.Errorf("mode = %v; want %v", info.Mode().Perm(), os.FileMode(0644))
+			}
+			if !info.ModTime().Equal(mtime) {
+				t.Errorf("mtime = %v; want %v", info.ModTime(), mtime)
+			}
+
+			// シンボリックリンクは維持される
+			if path != target {
+				linkInfo, err := os.Lstat(path)
+				if err != nil || linkInfo.Mode()&os.ModeSymlink == 0 {
+					t.Errorf("os.Lstat(%s) = %v, %v; want symlink", path, linkInfo, err)
+				}
+			}
+
+			// 一時ファイルが残っていない
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("os.ReadDir() = %v; want nil", err)
+			}
+			for _, entry := range entries {
+				if filepath.Ext(entry.Name()) != ".png" {
+					t.Errorf("unexpected file left: %s", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestOptimize_OutputAttributes(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		name        string
+		configure   func(o *Optimizer)
+		inPlace     bool
+		expectMode  os.FileMode
+		expectMtime bool
+	}{
+		{"デフォルト", func(o *Optimizer) {}, false, 0600, false},
+		{"OutputMode", func(o *Optimizer) { o.OutputMode = 0644 }, false, 0644, false},
+		{"PreserveModeとPreserveTimes", func(o *Optimizer) {
+			o.OutputMode = 0644
+			o.PreserveMode = true
+			o.PreserveTimes = true
+		}, false, 0640, true},
+		{"上書き", func(o *Optimizer) {
+			o.PreserveMode = true
+			o.PreserveOwner = true
+			o.PreserveTimes = true
+		}, true, 0640, true},
+		{"上書きのデフォルト", func(o *Optimizer) {}, true, 0640, false},
+		{"上書きでOutputModeを指定", func(o *Optimizer) { o.OutputMode = 0600 }, true, 0600, false},
+	}
+
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srcPath := filepath.Join(tempDir, fmt.Sprintf("src%d.png", i))
+			copyTestFile(t, "testdata/optimize/psnr-will-50.png", srcPath, 0640)
+			if err := os.Chtimes(srcPath, mtime, mtime); err != nil {
+				t.Fatalf("os.Chtimes() = %v; want nil", err)
+			}
+			destPath := filepath.Join(tempDir, fmt.Sprintf("dest%d.png", i))
+			if tc.inPlace {
+				destPath = srcPath
+			}
+
+			optimizer := NewOptimizer("")
+			tc.configure(optimizer)
+			output, err := optimizer.Run(srcPath, destPath)
+			if err != nil {
+				t.Fatalf("Run() = %v; want nil", err)
+			}
+			if output.CantOptimize || output.InspectionFailed {
+				t.Fatalf("Unexpected result: %+v", output)
+			}
+
+			info, err := os.Stat(destPath)
+			if err != nil {
+				t.Fatalf("os.Stat() = %v; want nil", err)
+			}
+			if info.Mode().Perm() != tc.expectMode {
+				t.Errorf("mode = %v; want %v", info.Mode().Perm(), tc.expectMode)
+			}
+			if info.ModTime().Equal(mtime) != tc.expectMtime {
+				t.Errorf("mtime = %v; preserved want %v", info.ModTime(), tc.expectMtime)
+			}
+			if info.Size() != output.AfterSize {
+				t.Errorf("size = %d; want %d", info.Size(), output.AfterSize)
+			}
+		})
+	}
+}
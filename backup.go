@@ -0,0 +1,138 @@
+package png
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for backup.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"backup requires a suffix or a directory":   "バックアップにはサフィックスかディレクトリの指定が必要です",
+		"path %s is outside of backup root %s":      "パス %s はバックアップの基準ディレクトリ %s の外にあります",
+		"failed to resolve backup path: %w":         "バックアップのパスの解決に失敗しました: %w",
+		"failed to create backup directory: %w":     "バックアップディレクトリの作成に失敗しました: %w",
+		"failed to write backup: %w":                "バックアップの書き込みに失敗しました: %w",
+		"failed to read backup: %w":                 "バックアップの読み込みに失敗しました: %w",
+		"failed to restore from backup: %w":         "バックアップからの復元に失敗しました: %w",
+		"failed to remove backup after restore: %w": "復元後のバックアップの削除に失敗しました: %w",
+	})
+}
+
+// Backup は上書き最適化の際に元のファイルを退避する場所を表します。
+// Suffixのみを指定した場合は元のファイルと同じディレクトリに <ファイル名><Suffix> として保存し、
+// Dirを指定した場合はDirの下に元のファイルのパス構造を再現して保存します（ミラーディレクトリ）。
+// 両方を指定した場合は、ミラーディレクトリ内のファイル名にSuffixを付けます。
+//
+// バックアップには元のファイルのパーミッションと更新日時を保持しますが、所有者は保持しません。
+// 同じファイルを再度上書き最適化（再最適化など）しても、既存のバックアップは最初の元のファイルのまま維持されます。
+type Backup struct {
+	Suffix string
+	Dir    string
+	// Root はDirにミラーする際の基準ディレクトリです。
+	// 空の場合は元のファイルの絶対パス全体をDirの下に再現します。
+	Root string
+	// Overwrite がtrueの場合は、既存のバックアップを上書きする直前の内容で置き換えます。
+	Overwrite bool
+}
+
+// Path は、pathのファイルに対するバックアップの保存先を返します。
+// SuffixとDirがともに空の場合や、pathがRootの外にある場合はCodeInvalidOptionのSystemErrorを返します。
+func (b *Backup) Path(path string) (string, error) {
+	if b.Suffix == "" && b.Dir == "" {
+		return "", NewSystemErrorf(CodeInvalidOption, l10n.T("backup requires a suffix or a directory"))
+	}
+	if b.Dir == "" {
+		return path + b.Suffix, nil
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", NewSystemErrorf(CodeIO, l10n.T("failed to resolve backup path: %w"), err)
+	}
+
+	var rel string
+	if b.Root == "" {
+		rel = strings.TrimPrefix(absPath, filepath.VolumeName(absPath))
+	} else {
+		absRoot, err := filepath.Abs(b.Root)
+		if err != nil {
+			return "", NewSystemErrorf(CodeIO, l10n.T("failed to resolve backup path: %w"), err)
+		}
+		rel, err = filepath.Rel(absRoot, absPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", NewSystemErrorf(CodeInvalidOption, l10n.T("path %s is outside of backup root %s"), path, b.Root)
+		}
+	}
+
+	return filepath.Join(b.Dir, rel) + b.Suffix, nil
+}
+
+// save は、上書きされる前の元のファイルの内容をバックアップとして保存します。
+// Overwriteがfalseで既にバックアップが存在する場合は何もせず、falseを返します。
+func (b *Backup) save(path string, data []byte, info os.FileInfo) (bool, error) {
+	backupPath, err := b.Path(path)
+	if err != nil {
+		return false, err
+	}
+	if !b.Overwrite {
+		if _, err := os.Lstat(backupPath); err == nil {
+			return false, nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+		return false, NewSystemErrorf(CodeIO, l10n.T("failed to create backup directory: %w"), err)
+	}
+	attrs := outputAttributes{mode: info.Mode().Perm(), mtime: info.ModTime()}
+	if err := writeFileAtomic(backupPath, data, attrs); err != nil {
+		return false, NewSystemErrorf(CodeIO, l10n.T("failed to write backup: %w"), err)
+	}
+	return true, nil
+}
+
+// Restore は、pathのファイルをバックアップの内容に戻し、バックアップを削除します。
+// 置き換えは一時ファイルを経由して行うため、途中で中断してもファイルが壊れることはありません。
+// バックアップが存在しない場合はos.ErrNotExistをラップしたエラーを返します。
+func (b *Backup) Restore(path string) error {
+	backupPath, err := b.Path(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(backupPath)
+	if err != nil {
+		return NewSystemErrorf(CodeIO, l10n.T("failed to read backup: %w"), err)
+	}
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return NewSystemErrorf(CodeIO, l10n.T("failed to read backup: %w"), err)
+	}
+
+	attrs := outputAttributes{mode: info.Mode().Perm(), mtime: info.ModTime()}
+	if err := writeFileAtomic(path, data, attrs); err != nil {
+		return NewSystemErrorf(CodeIO, l10n.T("failed to restore from backup: %w"), err)
+	}
+
+	if err := os.Remove(backupPath); err != nil {
+		return NewSystemErrorf(CodeIO, l10n.T("failed to remove backup after restore: %w"), err)
+	}
+	return nil
+}
+
+// isSameFile は2つのパスが同じファイルを指しているかを判定します。
+// どちらかが存在しない場合はfalseを返します。
+func isSameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
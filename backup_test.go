@@ -0,0 +1,216 @@
+package png
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackup_Path(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "assets", "img", "a.png")
+
+	cases := []struct {
+		name        string
+		backup      Backup
+		expected    string
+		expectError bool
+	}{
+		{"サフィックス", Backup{Suffix: ".orig"}, path + ".orig", false},
+		{"ミラーディレクトリ", Backup{Dir: "/backup", Root: tempDir}, filepath.Join("/backup", "assets", "img", "a.png"), false},
+		{"ミラーディレクトリとサフィックス", Backup{Dir: "/backup", Root: filepath.Join(tempDir, "assets"), Suffix: ".bak"}, filepath.Join("/backup", "img", "a.png.bak"), false},
+		{"基準ディレクトリなし", Backup{Dir: "/backup"}, filepath.Join("/backup", path), false},
+		{"基準ディレクトリの外", Backup{Dir: "/backup", Root: filepath.Join(tempDir, "other")}, "", true},
+		{"指定なし", Backup{}, "", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := tc.backup.Path(path)
+			if tc.expectError {
+				if AsSystemError(err) == nil || CodeOf(err) != CodeInvalidOption {
+					t.Errorf("Path() = %s, %v; want SystemError with code %s", actual, err, CodeInvalidOption)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Path() = %v; want nil", err)
+			}
+			if actual != tc.expected {
+				t.Errorf("Path() = %s; want %s", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestOptimize_InPlaceBackup(t *testing.T) {
+	t.Parallel()
+	original, err := os.ReadFile("testdata/optimize/psnr-will-50.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		backup func(dir string) *Backup
+	}{
+		{"サフィックス", func(dir string) *Backup { return &Backup{Suffix: ".orig"} }},
+		{"ミラーディレクトリ", func(dir string) *Backup {
+			return &Backup{Dir: filepath.Join(dir, "backup"), Root: filepath.Join(dir, "public")}
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "public", "img", "a.png")
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf("os.MkdirAll() = %v; want nil", err)
+			}
+			copyTestFile(t, "testdata/optimize/psnr-will-50.png", path, 0644)
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatalf("os.Chtimes() = %v; want nil", err)
+			}
+
+			backup := tc.backup(dir)
+			optimizer := NewOptimizer("")
+			optimizer.Backup = backup
+			output, err := optimizer.RunInPlace(path)
+			if err != nil {
+				t.Fatalf("RunInPlace() = %v; want nil", err)
+			}
+			if output.CantOptimize || output.InspectionFailed {
+				t.Fatalf("Unexpected result: %+v", output)
+			}
+
+			// 元のファイルがバックアップされ、ファイルは最適化されている
+			backupPath, err := backup.Path(path)
+			if err != nil {
+				t.Fatalf("Path() = %v; want nil", err)
+			}
+			saved, err := os.ReadFile(backupPath)
+			if err != nil {
+				t.Fatalf("os.ReadFile(backup) = %v; want nil", err)
+			}
+			if !bytes.Equal(saved, original) {
+				t.Error("backup content differs from original")
+			}
+			if info, err := os.Stat(backupPath); err != nil || !info.ModTime().Equal(mtime) || info.Mode().Perm() != 0644 {
+				t.Errorf("backup info = %v, %v; want original mode and mtime", info, err)
+			}
+			if info, err := os.Stat(path); err != nil || info.Size() != output.AfterSize {
+				t.Errorf("optimized file = %v, %v; want size %d", info, err, output.AfterSize)
+			}
+
+			// 2回目は最適化済みとしてスキップされ、バックアップは変更されない
+			second, err := optimizer.RunInPlace(path)
+			if err != nil || !second.AlreadyOptimized {
+				t.Fatalf("RunInPlace() = %+v, %v; want AlreadyOptimized", second, err)
+			}
+			if saved, _ := os.ReadFile(backupPath); !bytes.Equal(saved, original) {
+				t.Error("backup was overwritten by skipped run")
+			}
+
+			// 再最適化しても最初のバックアップが維持される
+			reoptimizer := NewOptimizer("high")
+			reoptimizer.Backup = backup
+			reoptimizer.ReoptimizePolicy = ForceReoptimize
+			if third, err := reoptimizer.RunInPlace(path); err != nil || third.CantOptimize || third.InspectionFailed {
+				t.Fatalf("RunInPlace(reoptimize) = %+v, %v; want written", third, err)
+			}
+			if saved, _ := os.ReadFile(backupPath); !bytes.Equal(saved, original) {
+				t.Error("backup was overwritten by re-optimization")
+			}
+
+			// 復元すると元の内容と更新日時に戻り、バックアップは削除される
+			if err := backup.Restore(path); err != nil {
+				t.Fatalf("Restore() = %v; want nil", err)
+			}
+			restored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+			if !bytes.Equal(restored, original) {
+				t.Error("restored content differs from original")
+			}
+			if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(mtime) {
+				t.Errorf("restored info = %v, %v; want original mtime", info, err)
+			}
+			if _, err := os.Stat(backupPath); !os.IsNotExist(err) {
+				t.Errorf("os.Stat(backup) = %v; want not exist", err)
+			}
+
+			// バックアップがない場合の復元
+			if err := backup.Restore(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Restore() = %v; want os.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestBackup_Overwrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.png")
+	info := writeTestFile(t, path, "second")
+	if err := os.WriteFile(path+".orig", []byte("first"), 0644); err != nil {
+		t.Fatalf("os.WriteFile() = %v; want nil", err)
+	}
+
+	cases := []struct {
+		name          string
+		overwrite     bool
+		expectSaved   bool
+		expectContent string
+	}{
+		{"既存のバックアップを維持", false, false, "first"},
+		{"上書き", true, true, "second"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			backup := &Backup{Suffix: ".orig", Overwrite: tc.overwrite}
+			saved, err := backup.save(path, []byte("second"), info)
+			if err != nil || saved != tc.expectSaved {
+				t.Fatalf("save() = %v, %v; want %v, nil", saved, err, tc.expectSaved)
+			}
+			if content, _ := os.ReadFile(path + ".orig"); string(content) != tc.expectContent {
+				t.Errorf("backup = %q; want %q", content, tc.expectContent)
+			}
+		})
+	}
+}
+
+// writeTestFile はcontentをpathに書き込み、その情報を返します。
+func writeTestFile(t *testing.T, path, content string) os.FileInfo {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("os.WriteFile() = %v; want nil", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat() = %v; want nil", err)
+	}
+	return info
+}
+
+func TestOptimize_BackupOnlyInPlace(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.png")
+	copyTestFile(t, "testdata/optimize/psnr-will-50.png", srcPath, 0644)
+
+	optimizer := NewOptimizer("")
+	optimizer.Backup = &Backup{Suffix: ".orig"}
+	if _, err := optimizer.Run(srcPath, filepath.Join(dir, "dest.png")); err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+
+	// 別のファイルに出力する場合、元のファイルは変更されないためバックアップしない
+	if _, err := os.Stat(srcPath + ".orig"); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(backup) = %v; want not exist", err)
+	}
+}
@@ -0,0 +1,301 @@
+package png
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// BatchJob はBatchOptimizerで最適化する1つのファイルです。
+type BatchJob struct {
+	// Src と Dest は入力と出力のファイルのパスです。同じパスの場合はその場で最適化します。
+	Src  string
+	Dest string
+	// Quality が空でない場合は、このジョブだけOptimizer.Qualityの代わりに使用します。
+	Quality string
+	// Configure が指定されている場合は、このジョブに使用するOptimizerのコピーを変更します。
+	// BatchOptimizer.Optimizer自体は変更されません。
+	Configure func(o *Optimizer)
+}
+
+// BatchOutcome はジョブの結果の種類です。
+type BatchOutcome int
+
+const (
+	// OutcomeOptimized は最適化したファイルを書き込んだ（DryRunとEstimateでは見積もった）ことを示します。
+	OutcomeOptimized BatchOutcome = iota
+	// OutcomeAlreadyOptimized は最適化済みのためスキップしたことを示します。
+	OutcomeAlreadyOptimized
+	// OutcomeCantOptimize はサイズが小さくならないため最適化しなかったことを示します。
+	OutcomeCantOptimize
+	// OutcomeInspectionFailed は最終PSNRが閾値に満たないため最適化しなかったことを示します。
+	OutcomeInspectionFailed
+	// OutcomeError はOptimizer.Runがエラーを返したことを示します。
+	OutcomeError
+)
+
+// batchOutcomes はBatchSummary.Outcomesに含まれる結果の種類の一覧です。
+var batchOutcomes = []BatchOutcome{OutcomeOptimized, OutcomeAlreadyOptimized, OutcomeCantOptimize, OutcomeInspectionFailed, OutcomeError}
+
+// String は結果の種類の名前を返します。
+func (o BatchOutcome) String() string {
+	switch o {
+	case OutcomeOptimized:
+		return "optimized"
+	case OutcomeAlreadyOptimized:
+		return "already_optimized"
+	case OutcomeCantOptimize:
+		return "cant_optimize"
+	case OutcomeInspectionFailed:
+		return "inspection_failed"
+	case OutcomeError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// outcomeOf はOptimizer.Runの戻り値から結果の種類を判定します。
+func outcomeOf(output *OptimizePNGOutput, err error) BatchOutcome {
+	switch {
+	case err != nil:
+		return OutcomeError
+	case output.AlreadyOptimized:
+		return OutcomeAlreadyOptimized
+	case output.CantOptimize:
+		return OutcomeCantOptimize
+	case output.InspectionFailed:
+		return OutcomeInspectionFailed
+	}
+	return OutcomeOptimized
+}
+
+// BatchResult は1つのジョブの結果です。
+type BatchResult struct {
+	// Index はジョブを受け取った順番（0から）です。結果は完了した順に届くため、並べ替えに使用できます。
+	Index    int
+	Job      BatchJob
+	Outcome  BatchOutcome
+	Output   *OptimizePNGOutput
+	Err      error
+	Duration time.Duration
+}
+
+// BatchOptimizer は、複数のファイルを並行して最適化し、完了した順に結果を返します。
+//
+// 各ジョブはOptimizerのコピーで実行するため、ジョブごとの設定（BatchJob.QualityとConfigure）は
+// 他のジョブに影響しません。Optimizer.SchedulerやOptimizer.Workersはコピー間で共有されます。
+type BatchOptimizer struct {
+	// Optimizer は各ジョブの既定の設定です。
+	Optimizer *Optimizer
+	// Concurrency は同時に実行するジョブの数です。0以下の場合はruntime.GOMAXPROCS(0)です。
+	Concurrency int
+}
+
+// NewBatchOptimizer は、optimizerの設定でconcurrency個のジョブを同時に実行するBatchOptimizerを作成します。
+func NewBatchOptimizer(optimizer *Optimizer, concurrency int) *BatchOptimizer {
+	return &BatchOptimizer{Optimizer: optimizer, Concurrency: concurrency}
+}
+
+// Stream はjobsから受け取ったジョブを並行して実行し、完了した順に結果を返します。
+// jobsが閉じられ、すべてのジョブが完了すると結果のチャネルは閉じられます。
+// 呼び出し元は結果のチャネルを最後まで読み出してください。
+//
+// 例:
+//
+//	summary := png.NewBatchSummary()
+//	for result := range batch.Stream(jobs) {
+//	    summary.Add(result)
+//	}
+func (b *BatchOptimizer) Stream(jobs <-chan BatchJob) <-chan BatchResult {
+	return b.stream(jobs, nil)
+}
+
+// stream はStreamの本体です。stopが閉じられた後に受け取ったジョブは実行せずに破棄します。
+func (b *BatchOptimizer) stream(jobs <-chan BatchJob, stop <-chan struct{}) <-chan BatchResult {
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	type indexedJob struct {
+		index int
+		job   BatchJob
+	}
+	indexed := make(chan indexedJob)
+	go func() {
+		defer close(indexed)
+		index := 0
+		for job := range jobs {
+			indexed <- indexedJob{index, job}
+			index++
+		}
+	}()
+
+	results := make(chan BatchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range indexed {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				results <- b.run(j.index, j.job)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// Run はjobsを並行して実行し、完了するたびにyieldを呼び出して、全体の集計を返します。
+// yieldはnilでも構いません。yieldがfalseを返した場合は以降のジョブを開始せず、
+// 実行中のジョブの完了を待って戻ります（それらの結果は集計に含まれますが、yieldは呼び出されません）。
+// yieldは一度に1つのゴルーチンからだけ呼び出されます。
+func (b *BatchOptimizer) Run(jobs []BatchJob, yield func(BatchResult) bool) *BatchSummary {
+	queue := make(chan BatchJob)
+	stop := make(chan struct{})
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			select {
+			case queue <- job:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	summary := NewBatchSummary()
+	stopped := false
+	for result := range b.stream(queue, stop) {
+		summary.Add(result)
+		if stopped || yield == nil {
+			continue
+		}
+		if !yield(result) {
+			stopped = true
+			close(stop)
+		}
+	}
+	return summary
+}
+
+// run はOptimizerのコピーに設定を適用して1つのジョブを実行します。
+func (b *BatchOptimizer) run(index int, job BatchJob) BatchResult {
+	optimizer := *b.Optimizer
+	if job.Quality != "" {
+		optimizer.Quality = job.Quality
+	}
+	if job.Configure != nil {
+		job.Configure(&optimizer)
+	}
+
+	start := time.Now()
+	output, err := optimizer.Run(job.Src, job.Dest)
+	return BatchResult{
+		Index:    index,
+		Job:      job,
+		Outcome:  outcomeOf(output, err),
+		Output:   output,
+		Err:      err,
+		Duration: time.Since(start),
+	}
+}
+
+// PSNRBuckets は、BatchSummary.PSNRの区間の境界（dB）です。
+// 区間 i は PSNRBuckets[i-1] 以上 PSNRBuckets[i] 未満で、最初の区間は下限がなく、最後の区間は上限がありません。
+var PSNRBuckets = []float64{30, 35, 40, 45, 50}
+
+// PSNRHistogram は最適化したファイルの最終PSNRの分布です。
+type PSNRHistogram struct {
+	// Counts はPSNRBucketsの各区間のファイル数で、長さはlen(PSNRBuckets)+1です。
+	Counts []int
+	// Lossless はPSNRが無限大（画素が変わっていない）のファイル数です。Countsには含みません。
+	Lossless int
+	// Min、Max、Mean は有限のPSNRの最小値、最大値、平均値です。有限の値がない場合は0です。
+	Min  float64
+	Max  float64
+	Mean float64
+
+	sum   float64
+	count int
+}
+
+// add はPSNRを分布に加えます。
+func (h *PSNRHistogram) add(psnr float64) {
+	if math.IsInf(psnr, 1) {
+		h.Lossless++
+		return
+	}
+
+	bucket := len(PSNRBuckets)
+	for i, bound := range PSNRBuckets {
+		if psnr < bound {
+			bucket = i
+			break
+		}
+	}
+	h.Counts[bucket]++
+
+	if h.count == 0 || psnr < h.Min {
+		h.Min = psnr
+	}
+	if h.count == 0 || psnr > h.Max {
+		h.Max = psnr
+	}
+	h.sum += psnr
+	h.count++
+	h.Mean = h.sum / float64(h.count)
+}
+
+// BatchSummary はBatchOptimizerの結果の集計です。
+type BatchSummary struct {
+	// Total は集計したジョブの数です。
+	Total int
+	// Outcomes は結果の種類ごとのジョブの数です。
+	Outcomes map[BatchOutcome]int
+	// BeforeSize と AfterSize は、最適化したファイルの最適化前後のサイズの合計です。
+	BeforeSize int64
+	AfterSize  int64
+	// BytesSaved は最適化で削減したバイト数の合計（BeforeSize - AfterSize）です。
+	BytesSaved int64
+	// PSNR は最適化したファイルの最終PSNRの分布です。
+	PSNR PSNRHistogram
+	// Duration は各ジョブの実行時間の合計です。
+	Duration time.Duration
+}
+
+// NewBatchSummary は空の集計を作成します。
+func NewBatchSummary() *BatchSummary {
+	s := &BatchSummary{
+		Outcomes: make(map[BatchOutcome]int, len(batchOutcomes)),
+		PSNR:     PSNRHistogram{Counts: make([]int, len(PSNRBuckets)+1)},
+	}
+	for _, outcome := range batchOutcomes {
+		s.Outcomes[outcome] = 0
+	}
+	return s
+}
+
+// Add は結果を集計に加えます。Streamの結果を自分で集計する場合に使用します。
+func (s *BatchSummary) Add(result BatchResult) {
+	s.Total++
+	s.Outcomes[result.Outcome]++
+	s.Duration += result.Duration
+	if result.Outcome != OutcomeOptimized {
+		return
+	}
+
+	s.BeforeSize += result.Output.BeforeSize
+	s.AfterSize += result.Output.AfterSize
+	s.BytesSaved = s.BeforeSize - s.AfterSize
+	s.PSNR.add(result.Output.FinalPSNR)
+}
@@ -0,0 +1,172 @@
+package png
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestBatchOptimizer_Run(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	var mu sync.Mutex
+	var qualities []string
+	captureQuality := func(o *Optimizer) {
+		mu.Lock()
+		defer mu.Unlock()
+		qualities = append(qualities, o.Quality)
+	}
+
+	jobs := []BatchJob{
+		{Src: "testdata/optimize/psnr-will-50.png", Dest: filepath.Join(tempDir, "optimized.png")},
+		{Src: "testdata/optimize/with-mac-icc.png", Dest: filepath.Join(tempDir, "icc.png"), Quality: "high", Configure: captureQuality},
+		{Src: "testdata/optimize/already-lightfile-truly.png", Dest: filepath.Join(tempDir, "already.png")},
+		{Src: "testdata/optimize/psnr-will-50.png", Dest: filepath.Join(tempDir, "inspection.png"), Configure: func(o *Optimizer) { o.PSNRThreshold = 1000 }},
+		{Src: "testdata/optimize/bad.png", Dest: filepath.Join(tempDir, "bad.png")},
+		{Src: filepath.Join(tempDir, "missing.png"), Dest: filepath.Join(tempDir, "missing-out.png")},
+	}
+	expectOutcomes := []BatchOutcome{OutcomeOptimized, OutcomeOptimized, OutcomeAlreadyOptimized, OutcomeInspectionFailed, OutcomeError, OutcomeError}
+
+	optimizer := NewOptimizer("")
+	batch := NewBatchOptimizer(optimizer, 3)
+	var results []BatchResult
+	summary := batch.Run(jobs, func(result BatchResult) bool {
+		results = append(results, result)
+		return true
+	})
+
+	if len(results) != len(jobs) {
+		t.Fatalf("yielded %d results; want %d", len(results), len(jobs))
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	var beforeSize, afterSize int64
+	for i, result := range results {
+		if result.Index != i || result.Job.Dest != jobs[i].Dest {
+			t.Errorf("results[%d] = job %d (%s); want %s", i, result.Index, result.Job.Dest, jobs[i].Dest)
+		}
+		if result.Outcome != expectOutcomes[i] {
+			t.Errorf("results[%d].Outcome = %s (%v); want %s", i, result.Outcome, result.Err, expectOutcomes[i])
+		}
+		if result.Outcome == OutcomeOptimized {
+			beforeSize += result.Output.BeforeSize
+			afterSize += result.Output.AfterSize
+		}
+	}
+
+	// ジョブごとの設定はOptimizerのコピーにだけ適用される
+	if len(qualities) != 1 || qualities[0] != "high" {
+		t.Errorf("Quality in Configure = %v; want [high]", qualities)
+	}
+	if optimizer.Quality != "" || optimizer.PSNRThreshold != PSNRThreshold {
+		t.Errorf("Optimizer = %+v; want unchanged", optimizer)
+	}
+
+	expectCounts := map[BatchOutcome]int{OutcomeOptimized: 2, OutcomeAlreadyOptimized: 1, OutcomeCantOptimize: 0, OutcomeInspectionFailed: 1, OutcomeError: 2}
+	for outcome, count := range expectCounts {
+		if summary.Outcomes[outcome] != count {
+			t.Errorf("Outcomes[%s] = %d; want %d", outcome, summary.Outcomes[outcome], count)
+		}
+	}
+	if summary.Total != len(jobs) {
+		t.Errorf("Total = %d; want %d", summary.Total, len(jobs))
+	}
+	if summary.BeforeSize != beforeSize || summary.AfterSize != afterSize || summary.BytesSaved != beforeSize-afterSize || summary.BytesSaved <= 0 {
+		t.Errorf("summary sizes = %d -> %d (saved %d); want %d -> %d", summary.BeforeSize, summary.AfterSize, summary.BytesSaved, beforeSize, afterSize)
+	}
+	counted := summary.PSNR.Lossless
+	for _, n := range summary.PSNR.Counts {
+		counted += n
+	}
+	if counted != 2 {
+		t.Errorf("PSNR = %+v; want 2 files", summary.PSNR)
+	}
+}
+
+func TestBatchOptimizer_RunStop(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	var jobs []BatchJob
+	for i := 0; i < 8; i++ {
+		jobs = append(jobs, BatchJob{Src: "testdata/optimize/psnr-will-50.png", Dest: filepath.Join(tempDir, fmt.Sprintf("out-%d.png", i))})
+	}
+
+	yielded := 0
+	summary := NewBatchOptimizer(NewOptimizer(""), 1).Run(jobs, func(result BatchResult) bool {
+		yielded++
+		return false
+	})
+	if yielded != 1 {
+		t.Errorf("yielded %d results; want 1", yielded)
+	}
+	// 実行中だったジョブは集計に含まれるが、以降のジョブは開始されない
+	if summary.Total < 1 || summary.Total > 2 {
+		t.Errorf("Total = %d; want 1 or 2", summary.Total)
+	}
+}
+
+func TestBatchOptimizer_Stream(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	jobs := make(chan BatchJob)
+	go func() {
+		defer close(jobs)
+		for i := 0; i < 6; i++ {
+			jobs <- BatchJob{Src: "testdata/optimize/psnr-will-50.png", Dest: filepath.Join(tempDir, fmt.Sprintf("out-%d.png", i))}
+		}
+	}()
+
+	seen := map[int]bool{}
+	summary := NewBatchSummary()
+	for result := range NewBatchOptimizer(NewOptimizer(""), 2).Stream(jobs) {
+		if seen[result.Index] {
+			t.Errorf("Index %d received twice", result.Index)
+		}
+		seen[result.Index] = true
+		if result.Err != nil {
+			t.Errorf("results[%d].Err = %v; want nil", result.Index, result.Err)
+		}
+		summary.Add(result)
+	}
+
+	if len(seen) != 6 || summary.Outcomes[OutcomeOptimized] != 6 {
+		t.Errorf("received %d results, %d optimized; want 6", len(seen), summary.Outcomes[OutcomeOptimized])
+	}
+}
+
+func TestPSNRHistogram(t *testing.T) {
+	cases := []struct {
+		name           string
+		values         []float64
+		expectCounts   []int
+		expectLossless int
+		expectMin      float64
+		expectMax      float64
+		expectMean     float64
+	}{
+		{"空", nil, []int{0, 0, 0, 0, 0, 0}, 0, 0, 0, 0},
+		{"境界の値", []float64{29.9, 30, 35, 44.9, 50, 60}, []int{1, 1, 1, 1, 0, 2}, 0, 29.9, 60, (29.9 + 30 + 35 + 44.9 + 50 + 60) / 6},
+		{"無限大", []float64{math.Inf(1), 42, math.Inf(1)}, []int{0, 0, 0, 1, 0, 0}, 2, 42, 42, 42},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			summary := NewBatchSummary()
+			for _, value := range tc.values {
+				summary.Add(BatchResult{Outcome: OutcomeOptimized, Output: &OptimizePNGOutput{FinalPSNR: value}})
+			}
+			h := summary.PSNR
+			if fmt.Sprint(h.Counts) != fmt.Sprint(tc.expectCounts) || h.Lossless != tc.expectLossless {
+				t.Errorf("Counts = %v, Lossless = %d; want %v, %d", h.Counts, h.Lossless, tc.expectCounts, tc.expectLossless)
+			}
+			if h.Min != tc.expectMin || h.Max != tc.expectMax || math.Abs(h.Mean-tc.expectMean) > 1e-9 {
+				t.Errorf("Min, Max, Mean = %v, %v, %v; want %v, %v, %v", h.Min, h.Max, h.Mean, tc.expectMin, tc.expectMax, tc.expectMean)
+			}
+		})
+	}
+}
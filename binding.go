@@ -84,6 +84,44 @@ func translateError(code int) string {
 	return "Unknown"
 }
 
+// QuantizeError はlibimagequantが返したエラーを表します。
+// Codeはliq_errorの値（QualityTooLow、OutOfMemoryなどの定数）です。
+//
+// errors.Isで同じコードのQuantizeErrorと一致するため、ErrQualityTooLowなどの
+// センチネルと比較して処理を分けることができます。
+//
+// 例:
+//
+//	if errors.Is(err, png.ErrOutOfMemory) {
+//	    // メモリ不足
+//	}
+type QuantizeError struct {
+	Code int
+}
+
+// libimagequantの各エラーコードに対応するセンチネルです。
+var (
+	ErrQualityTooLow   = &QuantizeError{Code: QualityTooLow}
+	ErrValueOutOfRange = &QuantizeError{Code: ValueOutOfRange}
+	ErrOutOfMemory     = &QuantizeError{Code: OutOfMemory}
+	ErrAborted         = &QuantizeError{Code: Aborted}
+	ErrInternalError   = &QuantizeError{Code: InternalError}
+	ErrBufferTooSmall  = &QuantizeError{Code: BufferTooSmall}
+	ErrInvalidPointer  = &QuantizeError{Code: InvalidPointer}
+	ErrUnsupported     = &QuantizeError{Code: Unsupported}
+)
+
+// Error はerrorインターフェースを実装し、エラーメッセージを返します。
+func (e *QuantizeError) Error() string {
+	return fmt.Sprintf(l10n.T("failed to quantize with %s (code %d)"), translateError(e.Code), e.Code)
+}
+
+// Is は、targetが同じコードのQuantizeErrorであるかを判定します。
+func (e *QuantizeError) Is(target error) bool {
+	t, ok := target.(*QuantizeError)
+	return ok && t.Code == e.Code
+}
+
 // decodeRgbaPng はPNGバイトデータをRGBAビットマップデータにデコードします。
 // この関数は、pngquantとの互換性を保証するためにカラーモデル変換を処理します:
 //   - RGBA画像は直接処理されます
@@ -100,7 +138,7 @@ func decodeRgbaPng(data []byte) (*image.RGBA, error) {
 
 	img, err := png.Decode(reader)
 	if err != nil {
-		return nil, fmt.Errorf(l10n.T("failed to decode < %v"), err)
+		return nil, NewDataErrorCodef(decodeErrorCode(err), l10n.T("failed to decode < %v"), err)
 	}
 
 	if _, ok := img.ColorModel().(color.Palette); ok {
@@ -112,7 +150,7 @@ func decodeRgbaPng(data []byte) (*image.RGBA, error) {
 		return rgba, nil
 	}
 
-	return nil, fmt.Errorf(l10n.T("unsupported image type on decoding"))
+	return nil, NewDataErrorCodef(CodeDecodeFailed, l10n.T("unsupported image type on decoding"))
 }
 
 // convertNRGBAToRGBA はNRGBAフォーマットの画像をRGBAフォーマットに変換します。
@@ -165,14 +203,17 @@ func convertNRGBAToRGBA(src *image.NRGBA) *image.RGBA {
 // パレット画像の場合、すでにインデックスカラーフォーマットであるため、
 // 関数は単純に入力をそのまま返します。
 //
+// 複数のゴルーチンから同時に呼び出すことができます。同時に実行する減色の数は
+// SetMaxConcurrentQuantizationsの上限までで、それを超えた呼び出しは待機します。
+//
 // 戻り値:
 //   - []byte: 処理後の画像データ
 //   - bool: pngquantが適用されたかどうか（インデックスカラーの場合はfalse）
-//   - error: エラーが発生した場合
+//   - error: エラーが発生した場合（libimagequantのエラーは*QuantizeError）
 func PNGQuant(data []byte) ([]byte, bool, error) {
 	sample, err := decodeRgbaPng(data)
 	if err != nil {
-		return nil, false, fmt.Errorf(l10n.T("failed to decode first in pngquant < %v"), err)
+		return nil, false, NewDataErrorCodef(CodeOf(err), l10n.T("failed to decode first in pngquant < %v"), err)
 	}
 
 	if sample == nil {
@@ -180,6 +221,10 @@ func PNGQuant(data []byte) ([]byte, bool, error) {
 		return data, false, nil
 	}
 
+	quantizeSemaphore.acquire()
+	defer quantizeSemaphore.release()
+	markQuantizeStarted()
+
 	handle := C.liq_attr_create()
 	defer C.liq_attr_destroy(handle)
 
@@ -195,8 +240,7 @@ func PNGQuant(data []byte) ([]byte, bool, error) {
 	var result *C.liq_result
 	quantize_result := C.liq_image_quantize(input, handle, &result)
 	if quantize_result != LIQ_OK {
-		phrase := translateError(int(quantize_result))
-		return nil, false, fmt.Errorf(l10n.T("failed to quantize with %s (code %d)"), phrase, quantize_result)
+		return nil, false, &QuantizeError{Code: int(quantize_result)}
 	}
 	defer C.liq_result_destroy(result)
 
@@ -232,7 +276,7 @@ func PNGQuant(data []byte) ([]byte, bool, error) {
 	var buf bytes.Buffer
 	err = png.Encode(&buf, paletted)
 	if err != nil {
-		return nil, false, fmt.Errorf(l10n.T("failed to encode pngquant < %v"), err)
+		return nil, false, NewDataErrorCodef(CodeEncodeFailed, l10n.T("failed to encode pngquant < %v"), err)
 	}
 
 	return buf.Bytes(), true, nil
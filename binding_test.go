@@ -1,6 +1,8 @@
 package png
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -184,3 +186,74 @@ func TestAlready8bitPng(t *testing.T) {
 		}
 	}
 }
+
+func TestQuantizeError(t *testing.T) {
+	err := fmt.Errorf("wrapper: %w", &QuantizeError{Code: OutOfMemory})
+
+	if !errors.Is(err, ErrOutOfMemory) {
+		t.Error("errors.Is should match ErrOutOfMemory")
+	}
+	if errors.Is(err, ErrQualityTooLow) {
+		t.Error("errors.Is should not match ErrQualityTooLow")
+	}
+
+	var quantizeErr *QuantizeError
+	if !errors.As(err, &quantizeErr) || quantizeErr.Code != OutOfMemory {
+		t.Errorf("errors.As() = %v; want code %d", quantizeErr, OutOfMemory)
+	}
+	if expected := "failed to quantize with OutOfMemory (code 101)"; quantizeErr.Error() != expected {
+		t.Errorf("Error() = %q; want %q", quantizeErr.Error(), expected)
+	}
+}
+
+func TestHandleQuantizeError(t *testing.T) {
+	decodeErr := NewDataErrorCodef(CodeDecodeFailed, "failed to decode")
+
+	cases := []struct {
+		name          string
+		err           error
+		expectAbort   ErrorCode
+		expectRecord  ErrorCode
+		expectNoError bool
+	}{
+		{"品質不足は適用しないだけ", &QuantizeError{Code: QualityTooLow}, CodeUnknown, CodeUnknown, true},
+		{"メモリ不足は中断", &QuantizeError{Code: OutOfMemory}, CodeOutOfMemory, CodeUnknown, false},
+		{"その他のエラーは記録", &QuantizeError{Code: Aborted}, CodeUnknown, CodeQuantizeFailed, false},
+		{"デコードエラーは記録", decodeErr, CodeUnknown, CodeDecodeFailed, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			optimizer := NewOptimizer("")
+			output := &OptimizePNGOutput{}
+			err := optimizer.handleQuantizeError(output, tc.err)
+
+			if tc.expectAbort != CodeUnknown {
+				if systemErr := AsSystemError(err); systemErr == nil || systemErr.Code() != tc.expectAbort || systemErr.Stage() != StagePNGQuant {
+					t.Errorf("handleQuantizeError() = %v; want SystemError %v", err, tc.expectAbort)
+				}
+				if !errors.Is(err, tc.err) {
+					t.Errorf("handleQuantizeError() = %v; want to wrap %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handleQuantizeError() = %v; want nil", err)
+			}
+
+			if tc.expectNoError {
+				if output.PNGQuantError != nil {
+					t.Errorf("PNGQuantError = %v; want nil", output.PNGQuantError)
+				}
+				return
+			}
+			dataErr := AsDataError(output.PNGQuantError)
+			if dataErr == nil || dataErr.Code() != tc.expectRecord || dataErr.Stage() != StagePNGQuant {
+				t.Errorf("PNGQuantError = %v; want DataError %v", output.PNGQuantError, tc.expectRecord)
+			}
+			if !errors.Is(output.PNGQuantError, tc.err) {
+				t.Errorf("PNGQuantError = %v; want to wrap %v", output.PNGQuantError, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package png
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image/png"
+
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for chunk.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"invalid IHDR chunk length: %d":   "IHDRチャンクの長さが不正です: %d",
+		"invalid image dimensions: %dx%d": "画像サイズが不正です: %dx%d",
+		"unsupported color type: %d":      "サポートされていないカラータイプです: %d",
+	})
+}
+
+// pngSignature はPNGファイル先頭の8バイトのシグネチャです。
+var pngSignature = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
+
+// adam7Passes はAdam7インターレースの各パスの開始位置と間隔です。
+// 要素は順に xStart, yStart, xStep, yStep です。
+var adam7Passes = [7][4]int{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// pngHeader はIHDRチャンクの内容を表します。
+type pngHeader struct {
+	Width     int
+	Height    int
+	BitDepth  int
+	ColorType int
+	Interlace int
+}
+
+// parseIHDR はIHDRチャンクのデータ部を解析します。
+// 画像サイズが0の場合や未知のカラータイプの場合はDataErrorを返します。
+func parseIHDR(data []byte) (*pngHeader, error) {
+	if len(data) != 13 {
+		return nil, NewDataErrorCodef(CodeInvalidHeader, l10n.T("invalid IHDR chunk length: %d"), len(data))
+	}
+
+	h := &pngHeader{
+		Width:     int(binary.BigEndian.Uint32(data[0:4])),
+		Height:    int(binary.BigEndian.Uint32(data[4:8])),
+		BitDepth:  int(data[8]),
+		ColorType: int(data[9]),
+		Interlace: int(data[12]),
+	}
+
+	if h.Width <= 0 || h.Height <= 0 {
+		return nil, NewDataErrorCodef(CodeInvalidHeader, l10n.T("invalid image dimensions: %dx%d"), h.Width, h.Height)
+	}
+	if h.channels() == 0 {
+		return nil, NewDataErrorCodef(CodeUnsupportedColorType, l10n.T("unsupported color type: %d"), h.ColorType)
+	}
+
+	return h, nil
+}
+
+// channels はカラータイプに対応するチャンネル数を返します。
+// 未知のカラータイプの場合は0を返します。
+func (h *pngHeader) channels() int {
+	switch h.ColorType {
+	case 0, 3:
+		return 1
+	case 2:
+		return 3
+	case 4:
+		return 2
+	case 6:
+		return 4
+	}
+	return 0
+}
+
+// rowBytes はフィルタタイプのバイトを除いた、幅widthの1行あたりのバイト数を返します。
+func (h *pngHeader) rowBytes(width int) int64 {
+	bits := int64(width) * int64(h.channels()) * int64(h.BitDepth)
+	return (bits + 7) / 8
+}
+
+// passSizes は画像データを構成する各パスの幅と行数を返します。
+// インターレースでない画像は画像全体の1パスのみで、Adam7の場合は空のパスを除いた各パスになります。
+func (h *pngHeader) passSizes() [][2]int {
+	if h.Interlace == 0 {
+		return [][2]int{{h.Width, h.Height}}
+	}
+
+	var sizes [][2]int
+	for _, p := range adam7Passes {
+		w := (h.Width - p[0] + p[2] - 1) / p[2]
+		rows := (h.Height - p[1] + p[3] - 1) / p[3]
+		if w <= 0 || rows <= 0 {
+			continue
+		}
+		sizes = append(sizes, [2]int{w, rows})
+	}
+	return sizes
+}
+
+// rawDataSize はIDATを展開した後のデータ量（フィルタタイプのバイトを含む）を返します。
+// インターレース画像の場合はAdam7の各パスの合計になります。
+func (h *pngHeader) rawDataSize() int64 {
+	var total int64
+	for _, size := range h.passSizes() {
+		total += int64(size[1]) * (1 + h.rowBytes(size[0]))
+	}
+	return total
+}
+
+// chunkCRC はチャンクタイプとデータからPNGのCRCを計算します。
+func chunkCRC(chunkType string, data []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	return crc.Sum32()
+}
+
+// isValidChunkType はチャンクタイプが4文字の英字で構成されているかを判定します。
+func isValidChunkType(chunkType []byte) bool {
+	if len(chunkType) != 4 {
+		return false
+	}
+	for _, c := range chunkType {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// structureErrorCode はpngstructureの解析エラーに対応するエラーコードを返します。
+// pngstructureのエラーはerrors.Isで比較できないため、センチネルのメッセージで判定します。
+func structureErrorCode(err error) ErrorCode {
+	switch err.Error() {
+	case pngstructure.ErrCrcFailure.Error():
+		return CodeCRCMismatch
+	case pngstructure.ErrNotPng.Error():
+		return CodeInvalidSignature
+	}
+	return CodeInvalidStructure
+}
+
+// decodeErrorCode はimage/pngのデコードエラーに対応するエラーコードを返します。
+func decodeErrorCode(err error) ErrorCode {
+	var formatErr png.FormatError
+	if errors.As(err, &formatErr) {
+		switch formatErr {
+		case "invalid checksum":
+			return CodeCRCMismatch
+		case "not a PNG file":
+			return CodeInvalidSignature
+		}
+	}
+	return CodeDecodeFailed
+}
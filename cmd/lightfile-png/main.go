@@ -0,0 +1,82 @@
+// lightfile-png はPNG画像を最適化するコマンドです。
+//
+// 使い方:
+//
+//	lightfile-png [optimize] [flags] <file|dir>...
+//	lightfile-png worker
+//	lightfile-png quantize
+//
+// optimize はファイルとディレクトリ（再帰的）のPNGを最適化します。フラグは lightfile-png optimize -h で確認できます。
+// worker と quantize は、-isolate を指定した場合などに子プロセスとして起動される減色のワーカーで、
+// 標準入出力で png.ServeWorker と png.ServeQuantize を実行します。
+//
+// 終了コード:
+//
+//	0  すべてのファイルを処理した（最適化済み、削減できないなどでスキップしたファイルを含む）
+//	1  一部のファイルでエラーが発生した
+//	2  引数が不正、または処理するファイルがない
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ideamans/go-l10n"
+	png "github.com/ideamans/lightfile6-png"
+)
+
+func init() {
+	// Register Japanese translations for main.go messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"Usage: %s [optimize] [flags] <file|dir>...\n       %s worker\n       %s quantize\n": "使い方: %s [optimize] [フラグ] <ファイル|ディレクトリ>...\n        %s worker\n        %s quantize\n",
+	})
+}
+
+// 終了コード
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run はサブコマンドを実行し、終了コードを返します。
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "optimize":
+			return runOptimize(args[1:], stdout, stderr)
+		case "worker":
+			return serve(png.ServeWorker, stdin, stdout, stderr)
+		case "quantize":
+			return serve(png.ServeQuantize, stdin, stdout, stderr)
+		case "help", "-h", "-help", "--help":
+			usage(stderr)
+			return exitOK
+		}
+	}
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
+	return runOptimize(args, stdout, stderr)
+}
+
+// serve は減色のワーカーを実行します。
+func serve(fn func(io.Reader, io.Writer) error, stdin io.Reader, stdout, stderr io.Writer) int {
+	if err := fn(stdin, stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// usage は使い方を表示します。
+func usage(w io.Writer) {
+	name := "lightfile-png"
+	fmt.Fprintf(w, l10n.T("Usage: %s [optimize] [flags] <file|dir>...\n       %s worker\n       %s quantize\n"), name, name, name)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	png "github.com/ideamans/lightfile6-png"
+)
+
+// copyFile はテストデータをdestにコピーします。
+func copyFile(t *testing.T, src, dest string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("..", "..", src))
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		t.Fatalf("os.MkdirAll() = %v; want nil", err)
+	}
+	if err := os.WriteFile(dest, data, 0o644); err != nil {
+		t.Fatalf("os.WriteFile() = %v; want nil", err)
+	}
+}
+
+// setupInput は入力のディレクトリを作成します。
+func setupInput(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "in")
+	copyFile(t, "testdata/optimize/psnr-will-50.png", filepath.Join(dir, "a.png"))
+	copyFile(t, "testdata/optimize/already-lightfile-truly.png", filepath.Join(dir, "sub", "b.png"))
+	copyFile(t, "testdata/optimize/psnr-will-50.png", filepath.Join(dir, "vendor", "c.png"))
+	copyFile(t, "testdata/optimize/bad.png", filepath.Join(dir, "notes.txt"))
+	return dir
+}
+
+// listFiles はdirの下のファイルの相対パスを返します。
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		name        string
+		args        func(in, out string) []string
+		expectCode  int
+		expectFiles []string
+		expectOut   string
+	}{
+		{
+			"出力ディレクトリ",
+			func(in, out string) []string { return []string{"-o", out, in} },
+			exitOK, []string{"a.png", "vendor/c.png"}, "3 files: 2 optimized, 1 already optimized",
+		},
+		{
+			"除外パターン",
+			func(in, out string) []string { return []string{"optimize", "-o", out, "-exclude", "vendor", in} },
+			exitOK, []string{"a.png"}, "2 files: 1 optimized, 1 already optimized",
+		},
+		{
+			"対象パターン",
+			func(in, out string) []string { return []string{"-o", out, "-include", "sub/*.png", in} },
+			exitOK, nil, "1 files: 0 optimized, 1 already optimized",
+		},
+		{
+			"ドライラン",
+			func(in, out string) []string { return []string{"-dry-run", "-q", in} },
+			exitOK, nil, "3 files: 2 optimized",
+		},
+		{
+			"一部のファイルが失敗",
+			func(in, out string) []string {
+				return []string{"-o", out, "-include", "*.txt", in, filepath.Join(in, "a.png")}
+			},
+			exitFailed, []string{"a.png"}, "2 files: 1 optimized, 0 already optimized, 0 not smaller, 0 inspection failed, 1 failed",
+		},
+		{"引数なし", func(in, out string) []string { return nil }, exitUsage, nil, ""},
+		{"不明な品質", func(in, out string) []string { return []string{"-quality", "best", "-o", out, in} }, exitUsage, nil, ""},
+		{"不明な出力形式", func(in, out string) []string { return []string{"-format", "xml", "-o", out, in} }, exitUsage, nil, ""},
+		{"出力先の指定なし", func(in, out string) []string { return []string{in} }, exitUsage, nil, ""},
+		{"-oと-in-placeの併用", func(in, out string) []string { return []string{"-o", out, "-in-place", in} }, exitUsage, nil, ""},
+		{"存在しない入力", func(in, out string) []string { return []string{"-o", out, filepath.Join(in, "missing")} }, exitUsage, nil, ""},
+		{"対象のファイルがない", func(in, out string) []string { return []string{"-o", out, "-include", "*.gif", in} }, exitUsage, nil, ""},
+		{"-in-placeなしのバックアップ", func(in, out string) []string { return []string{"-o", out, "-backup-suffix", ".orig", in} }, exitUsage, nil, ""},
+		{"バックアップの指定なしで復元", func(in, out string) []string { return []string{"-restore", in} }, exitUsage, nil, ""},
+		{"-oと-restoreの併用", func(in, out string) []string { return []string{"-o", out, "-restore", "-backup-dir", out, in} }, exitUsage, nil, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := setupInput(t)
+			out := filepath.Join(t.TempDir(), "out")
+
+			var stdout, stderr bytes.Buffer
+			code := run(tc.args(in, out), strings.NewReader(""), &stdout, &stderr)
+			if code != tc.expectCode {
+				t.Fatalf("run() = %d; want %d\nstdout: %s\nstderr: %s", code, tc.expectCode, stdout.String(), stderr.String())
+			}
+			if files := listFiles(t, out); strings.Join(files, ",") != strings.Join(tc.expectFiles, ",") {
+				t.Errorf("output files = %v; want %v", files, tc.expectFiles)
+			}
+			if !strings.Contains(stdout.String(), tc.expectOut) {
+				t.Errorf("stdout = %q; want to contain %q", stdout.String(), tc.expectOut)
+			}
+		})
+	}
+}
+
+func TestRun_InPlace(t *testing.T) {
+	in := setupInput(t)
+	before, err := os.Stat(filepath.Join(in, "a.png"))
+	if err != nil {
+		t.Fatalf("os.Stat() = %v; want nil", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-in-place", "-j", "2", in}, strings.NewReader(""), &stdout, &stderr); code != exitOK {
+		t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitOK, stderr.String())
+	}
+
+	after, err := os.Stat(filepath.Join(in, "a.png"))
+	if err != nil {
+		t.Fatalf("os.Stat() = %v; want nil", err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("size = %d; want smaller than %d", after.Size(), before.Size())
+	}
+	// 進捗はファイルごとに標準エラー出力に表示される
+	if lines := strings.Count(stderr.String(), "\n"); lines != 3 {
+		t.Errorf("stderr has %d lines; want 3\n%s", lines, stderr.String())
+	}
+}
+
+func TestRun_FileAttributes(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		name        string
+		args        func(in, out string) []string
+		inPlace     bool
+		expectMode  os.FileMode
+		expectMtime bool
+	}{
+		{"その場で置き換え", func(in, out string) []string { return []string{"-in-place", in} }, true, 0o640, true},
+		{"出力ディレクトリ", func(in, out string) []string { return []string{"-o", out, in} }, false, 0o640, true},
+		{"コピーしない", func(in, out string) []string {
+			return []string{"-in-place", "-preserve-mode=false", "-preserve-times=false", in}
+		}, true, png.DefaultOutputMode, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := setupInput(t)
+			out := filepath.Join(t.TempDir(), "out")
+			src := filepath.Join(in, "a.png")
+			if err := os.Chmod(src, 0o640); err != nil {
+				t.Fatalf("os.Chmod() = %v; want nil", err)
+			}
+			if err := os.Chtimes(src, mtime, mtime); err != nil {
+				t.Fatalf("os.Chtimes() = %v; want nil", err)
+			}
+
+			var stdout, stderr bytes.Buffer
+			if code := run(tc.args(in, out), strings.NewReader(""), &stdout, &stderr); code != exitOK {
+				t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitOK, stderr.String())
+			}
+
+			dest := filepath.Join(out, "a.png")
+			if tc.inPlace {
+				dest = src
+			}
+			info, err := os.Stat(dest)
+			if err != nil {
+				t.Fatalf("os.Stat() = %v; want nil", err)
+			}
+			if info.Mode().Perm() != tc.expectMode {
+				t.Errorf("mode = %v; want %v", info.Mode().Perm(), tc.expectMode)
+			}
+			if info.ModTime().Equal(mtime) != tc.expectMtime {
+				t.Errorf("mtime = %v; preserved want %v", info.ModTime(), tc.expectMtime)
+			}
+		})
+	}
+}
+
+func TestRun_Backup(t *testing.T) {
+	cases := []struct {
+		name       string
+		args       func(backupDir string) []string
+		backupPath func(in, backupDir string) string
+	}{
+		{
+			"サフィックス",
+			func(backupDir string) []string { return []string{"-backup-suffix", ".orig"} },
+			func(in, backupDir string) string { return filepath.Join(in, "a.png.orig") },
+		},
+		{
+			"ディレクトリ",
+			func(backupDir string) []string { return []string{"-backup-dir", backupDir} },
+			func(in, backupDir string) string { return filepath.Join(backupDir, "a.png") },
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := setupInput(t)
+			backupDir := filepath.Join(in, "backup")
+			src := filepath.Join(in, "a.png")
+			original, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+
+			var stdout, stderr bytes.Buffer
+			args := append(append([]string{"-in-place"}, tc.args(backupDir)...), in)
+			if code := run(args, strings.NewReader(""), &stdout, &stderr); code != exitOK {
+				t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitOK, stderr.String())
+			}
+			if backup, err := os.ReadFile(tc.backupPath(in, backupDir)); err != nil || !bytes.Equal(backup, original) {
+				t.Fatalf("backup = %d bytes, %v; want the original %d bytes", len(backup), err, len(original))
+			}
+
+			// 2回目はバックアップのファイルやディレクトリを対象にせず、最初のバックアップを残す
+			stdout.Reset()
+			if code := run(args, strings.NewReader(""), &stdout, &stderr); code != exitOK {
+				t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitOK, stderr.String())
+			}
+			if expect := "3 files: 0 optimized, 3 already optimized"; !strings.Contains(stdout.String(), expect) {
+				t.Errorf("stdout = %q; want to contain %q", stdout.String(), expect)
+			}
+
+			// 復元するとバックアップは削除され、バックアップのないファイルはそのまま
+			stdout.Reset()
+			args = append(append([]string{"-restore"}, tc.args(backupDir)...), in)
+			if code := run(args, strings.NewReader(""), &stdout, &stderr); code != exitOK {
+				t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitOK, stderr.String())
+			}
+			if expect := "3 files: 2 restored, 1 without backup, 0 failed"; !strings.Contains(stdout.String(), expect) {
+				t.Errorf("stdout = %q; want to contain %q", stdout.String(), expect)
+			}
+			if restored, err := os.ReadFile(src); err != nil || !bytes.Equal(restored, original) {
+				t.Errorf("restored = %d bytes, %v; want the original %d bytes", len(restored), err, len(original))
+			}
+			if _, err := os.Stat(tc.backupPath(in, backupDir)); !os.IsNotExist(err) {
+				t.Errorf("os.Stat(backup) = %v; want not exist", err)
+			}
+		})
+	}
+}
+
+func TestRun_CaseInsensitive(t *testing.T) {
+	in := setupInput(t)
+	copyFile(t, "testdata/optimize/psnr-will-50.png", filepath.Join(in, "D.PNG"))
+	copyFile(t, "testdata/optimize/psnr-will-50.png", filepath.Join(in, "e.Png"))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-dry-run", "-q", in}, strings.NewReader(""), &stdout, &stderr); code != exitOK {
+		t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitOK, stderr.String())
+	}
+	if expect := "5 files: 4 optimized"; !strings.Contains(stdout.String(), expect) {
+		t.Errorf("stdout = %q; want to contain %q", stdout.String(), expect)
+	}
+}
+
+func TestRun_Collision(t *testing.T) {
+	in := setupInput(t)
+	other := filepath.Join(t.TempDir(), "other")
+	copyFile(t, "testdata/optimize/psnr-will-50.png", filepath.Join(other, "a.png"))
+	out := filepath.Join(t.TempDir(), "out")
+
+	// 異なるディレクトリの同じ相対パスのファイルは、出力先が重なるため拒否する
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-o", out, in, other}, strings.NewReader(""), &stdout, &stderr); code != exitUsage {
+		t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitUsage, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), filepath.Join(out, "a.png")) {
+		t.Errorf("stderr = %q; want to contain the colliding path", stderr.String())
+	}
+	if files := listFiles(t, out); len(files) != 0 {
+		t.Errorf("output files = %v; want none", files)
+	}
+
+	// 同じファイルを重ねて指定した場合は1度だけ処理する
+	stdout.Reset()
+	if code := run([]string{"-o", out, in, filepath.Join(in, "a.png")}, strings.NewReader(""), &stdout, &stderr); code != exitOK {
+		t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitOK, stderr.String())
+	}
+	if expect := "3 files:"; !strings.Contains(stdout.String(), expect) {
+		t.Errorf("stdout = %q; want to contain %q", stdout.String(), expect)
+	}
+}
+
+func TestRun_Format(t *testing.T) {
+	cases := []struct {
+		name   string
+		format string
+		decode func(t *testing.T, stdout string) (files int, summaryTotal int)
+	}{
+		{
+			"NDJSON",
+			"ndjson",
+			func(t *testing.T, stdout string) (int, int) {
+				lines := strings.Split(strings.TrimSpace(stdout), "\n")
+				files := 0
+				var summary png.SummaryReport
+				for i, line := range lines {
+					var head struct {
+						Type string `json:"type"`
+					}
+					if err := json.Unmarshal([]byte(line), &head); err != nil {
+						t.Fatalf("json.Unmarshal(%q) = %v; want nil", line, err)
+					}
+					switch {
+					case head.Type == png.ReportTypeFile:
+						files++
+					case head.Type == png.ReportTypeSummary && i == len(lines)-1:
+						json.Unmarshal([]byte(line), &summary)
+					default:
+						t.Errorf("line %d type = %q; unexpected", i, head.Type)
+					}
+				}
+				return files, summary.Total
+			},
+		},
+		{
+			"JSON",
+			"json",
+			func(t *testing.T, stdout string) (int, int) {
+				var report batchReport
+				if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+					t.Fatalf("json.Unmarshal() = %v; want nil\n%s", err, stdout)
+				}
+				if report.SchemaVersion != png.ReportSchemaVersion || report.Type != "batch" {
+					t.Errorf("schemaVersion, type = %d, %q; want %d, %q", report.SchemaVersion, report.Type, png.ReportSchemaVersion, "batch")
+				}
+				return len(report.Files), report.Summary.Total
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := setupInput(t)
+			out := filepath.Join(t.TempDir(), "out")
+
+			var stdout, stderr bytes.Buffer
+			code := run([]string{"-o", out, "-format", tc.format, in}, strings.NewReader(""), &stdout, &stderr)
+			if code != exitOK {
+				t.Fatalf("run() = %d; want %d\nstderr: %s", code, exitOK, stderr.String())
+			}
+			files, total := tc.decode(t, stdout.String())
+			if files != 3 || total != 3 {
+				t.Errorf("files, summary total = %d, %d; want 3, 3", files, total)
+			}
+			// 進捗は標準エラー出力のまま
+			if lines := strings.Count(stderr.String(), "\n"); lines != 3 {
+				t.Errorf("stderr has %d lines; want 3\n%s", lines, stderr.String())
+			}
+		})
+	}
+}
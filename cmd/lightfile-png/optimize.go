@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ideamans/go-l10n"
+	png "github.com/ideamans/lightfile6-png"
+)
+
+func init() {
+	// Register Japanese translations for optimize.go messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"quality profile: high, medium, low or force":                    "品質のプロファイル: high、medium、low、force",
+		"write optimized files under `dir`, mirroring input directories": "最適化したファイルを `dir` の下に入力のディレクトリ構成のまま書き込む",
+		"replace the input files with the optimized files":               "入力ファイルを最適化したファイルで置き換える",
+		"number of files optimized at once (0 means the number of CPUs)": "同時に最適化するファイルの数（0はCPU数）",
+		"glob of file names or relative paths to include (repeatable)":   "対象にするファイル名または相対パスのglob（複数指定可）",
+		"glob of file names or relative paths to exclude (repeatable)":   "除外するファイル名または相対パスのglob（複数指定可）",
+		"report the results without writing any files":                   "ファイルを書き込まずに結果だけを表示する",
+		"do not print the progress of each file":                         "ファイルごとの進捗を表示しない",
+		"quantize in isolated worker processes":                          "減色を分離したワーカープロセスで行う",
+		"time limit of each quantization with -isolate (0 means none)":   "-isolate での1回の減色の制限時間（0は無制限）",
+		"output format of the results: text, json or ndjson":             "結果の出力形式: text、json、ndjson",
+		"unknown quality %q":                         "不明な品質 %q です",
+		"unknown format %q":                          "不明な出力形式 %q です",
+		"failed to write the report: %v":             "レポートの書き込みに失敗しました: %v",
+		"-o and -in-place cannot be used together":   "-o と -in-place は同時に指定できません",
+		"either -o or -in-place is required":         "-o または -in-place を指定してください",
+		"invalid glob %q: %v":                        "不正なglob %q です: %v",
+		"no input files or directories":              "入力のファイルまたはディレクトリがありません",
+		"no PNG files found":                         "PNGファイルが見つかりません",
+		"failed to start workers: %v":                "ワーカーの起動に失敗しました: %v",
+		"failed to create output directory: %v":      "出力ディレクトリの作成に失敗しました: %v",
+		"[%d/%d] %s: %s -> %s (-%.1f%%), PSNR %s":    "[%d/%d] %s: %s -> %s (-%.1f%%), PSNR %s",
+		"[%d/%d] %s: already optimized":              "[%d/%d] %s: 最適化済み",
+		"[%d/%d] %s: not smaller after optimization": "[%d/%d] %s: 最適化しても小さくならない",
+		"[%d/%d] %s: PSNR below threshold":           "[%d/%d] %s: PSNRが閾値未満",
+		"[%d/%d] %s: error: %v":                      "[%d/%d] %s: エラー: %v",
+		"%d files: %d optimized, %d already optimized, %d not smaller, %d inspection failed, %d failed": "%d ファイル: 最適化 %d, 最適化済み %d, 削減不可 %d, 検査不合格 %d, 失敗 %d",
+		"Saved %s of %s (%.1f%%)": "%s 削減 (%s 中, %.1f%%)",
+
+		// -backup-suffix、-backup-dir、-restore
+		"with -in-place, keep the original of each file as <file>`suffix`":                          "-in-place で、元のファイルを <ファイル>`suffix` として残す",
+		"with -in-place, keep the originals under `dir`, mirroring input directories":               "-in-place で、元のファイルを `dir` の下に入力のディレクトリ構成のまま残す",
+		"restore the files from the backups of -backup-suffix or -backup-dir instead of optimizing": "最適化せずに -backup-suffix または -backup-dir のバックアップからファイルを元に戻す",
+		"-backup-suffix and -backup-dir require -in-place":                                          "-backup-suffix と -backup-dir には -in-place が必要です",
+		"-restore requires -backup-suffix or -backup-dir":                                           "-restore には -backup-suffix または -backup-dir が必要です",
+		"-restore cannot be used with -o, -dry-run or -format":                                      "-restore は -o、-dry-run、-format と同時に指定できません",
+		"%s and %s would both be written to %s":                                                     "%s と %s の出力先がどちらも %s になります",
+		"[%d/%d] %s: restored":                                                                      "[%d/%d] %s: 復元",
+		"[%d/%d] %s: no backup":                                                                     "[%d/%d] %s: バックアップなし",
+		"%d files: %d restored, %d without backup, %d failed":                                       "%d ファイル: 復元 %d, バックアップなし %d, 失敗 %d",
+
+		// -preserve-mode、-preserve-times
+		"copy the permission of each input file to its output (otherwise 0600)": "入力ファイルのパーミッションを出力にコピーする（しない場合は0600）",
+		"copy the modification time of each input file to its output":           "入力ファイルの更新日時を出力にコピーする",
+	})
+}
+
+// stringList は複数回指定できる文字列のフラグです。
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// optimizeOptions は optimize サブコマンドのフラグです。
+type optimizeOptions struct {
+	quality     string
+	outputDir   string
+	inPlace     bool
+	concurrency int
+	include     stringList
+	exclude     stringList
+	dryRun      bool
+	quiet       bool
+	isolate     bool
+	timeout     time.Duration
+	format      string
+
+	backupSuffix string
+	backupDir    string
+	restore      bool
+
+	preserveMode  bool
+	preserveTimes bool
+}
+
+// target は最適化する1つのファイルです。
+type target struct {
+	src  string
+	dest string
+	// root は引数で指定したディレクトリ（ファイルの場合はその親ディレクトリ）で、
+	// rel はrootからの相対パスです。-o と -backup-dir の下にはrelの構成で書き込みます。
+	root string
+	rel  string
+}
+
+// batchReport は -format json で出力するJSONです。
+type batchReport struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	Type          string             `json:"type"`
+	Files         []*png.FileReport  `json:"files"`
+	Summary       *png.SummaryReport `json:"summary"`
+}
+
+// defaultInclude は -include を指定しない場合に対象にするファイル名のパターンです。
+// パターンは大文字と小文字を区別しないため、.PNG や .Png も対象になります。
+var defaultInclude = []string{"*.png"}
+
+// runOptimize は optimize サブコマンドを実行し、終了コードを返します。
+func runOptimize(args []string, stdout, stderr io.Writer) int {
+	var opts optimizeOptions
+	flags := flag.NewFlagSet("optimize", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&opts.quality, "quality", "medium", l10n.T("quality profile: high, medium, low or force"))
+	flags.StringVar(&opts.outputDir, "o", "", l10n.T("write optimized files under `dir`, mirroring input directories"))
+	flags.BoolVar(&opts.inPlace, "in-place", false, l10n.T("replace the input files with the optimized files"))
+	flags.IntVar(&opts.concurrency, "j", 0, l10n.T("number of files optimized at once (0 means the number of CPUs)"))
+	flags.Var(&opts.include, "include", l10n.T("glob of file names or relative paths to include (repeatable)"))
+	flags.Var(&opts.exclude, "exclude", l10n.T("glob of file names or relative paths to exclude (repeatable)"))
+	flags.BoolVar(&opts.dryRun, "dry-run", false, l10n.T("report the results without writing any files"))
+	flags.BoolVar(&opts.quiet, "q", false, l10n.T("do not print the progress of each file"))
+	flags.BoolVar(&opts.isolate, "isolate", false, l10n.T("quantize in isolated worker processes"))
+	flags.DurationVar(&opts.timeout, "timeout", 0, l10n.T("time limit of each quantization with -isolate (0 means none)"))
+	flags.StringVar(&opts.format, "format", "text", l10n.T("output format of the results: text, json or ndjson"))
+	flags.StringVar(&opts.backupSuffix, "backup-suffix", "", l10n.T("with -in-place, keep the original of each file as <file>`suffix`"))
+	flags.StringVar(&opts.backupDir, "backup-dir", "", l10n.T("with -in-place, keep the originals under `dir`, mirroring input directories"))
+	flags.BoolVar(&opts.restore, "restore", false, l10n.T("restore the files from the backups of -backup-suffix or -backup-dir instead of optimizing"))
+	flags.BoolVar(&opts.preserveMode, "preserve-mode", true, l10n.T("copy the permission of each input file to its output (otherwise 0600)"))
+	flags.BoolVar(&opts.preserveTimes, "preserve-times", true, l10n.T("copy the modification time of each input file to its output"))
+	flags.Usage = func() {
+		usage(stderr)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if err := opts.validate(flags.NArg()); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if len(opts.include) == 0 {
+		opts.include = defaultInclude
+	}
+
+	targets, err := collectTargets(flags.Args(), &opts)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(stderr, l10n.T("no PNG files found"))
+		return exitUsage
+	}
+	if opts.restore {
+		return runRestore(targets, &opts, stdout, stderr)
+	}
+
+	optimizer := png.NewOptimizer(opts.quality)
+	optimizer.DryRun = opts.dryRun
+	optimizer.PreserveMode = opts.preserveMode
+	optimizer.PreserveTimes = opts.preserveTimes
+	if !opts.preserveMode {
+		// -in-place でも既存のパーミッションを維持しない
+		optimizer.OutputMode = png.DefaultOutputMode
+	}
+	if opts.isolate {
+		executable, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(stderr, l10n.T("failed to start workers: %v")+"\n", err)
+			return exitFailed
+		}
+		pool := png.NewWorkerPool([]string{executable, "worker"}, opts.concurrency)
+		pool.Timeout = opts.timeout
+		defer pool.Close()
+		optimizer.Workers = pool
+	}
+
+	jobs := make([]png.BatchJob, 0, len(targets))
+	for _, t := range targets {
+		if !opts.dryRun && opts.outputDir != "" {
+			if err := os.MkdirAll(filepath.Dir(t.dest), 0o755); err != nil {
+				fmt.Fprintf(stderr, l10n.T("failed to create output directory: %v")+"\n", err)
+				return exitFailed
+			}
+		}
+		job := png.BatchJob{Src: t.src, Dest: t.dest}
+		if backup := opts.backup(t); backup != nil {
+			job.Configure = func(o *png.Optimizer) { o.Backup = backup }
+		}
+		jobs = append(jobs, job)
+	}
+
+	// 進捗は常に標準エラー出力に、結果は -format の形式で標準出力に書き込む
+	done := 0
+	ndjson := png.NewNDJSONWriter(stdout)
+	var reports []*png.FileReport
+	var writeErr error
+	batch := png.NewBatchOptimizer(optimizer, opts.concurrency)
+	summary := batch.Run(jobs, func(result png.BatchResult) bool {
+		done++
+		if !opts.quiet || result.Outcome == png.OutcomeError {
+			printResult(stderr, done, len(jobs), result)
+		}
+		switch opts.format {
+		case "json":
+			reports = append(reports, result.Report())
+		case "ndjson":
+			if err := ndjson.Write(result.Report()); err != nil && writeErr == nil {
+				writeErr = err
+			}
+		}
+		return true
+	})
+
+	switch opts.format {
+	case "text":
+		printSummary(stdout, summary)
+	case "json":
+		if reports == nil {
+			reports = []*png.FileReport{}
+		}
+		encoder := json.NewEncoder(stdout)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		writeErr = encoder.Encode(batchReport{
+			SchemaVersion: png.ReportSchemaVersion,
+			Type:          "batch",
+			Files:         reports,
+			Summary:       summary.Report(),
+		})
+	case "ndjson":
+		if err := ndjson.Write(summary.Report()); err != nil && writeErr == nil {
+			writeErr = err
+		}
+	}
+	if writeErr != nil {
+		fmt.Fprintf(stderr, l10n.T("failed to write the report: %v")+"\n", writeErr)
+		return exitFailed
+	}
+
+	if summary.Outcomes[png.OutcomeError] > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// validate はフラグの組み合わせを確認します。
+func (opts *optimizeOptions) validate(nargs int) error {
+	switch opts.quality {
+	case "high", "medium", "low", "force":
+	default:
+		return fmt.Errorf(l10n.T("unknown quality %q"), opts.quality)
+	}
+	switch opts.format {
+	case "text", "json", "ndjson":
+	default:
+		return fmt.Errorf(l10n.T("unknown format %q"), opts.format)
+	}
+	if opts.outputDir != "" && opts.inPlace {
+		return errors.New(l10n.T("-o and -in-place cannot be used together"))
+	}
+	hasBackup := opts.backupSuffix != "" || opts.backupDir != ""
+	if opts.restore {
+		if !hasBackup {
+			return errors.New(l10n.T("-restore requires -backup-suffix or -backup-dir"))
+		}
+		if opts.outputDir != "" || opts.dryRun || opts.format != "text" {
+			return errors.New(l10n.T("-restore cannot be used with -o, -dry-run or -format"))
+		}
+	} else {
+		if opts.outputDir == "" && !opts.inPlace && !opts.dryRun {
+			return errors.New(l10n.T("either -o or -in-place is required"))
+		}
+		if hasBackup && !opts.inPlace {
+			return errors.New(l10n.T("-backup-suffix and -backup-dir require -in-place"))
+		}
+	}
+	for _, pattern := range append(append([]string{}, opts.include...), opts.exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf(l10n.T("invalid glob %q: %v"), pattern, err)
+		}
+	}
+	if nargs == 0 {
+		return errors.New(l10n.T("no input files or directories"))
+	}
+	return nil
+}
+
+// collectTargets は引数のファイルとディレクトリから最適化するファイルを集めます。
+// ディレクトリは再帰的にたどり、-include と -exclude に一致するファイルだけを対象にします。
+// 引数で直接指定したファイルは常に対象にします。
+// 同じファイルは1度だけ対象にし、異なるファイルの出力先やバックアップ先が重なる場合はエラーを返します。
+func collectTargets(args []string, opts *optimizeOptions) ([]target, error) {
+	// 出力先とバックアップのディレクトリはたどらない
+	var skipDirs []string
+	for _, dir := range []string{opts.outputDir, opts.backupDir} {
+		if dir != "" {
+			abs, _ := filepath.Abs(dir)
+			skipDirs = append(skipDirs, abs)
+		}
+	}
+
+	var targets []target
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			rel := filepath.Base(arg)
+			targets = append(targets, target{src: arg, dest: opts.destPath(arg, rel), root: filepath.Dir(arg), rel: rel})
+			continue
+		}
+
+		err = filepath.WalkDir(arg, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(arg, path)
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if rel == "." {
+					return nil
+				}
+				// 出力先、バックアップ、除外したディレクトリはたどらない
+				if abs, _ := filepath.Abs(path); slices.Contains(skipDirs, abs) || matchAny(opts.exclude, rel) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() || !matchAny(opts.include, rel) || matchAny(opts.exclude, rel) {
+				return nil
+			}
+			// -backup-suffix のバックアップは対象にしない
+			if opts.backupSuffix != "" && strings.HasSuffix(rel, opts.backupSuffix) {
+				return nil
+			}
+			targets = append(targets, target{src: path, dest: opts.destPath(path, rel), root: arg, rel: rel})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return uniqueTargets(targets, opts)
+}
+
+// uniqueTargets は同じファイルの重複を取り除き、異なるファイルの -o の出力先または
+// -backup-dir のバックアップ先が重なる場合はエラーを返します。
+func uniqueTargets(targets []target, opts *optimizeOptions) ([]target, error) {
+	sources := make(map[string]bool, len(targets))
+	placed := make(map[string]string, len(targets))
+	unique := targets[:0]
+	for _, t := range targets {
+		src, _ := filepath.Abs(t.src)
+		if sources[src] {
+			continue
+		}
+		sources[src] = true
+
+		// -o と -backup-dir はどちらもrelの構成で書き込むため、relが重なると衝突する
+		if opts.outputDir != "" || opts.backupDir != "" {
+			key := filepath.Clean(t.rel)
+			if other, ok := placed[key]; ok {
+				dir := opts.outputDir
+				if dir == "" {
+					dir = opts.backupDir
+				}
+				return nil, fmt.Errorf(l10n.T("%s and %s would both be written to %s"), other, t.src, filepath.Join(dir, t.rel))
+			}
+			placed[key] = t.src
+		}
+		unique = append(unique, t)
+	}
+	return unique, nil
+}
+
+// backup はtのファイルを -in-place で置き換える前に元のファイルを残す場所を返します。
+// -backup-suffix も -backup-dir も指定されていない場合はnilです。
+func (opts *optimizeOptions) backup(t target) *png.Backup {
+	if opts.backupSuffix == "" && opts.backupDir == "" {
+		return nil
+	}
+	backup := &png.Backup{Suffix: opts.backupSuffix}
+	if opts.backupDir != "" {
+		backup.Dir = opts.backupDir
+		backup.Root = t.root
+	}
+	return backup
+}
+
+// runRestore は -restore でファイルをバックアップから元に戻し、終了コードを返します。
+// バックアップのないファイルはそのままにします。
+func runRestore(targets []target, opts *optimizeOptions, stdout, stderr io.Writer) int {
+	var restored, missing, failed int
+	for i, t := range targets {
+		err := opts.backup(t).Restore(t.src)
+		switch {
+		case err == nil:
+			restored++
+			if !opts.quiet {
+				fmt.Fprintf(stderr, l10n.T("[%d/%d] %s: restored")+"\n", i+1, len(targets), t.src)
+			}
+		case errors.Is(err, fs.ErrNotExist):
+			missing++
+			if !opts.quiet {
+				fmt.Fprintf(stderr, l10n.T("[%d/%d] %s: no backup")+"\n", i+1, len(targets), t.src)
+			}
+		default:
+			failed++
+			fmt.Fprintf(stderr, l10n.T("[%d/%d] %s: error: %v")+"\n", i+1, len(targets), t.src, err)
+		}
+	}
+
+	fmt.Fprintf(stdout, l10n.T("%d files: %d restored, %d without backup, %d failed")+"\n", len(targets), restored, missing, failed)
+	if failed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// destPath は入力ファイルsrcの出力先を返します。relは出力ディレクトリの下に置く相対パスです。
+func (opts *optimizeOptions) destPath(src, rel string) string {
+	if opts.outputDir != "" {
+		return filepath.Join(opts.outputDir, rel)
+	}
+	return src
+}
+
+// matchAny は、相対パスrelまたはそのファイル名がpatternsのいずれかに一致するかを判定します。
+// 大文字と小文字は区別しません。
+func matchAny(patterns []string, rel string) bool {
+	slashed := strings.ToLower(filepath.ToSlash(rel))
+	base := strings.ToLower(filepath.Base(rel))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, slashed); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// printResult は1つのファイルの結果を表示します。
+func printResult(w io.Writer, done, total int, result png.BatchResult) {
+	src := result.Job.Src
+	switch result.Outcome {
+	case png.OutcomeOptimized:
+		output := result.Output
+		fmt.Fprintf(w, l10n.T("[%d/%d] %s: %s -> %s (-%.1f%%), PSNR %s")+"\n", done, total, src,
+			humanize.Bytes(uint64(output.BeforeSize)), humanize.Bytes(uint64(output.AfterSize)),
+			savedPercent(output.BeforeSize, output.AfterSize), formatPSNR(output.FinalPSNR))
+	case png.OutcomeAlreadyOptimized:
+		fmt.Fprintf(w, l10n.T("[%d/%d] %s: already optimized")+"\n", done, total, src)
+	case png.OutcomeCantOptimize:
+		fmt.Fprintf(w, l10n.T("[%d/%d] %s: not smaller after optimization")+"\n", done, total, src)
+	case png.OutcomeInspectionFailed:
+		fmt.Fprintf(w, l10n.T("[%d/%d] %s: PSNR below threshold")+"\n", done, total, src)
+	case png.OutcomeError:
+		fmt.Fprintf(w, l10n.T("[%d/%d] %s: error: %v")+"\n", done, total, src, result.Err)
+	}
+}
+
+// printSummary は全体の集計を表示します。
+func printSummary(w io.Writer, summary *png.BatchSummary) {
+	fmt.Fprintf(w, l10n.T("%d files: %d optimized, %d already optimized, %d not smaller, %d inspection failed, %d failed")+"\n",
+		summary.Total,
+		summary.Outcomes[png.OutcomeOptimized],
+		summary.Outcomes[png.OutcomeAlreadyOptimized],
+		summary.Outcomes[png.OutcomeCantOptimize],
+		summary.Outcomes[png.OutcomeInspectionFailed],
+		summary.Outcomes[png.OutcomeError])
+	if summary.BeforeSize > 0 {
+		fmt.Fprintf(w, l10n.T("Saved %s of %s (%.1f%%)")+"\n",
+			humanize.Bytes(uint64(summary.BytesSaved)), humanize.Bytes(uint64(summary.BeforeSize)),
+			savedPercent(summary.BeforeSize, summary.AfterSize))
+	}
+}
+
+// savedPercent は削減率（%）を返します。
+func savedPercent(before, after int64) float64 {
+	if before == 0 {
+		return 0
+	}
+	return float64(before-after) / float64(before) * 100
+}
+
+// formatPSNR はPSNRを表示用の文字列にします。無限大（画素が変わっていない）は "inf" です。
+func formatPSNR(psnr float64) string {
+	if math.IsInf(psnr, 1) {
+		return "inf"
+	}
+	return fmt.Sprintf("%.2f dB", psnr)
+}
@@ -19,14 +19,43 @@ func init() {
 	})
 }
 
+const (
+	// CommentSchemaLegacy is the schema version of comments written before
+	// the schema field was introduced (By/Before/After/PNGQuant/PSNR only).
+	CommentSchemaLegacy = 1
+	// CommentSchemaVersion is the schema version of comments written by this library.
+	CommentSchemaVersion = 2
+)
+
 // LightFileComment represents the metadata structure for PNG optimization comments.
 // All fields are public and JSON-serializable.
+// Fields added in schema version 2 are omitted from JSON when empty, so comments
+// written by older versions (including the legacy LightFile6 format) still parse.
 type LightFileComment struct {
-	By       string   `json:"by"`       // Optimization tool identifier
-	Before   int64    `json:"before"`   // Original file size in bytes
-	After    int64    `json:"after"`    // Optimized file size in bytes
-	PNGQuant bool     `json:"pngquant"` // Indicates if PNGQuant was used
-	PSNR     MaybeInf `json:"psnr"`     // Peak signal-to-noise ratio (0.0+ or Inf)
+	Schema     int            `json:"schema,omitempty"`  // Comment schema version (0 means CommentSchemaLegacy)
+	By         string         `json:"by"`                // Optimization tool identifier
+	Version    string         `json:"ver,omitempty"`     // Library version that produced the file
+	Profile    string         `json:"profile,omitempty"` // Quality profile (high, medium, low, force)
+	Before     int64          `json:"before"`            // Original file size in bytes
+	After      int64          `json:"after"`             // Optimized file size in bytes
+	PNGQuant   bool           `json:"pngquant"`          // Indicates if PNGQuant was used
+	Metric     string         `json:"metric,omitempty"`  // Name of the quality metric stored in PSNR
+	PSNR       MaybeInf       `json:"psnr"`              // Peak signal-to-noise ratio (0.0+ or Inf)
+	Stages     []string       `json:"stages,omitempty"`  // Optimization stages applied, in order
+	Timestamp  int64          `json:"ts,omitempty"`      // Unix time of optimization in seconds
+	SourceHash string         `json:"src,omitempty"`     // Hash of the original file ("sha256:<hex>")
+	History    []HistoryEntry `json:"hist,omitempty"`    // Previous optimizations, oldest first (compact arrays)
+	OutputHash string         `json:"out,omitempty"`     // Hash of the file an external marker belongs to ("sha256:<hex>")
+	Signature  string         `json:"sig,omitempty"`     // Keyed signature over pixels and the stored text; must stay the last field (see SignComment)
+}
+
+// SchemaVersion returns the schema version of the comment.
+// Comments without a schema field are reported as CommentSchemaLegacy.
+func (c *LightFileComment) SchemaVersion() int {
+	if c.Schema == 0 {
+		return CommentSchemaLegacy
+	}
+	return c.Schema
 }
 
 // PNGMeta defines the interface for PNG metadata operations.
@@ -51,18 +80,35 @@ type PNGMeta interface {
 	//   - error: DataError if PNG structure is invalid
 	WriteComment(data []byte, comment *LightFileComment) ([]byte, error)
 
-	// WriteCommentString writes an arbitrary string as a tEXt chunk into PNG data.
+	// WriteCommentString writes an arbitrary string as a text chunk into PNG data.
 	// Returns:
 	//   - []byte: New PNG data with comment embedded
 	//   - error: DataError if PNG structure is invalid
 	WriteCommentString(data []byte, comment string) ([]byte, error)
 }
 
+// commentKeyword is the keyword of text chunks holding the LightFile comment.
+const commentKeyword = "LightFile"
+
 // PNGMetaManager implements the PNGMeta interface for PNG metadata operations.
-type PNGMetaManager struct{}
+type PNGMetaManager struct {
+	// Placement selects where WriteCommentString inserts the comment chunk.
+	Placement CommentPlacement
+}
+
+// CommentPlacement is the position of the LightFile comment chunk in a PNG.
+type CommentPlacement int
+
+const (
+	// CommentBeforeIEND places the comment just before IEND (default).
+	CommentBeforeIEND CommentPlacement = iota
+	// CommentBeforeIDAT places the comment just before the first IDAT, so that
+	// DetectMarker can find it after reading only the first few hundred bytes.
+	CommentBeforeIDAT
+)
 
 // ReadComment reads and parses PNG comment data from raw PNG bytes.
-// It extracts the tEXt chunk with "LightFile" keyword and attempts to parse it as JSON.
+// It extracts the tEXt, zTXt or iTXt chunk with "LightFile" keyword and attempts to parse it as JSON.
 // Returns:
 //   - *LightFileComment: Parsed comment if valid JSON, nil otherwise
 //   - string: Raw comment string (empty if no comment found)
@@ -72,87 +118,104 @@ func (m *PNGMetaManager) ReadComment(data []byte) (*LightFileComment, string, er
 
 	mediaContext, err := pmp.ParseBytes(data)
 	if err != nil {
-		return nil, "", NewDataErrorf(l10n.T("failed to parse PNG structure: %v"), err)
+		return nil, "", NewDataErrorCodef(structureErrorCode(err), l10n.T("failed to parse PNG structure: %v"), err)
 	}
 
 	cs, ok := mediaContext.(*pngstructure.ChunkSlice)
 	if !ok {
-		return nil, "", NewDataError(l10n.T("unexpected media context type"))
+		return nil, "", NewDataErrorCodef(CodeInvalidStructure, l10n.T("unexpected media context type"))
 	}
 	chunks := cs.Chunks()
 
 	for _, chunk := range chunks {
-		if chunk.Type == "tEXt" {
-			textData := chunk.Data
+		if comment, raw, found := parseCommentChunk(chunk.Type, chunk.Data); found {
+			return comment, raw, nil
+		}
+	}
 
-			// Try to parse both formats:
-			// 1. Correct format: keyword\0text (e.g., "LightFile\0{JSON}")
-			// 2. Legacy incorrect format: direct JSON (e.g., "{JSON}")
+	return nil, "", nil
+}
 
-			nullIndex := bytes.IndexByte(textData, 0)
-			if nullIndex == -1 {
-				// Legacy format: Try to parse entire chunk as JSON
-				var comment LightFileComment
-				err := json.Unmarshal(textData, &comment)
-				if err == nil && comment.By == "LightFile6" {
-					// Successfully parsed as legacy format
-					return &comment, string(textData), nil
-				}
-				continue
-			}
+// parseCommentChunk checks whether a chunk holds a LightFile comment and parses it.
+// Returns:
+//   - *LightFileComment: Parsed comment if valid JSON, nil otherwise
+//   - string: Raw comment string
+//   - bool: Whether the chunk is a LightFile comment
+func parseCommentChunk(chunkType string, data []byte) (*LightFileComment, string, bool) {
+	if !isTextChunk(chunkType) {
+		return nil, "", false
+	}
 
-			// Correct format: keyword\0text
-			keyword := string(textData[:nullIndex])
-			text := string(textData[nullIndex+1:])
+	// Try to parse both formats:
+	// 1. Correct format: keyword\0text in tEXt, zTXt or iTXt (e.g., "LightFile\0{JSON}")
+	// 2. Legacy incorrect format: direct JSON in tEXt (e.g., "{JSON}")
 
-			// Look for LightFile comment
-			if keyword == "LightFile" {
-				var comment LightFileComment
-				err := json.Unmarshal([]byte(text), &comment)
-				if err != nil {
-					// Return raw text even if JSON parsing fails
-					return nil, text, nil
-				}
-				return &comment, text, nil
-			}
+	keyword, ok := textChunkKeyword(data)
+	if !ok {
+		if chunkType != "tEXt" {
+			return nil, "", false
+		}
+		// Legacy format: Try to parse entire chunk as JSON
+		var comment LightFileComment
+		err := json.Unmarshal(data, &comment)
+		if err == nil && comment.By == "LightFile6" {
+			// Successfully parsed as legacy format
+			return &comment, string(data), true
 		}
+		return nil, "", false
 	}
 
-	return nil, "", nil
+	// Look for LightFile comment
+	if keyword != commentKeyword {
+		return nil, "", false
+	}
+
+	_, text, err := decodeTextChunk(chunkType, data)
+	if err != nil {
+		// Skip comments that cannot be decompressed
+		return nil, "", false
+	}
+
+	// Return raw text even if JSON parsing fails
+	comment, _ := parseCommentText([]byte(text))
+	return comment, text, true
 }
 
 // BuildComment builds a JSON comment from LightFileComment and calculates the size increase.
 // It returns the JSON string and the number of bytes that will be added to the PNG
-// when this comment is written as a tEXt chunk (including chunk overhead).
+// when this comment is written as a text chunk (including chunk overhead).
+// The chunk type is the one WriteCommentString will pick (the smallest of tEXt, zTXt and iTXt).
 // Returns:
 //   - string: JSON representation of the comment
-//   - int: Number of bytes that will be added to PNG (comment + tEXt chunk overhead)
+//   - int: Number of bytes that will be added to PNG (comment + text chunk overhead)
 //   - error: DataError if JSON marshaling fails (should not happen with valid input)
 func (m *PNGMetaManager) BuildComment(comment *LightFileComment) (string, int, error) {
 	// Convert comment to JSON
 	jsonData, err := json.Marshal(comment)
 	if err != nil {
 		// JSON marshaling failure is a data error (invalid struct contents)
-		return "", 0, NewDataErrorf(l10n.T("failed to marshal comment to JSON: %v"), err)
+		return "", 0, NewDataErrorCodef(CodeCommentFailed, l10n.T("failed to marshal comment to JSON: %v"), err)
 	}
 
 	jsonString := string(jsonData)
-	keyword := "LightFile"
 
-	// Calculate tEXt chunk overhead:
+	chunk, err := encodeTextChunk(commentKeyword, jsonString)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Calculate text chunk size:
 	// - 4 bytes for length field
-	// - 4 bytes for type ("tEXt")
-	// - keyword length + 1 (null terminator)
-	// - text data length
+	// - 4 bytes for type ("tEXt", "zTXt" or "iTXt")
+	// - chunk data length (keyword, separators and text)
 	// - 4 bytes for CRC
-	chunkOverhead := 4 + 4 + len(keyword) + 1 + 4 // 13 + keyword length
-	totalIncrease := chunkOverhead + len(jsonString)
+	totalIncrease := 4 + 4 + len(chunk.Data) + 4
 
 	return jsonString, totalIncrease, nil
 }
 
 // WriteComment writes a LightFileComment as JSON into PNG data.
-// It inserts a tEXt chunk containing the JSON representation of the comment.
+// It inserts a text chunk containing the JSON representation of the comment.
 // Returns:
 //   - []byte: New PNG data with comment embedded
 //   - error: DataError if PNG structure is invalid or JSON marshaling fails
@@ -168,7 +231,10 @@ func (m *PNGMetaManager) WriteComment(data []byte, comment *LightFileComment) ([
 	return m.WriteCommentString(data, jsonString)
 }
 
-// WriteCommentString writes an arbitrary string as a tEXt chunk into PNG data.
+// WriteCommentString writes an arbitrary string as a text chunk into PNG data.
+// The smallest encoding among tEXt, zTXt and iTXt is used; text containing
+// non-ASCII characters is always written as UTF-8 iTXt.
+// Existing LightFile comments in any text chunk type are replaced.
 // Returns:
 //   - []byte: New PNG data with comment embedded
 //   - error: DataError if PNG structure is invalid
@@ -177,37 +243,34 @@ func (m *PNGMetaManager) WriteCommentString(data []byte, comment string) ([]byte
 
 	mediaContext, err := pmp.ParseBytes(data)
 	if err != nil {
-		return nil, NewDataErrorf(l10n.T("failed to parse PNG structure: %v"), err)
+		return nil, NewDataErrorCodef(structureErrorCode(err), l10n.T("failed to parse PNG structure: %v"), err)
 	}
 
-	// Create tEXt chunk data
-	keyword := "LightFile"
-	textData := make([]byte, len(keyword)+1+len(comment))
-	copy(textData, keyword)
-	textData[len(keyword)] = 0 // null separator
-	copy(textData[len(keyword)+1:], comment)
+	// Create text chunk
+	textChunk, err := encodeTextChunk(commentKeyword, comment)
+	if err != nil {
+		return nil, err
+	}
 
-	// Find where to insert the tEXt chunk (before IEND)
+	// Find where to insert the text chunk (before IEND)
 	cs, ok := mediaContext.(*pngstructure.ChunkSlice)
 	if !ok {
-		return nil, NewDataError(l10n.T("unexpected media context type"))
+		return nil, NewDataErrorCodef(CodeInvalidStructure, l10n.T("unexpected media context type"))
 	}
 	chunks := cs.Chunks()
 	newChunks := make([]*pngstructure.Chunk, 0, len(chunks)+1)
 
-	// Remove existing LightFile tEXt chunks
+	// Remove existing LightFile text chunks
 	for _, chunk := range chunks {
-		if chunk.Type == "tEXt" {
+		if isTextChunk(chunk.Type) {
 			// Check if this is a LightFile comment
 			chunkData := chunk.Data
-			nullIndex := bytes.IndexByte(chunkData, 0)
-			if nullIndex != -1 {
-				chunkKeyword := string(chunkData[:nullIndex])
-				if chunkKeyword == "LightFile" {
+			if chunkKeyword, ok := textChunkKeyword(chunkData); ok {
+				if chunkKeyword == commentKeyword {
 					// Skip this chunk (remove it)
 					continue
 				}
-			} else {
+			} else if chunk.Type == "tEXt" {
 				// Legacy format: check if it's a LightFile6 JSON comment
 				var comment LightFileComment
 				if json.Unmarshal(chunkData, &comment) == nil && comment.By == "LightFile6" {
@@ -219,17 +282,18 @@ func (m *PNGMetaManager) WriteCommentString(data []byte, comment string) ([]byte
 		newChunks = append(newChunks, chunk)
 	}
 
-	// Find IEND chunk and insert new tEXt before it
+	// Find IEND (or the first IDAT) chunk and insert new text chunk before it
+	anchor := "IEND"
+	if m.Placement == CommentBeforeIDAT {
+		anchor = "IDAT"
+	}
+
 	finalChunks := make([]*pngstructure.Chunk, 0, len(newChunks)+1)
 	inserted := false
 
 	for _, chunk := range newChunks {
-		if chunk.Type == "IEND" && !inserted {
-			// Insert our tEXt chunk before IEND
-			textChunk := &pngstructure.Chunk{
-				Type: "tEXt",
-				Data: textData,
-			}
+		if chunk.Type == anchor && !inserted {
+			// Insert our text chunk before the anchor chunk
 			finalChunks = append(finalChunks, textChunk)
 			inserted = true
 		}
@@ -237,7 +301,10 @@ func (m *PNGMetaManager) WriteCommentString(data []byte, comment string) ([]byte
 	}
 
 	if !inserted {
-		return nil, NewDataError(l10n.T("png file missing IEND chunk"))
+		if anchor == "IDAT" {
+			return nil, NewDataErrorCodef(CodeMissingChunk, l10n.T("png file missing IDAT chunk"))
+		}
+		return nil, NewDataErrorCodef(CodeMissingChunk, l10n.T("png file missing IEND chunk"))
 	}
 
 	// Rebuild PNG with new chunks
@@ -249,7 +316,7 @@ func (m *PNGMetaManager) WriteCommentString(data []byte, comment string) ([]byte
 	for _, chunk := range finalChunks {
 		err := writeChunk(&buf, chunk)
 		if err != nil {
-			return nil, NewDataErrorf(l10n.T("failed to write chunk: %v"), err)
+			return nil, NewDataErrorCodef(CodeEncodeFailed, l10n.T("failed to write chunk: %v"), err)
 		}
 	}
 
@@ -313,7 +380,7 @@ func crc32PNG(data []byte) uint32 {
 var defaultPNGMetaManager = &PNGMetaManager{}
 
 // ReadComment reads and parses PNG comment data from raw PNG bytes using the default manager.
-// It extracts the tEXt chunk with "LightFile" keyword and attempts to parse it as JSON.
+// It extracts the tEXt, zTXt or iTXt chunk with "LightFile" keyword and attempts to parse it as JSON.
 // Returns:
 //   - *LightFileComment: Parsed comment if valid JSON, nil otherwise
 //   - string: Raw comment string (empty if no comment found)
@@ -338,7 +405,7 @@ func BuildComment(comment *LightFileComment) (string, int, error) {
 	return jsonStr, len(jsonStr), nil
 }
 
-// WriteComment writes a string as a tEXt chunk into PNG data using the default manager.
+// WriteComment writes a string as a text chunk into PNG data using the default manager.
 // This is a convenience function that accepts a string directly instead of a LightFileComment.
 // Returns:
 //   - []byte: New PNG data with comment embedded
@@ -2,6 +2,7 @@ package png
 
 import (
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -272,6 +273,77 @@ func TestReadComment_BothFormats(t *testing.T) {
 	}
 }
 
+func TestReadComment_SchemaVersion(t *testing.T) {
+	t.Run("Legacy comments", func(t *testing.T) {
+		for _, filename := range []string{
+			"testdata/optimize/already-lightfile.png",
+			"testdata/optimize/already-lightfile-truly.png",
+		} {
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+
+			comment, _, err := ReadComment(data)
+			if err != nil {
+				t.Fatalf("ReadComment failed: %v", err)
+			}
+			if comment == nil {
+				t.Fatalf("Expected to read LightFile comment from %s, got nil", filename)
+			}
+
+			if comment.SchemaVersion() != CommentSchemaLegacy {
+				t.Errorf("SchemaVersion() = %d, want %d", comment.SchemaVersion(), CommentSchemaLegacy)
+			}
+			if comment.Version != "" || comment.Profile != "" || len(comment.Stages) != 0 {
+				t.Errorf("Expected empty provenance fields for legacy comment, got: %+v", comment)
+			}
+		}
+	})
+
+	t.Run("Current schema round trip", func(t *testing.T) {
+		originalData, err := os.ReadFile("testdata/variations/colortype_rgb.png")
+		if err != nil {
+			t.Skipf("Test PNG file not found: %v", err)
+		}
+
+		testComment := &LightFileComment{
+			Schema:     CommentSchemaVersion,
+			By:         "LightFile",
+			Version:    Version,
+			Profile:    "high",
+			Before:     2048,
+			After:      1536,
+			PNGQuant:   true,
+			Metric:     "psnr",
+			PSNR:       45.5,
+			Stages:     []string{"strip", "pngquant"},
+			Timestamp:  1700000000,
+			SourceHash: "sha256:00",
+		}
+
+		modifiedData, err := defaultPNGMetaManager.WriteComment(originalData, testComment)
+		if err != nil {
+			t.Fatalf("WriteComment failed: %v", err)
+		}
+
+		readComment, _, err := ReadComment(modifiedData)
+		if err != nil {
+			t.Fatalf("ReadComment failed: %v", err)
+		}
+		if readComment == nil {
+			t.Fatal("Expected to read LightFile comment, got nil")
+		}
+
+		if !reflect.DeepEqual(readComment, testComment) {
+			t.Errorf("Comment mismatch:\nExpected: %+v\nGot: %+v", testComment, readComment)
+		}
+		if readComment.SchemaVersion() != CommentSchemaVersion {
+			t.Errorf("SchemaVersion() = %d, want %d", readComment.SchemaVersion(), CommentSchemaVersion)
+		}
+	})
+}
+
 // Helper function to check if a string contains a substring
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(s) > len(substr) && (s[:len(substr)] == substr || s[len(s)-len(substr):] == substr || containsAt(s, substr, 1)))
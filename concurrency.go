@@ -0,0 +1,123 @@
+package png
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for concurrency.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"quantize threads must be set before the first quantization": "減色のスレッド数は最初の減色の前に設定する必要があります",
+	})
+}
+
+// quantizeThreadsEnv は、libimagequantが内部で使用するスレッド数を読み込む環境変数です。
+const quantizeThreadsEnv = "RAYON_NUM_THREADS"
+
+// quantizeSemaphore はこのプロセスで同時に実行するlibimagequantの減色の数を制限します。
+var quantizeSemaphore = newSemaphore(runtime.GOMAXPROCS(0))
+
+// quantizeStarted は最初の減色が始まったかどうかで、quantizeThreadsMuで保護します。
+// libimagequantはスレッドプールを最初の減色で作成するため、それ以降はスレッド数を変更できません。
+var (
+	quantizeThreadsMu sync.Mutex
+	quantizeStarted   bool
+)
+
+// markQuantizeStarted は減色の開始を記録します。
+// SetQuantizeThreadsによる環境変数の書き込みが完了するまで待機するため、
+// libimagequantが書き込み途中の環境変数を読み込むことはありません。
+func markQuantizeStarted() {
+	quantizeThreadsMu.Lock()
+	quantizeStarted = true
+	quantizeThreadsMu.Unlock()
+}
+
+// SetMaxConcurrentQuantizations は、このプロセスで同時に実行するPNGQuantの数の上限を設定します。
+// 上限を超えた呼び出しは、実行中の減色が終わるまで待機します。
+// libimagequantは1回の減色で大量のCPUとメモリを使用するため、多数のゴルーチンから
+// 同時に減色するとかえって遅くなります。0以下の場合は制限しません。
+//
+// 初期値はruntime.GOMAXPROCS(0)です。実行中に変更しても安全です。
+func SetMaxConcurrentQuantizations(n int) {
+	quantizeSemaphore.setLimit(n)
+}
+
+// MaxConcurrentQuantizations は、同時に実行するPNGQuantの数の上限を返します。0は制限がないことを示します。
+func MaxConcurrentQuantizations() int {
+	return quantizeSemaphore.getLimit()
+}
+
+// SetQuantizeThreads は、libimagequantが1回の減色で使用するスレッド数を設定します。
+// 0以下の場合はlibimagequantの既定（CPU数）を使用します。
+//
+// スレッドプールは最初の減色で作成されるため、このプロセスで最初にPNGQuantやOptimizer.Runを
+// 呼び出す前（通常はmainの初期化時）に設定してください。それ以降に呼び出した場合は
+// CodeInvalidOptionのSystemErrorを返します。減色の開始とは排他的に実行されるため、
+// 他のゴルーチンで減色が始まる可能性がある場合も環境変数が競合して書き込まれることはありません。
+// 設定は環境変数 RAYON_NUM_THREADS として、後から起動するWorkerPoolのワーカーや
+// Optimizer.QuantizeCommandの子プロセスにも引き継がれます。
+func SetQuantizeThreads(n int) error {
+	quantizeThreadsMu.Lock()
+	defer quantizeThreadsMu.Unlock()
+	if quantizeStarted {
+		return NewSystemErrorf(CodeInvalidOption, l10n.T("quantize threads must be set before the first quantization"))
+	}
+	if n <= 0 {
+		return os.Unsetenv(quantizeThreadsEnv)
+	}
+	return os.Setenv(quantizeThreadsEnv, strconv.Itoa(n))
+}
+
+// semaphore は上限を実行中に変更できるセマフォです。上限が0以下の場合は制限しません。
+type semaphore struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+// newSemaphore は上限がlimitのセマフォを作成します。
+func newSemaphore(limit int) *semaphore {
+	s := &semaphore{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire は空きができるまで待機してから1つ確保します。
+func (s *semaphore) acquire() {
+	s.mu.Lock()
+	for s.limit > 0 && s.active >= s.limit {
+		s.cond.Wait()
+	}
+	s.active++
+	s.mu.Unlock()
+}
+
+// release はacquireで確保した1つを解放します。
+func (s *semaphore) release() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// setLimit は上限を変更します。上限を増やした場合は待機中の呼び出しを再開します。
+func (s *semaphore) setLimit(limit int) {
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// getLimit は現在の上限を返します。
+func (s *semaphore) getLimit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
@@ -0,0 +1,263 @@
+package png
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// syncLogger は複数のゴルーチンから使用できるTestLoggerです
+type syncLogger struct {
+	mu sync.Mutex
+	TestLogger
+}
+
+func (l *syncLogger) Debug(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.TestLogger.Debug(format, args...)
+}
+
+func (l *syncLogger) Info(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.TestLogger.Info(format, args...)
+}
+
+func (l *syncLogger) Warn(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.TestLogger.Warn(format, args...)
+}
+
+func (l *syncLogger) Error(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.TestLogger.Error(format, args...)
+}
+
+func TestSemaphore(t *testing.T) {
+	cases := []struct {
+		name      string
+		limit     int
+		expectMax int32
+	}{
+		{"上限1", 1, 1},
+		{"上限3", 3, 3},
+		{"制限なし", 0, 8},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSemaphore(tc.limit)
+			var active, max atomic.Int32
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					s.acquire()
+					defer s.release()
+					n := active.Add(1)
+					for {
+						m := max.Load()
+						if n <= m || max.CompareAndSwap(m, n) {
+							break
+						}
+					}
+					time.Sleep(20 * time.Millisecond)
+					active.Add(-1)
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			if max.Load() != tc.expectMax {
+				t.Errorf("max active = %d; want %d", max.Load(), tc.expectMax)
+			}
+		})
+	}
+
+	t.Run("上限を増やすと待機中の呼び出しが再開する", func(t *testing.T) {
+		s := newSemaphore(1)
+		s.acquire()
+		acquired := make(chan struct{})
+		go func() {
+			s.acquire()
+			close(acquired)
+		}()
+
+		select {
+		case <-acquired:
+			t.Fatal("acquire() returned over the limit")
+		case <-time.After(50 * time.Millisecond):
+		}
+		s.setLimit(2)
+		select {
+		case <-acquired:
+		case <-time.After(time.Second):
+			t.Fatal("acquire() did not return after setLimit(2)")
+		}
+	})
+}
+
+func TestPNGQuant_Concurrent(t *testing.T) {
+	previous := MaxConcurrentQuantizations()
+	SetMaxConcurrentQuantizations(2)
+	defer SetMaxConcurrentQuantizations(previous)
+
+	data, err := os.ReadFile("testdata/binding/psnr-will-50.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	expected, _, err := PNGQuant(data)
+	if err != nil {
+		t.Fatalf("PNGQuant() = %v; want nil", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			actual, quantized, err := PNGQuant(data)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !quantized || !bytes.Equal(actual, expected) {
+				errs <- fmt.Errorf("result differs from sequential PNGQuant")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSetQuantizeThreads(t *testing.T) {
+	data, err := os.ReadFile("testdata/binding/psnr-will-50.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	if _, _, err := PNGQuant(data); err != nil {
+		t.Fatalf("PNGQuant() = %v; want nil", err)
+	}
+
+	// 最初の減色の後はスレッド数を変更できない
+	previous := os.Getenv(quantizeThreadsEnv)
+	if err := SetQuantizeThreads(127); AsSystemError(err) == nil || CodeOf(err) != CodeInvalidOption {
+		t.Errorf("SetQuantizeThreads() = %v; want SystemError with code %s", err, CodeInvalidOption)
+	}
+	if actual := os.Getenv(quantizeThreadsEnv); actual != previous {
+		t.Errorf("%s = %q after a failed SetQuantizeThreads(); want %q", quantizeThreadsEnv, actual, previous)
+	}
+}
+
+func TestOptimizer_PSNRThreshold(t *testing.T) {
+	cases := []struct {
+		name                   string
+		threshold              float64
+		expectInspectionFailed bool
+	}{
+		{"NewOptimizerの閾値", PSNRThreshold, false},
+		{"既定の閾値", 0, false},
+		{"閾値を超えない", 1000, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			optimizer := NewOptimizer("")
+			if optimizer.PSNRThreshold != PSNRThreshold {
+				t.Errorf("PSNRThreshold = %v; want %v", optimizer.PSNRThreshold, PSNRThreshold)
+			}
+			optimizer.PSNRThreshold = tc.threshold
+			optimizer.DryRun = true
+			output, err := optimizer.Run("testdata/optimize/psnr-will-50.png", filepath.Join(t.TempDir(), "out.png"))
+			if err != nil {
+				t.Fatalf("Run() = %v; want nil", err)
+			}
+			if output.InspectionFailed != tc.expectInspectionFailed {
+				t.Errorf("InspectionFailed = %v; want %v", output.InspectionFailed, tc.expectInspectionFailed)
+			}
+		})
+	}
+	// 0の場合はパッケージ変数ではなく定数の閾値を使う
+	if threshold := (&Optimizer{}).psnrThreshold(); threshold != DefaultPSNRThreshold {
+		t.Errorf("psnrThreshold() = %v; want %v", threshold, DefaultPSNRThreshold)
+	}
+}
+
+func TestOptimizer_Concurrent(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	src := "testdata/optimize/psnr-will-50.png"
+
+	expected, err := NewOptimizer("").Run(src, filepath.Join(tempDir, "expected.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+
+	pool := NewWorkerPool(helperCommand("worker-helper"), 2)
+	defer pool.Close()
+
+	cases := []struct {
+		name      string
+		optimizer func() *Optimizer
+	}{
+		{"同じプロセスで減色", func() *Optimizer { return NewOptimizer("") }},
+		{"ワーカープールで減色", func() *Optimizer {
+			optimizer := NewOptimizer("")
+			optimizer.Workers = pool
+			return optimizer
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// すべてのゴルーチンで1つのOptimizerを共有する
+			optimizer := tc.optimizer()
+			optimizer.Analyze = true
+			optimizer.Verify = true
+			optimizer.PSNRThreshold = 30
+			logger := &syncLogger{}
+			optimizer.SetLogger(logger)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 16)
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					output, err := optimizer.Run(src, filepath.Join(tempDir, fmt.Sprintf("%s-%d.png", tc.name, i)))
+					if err != nil {
+						errs <- err
+						return
+					}
+					if output.PNGQuant != expected.PNGQuant || output.SizeAfterPNGQuant != expected.SizeAfterPNGQuant || output.FinalPSNR != expected.FinalPSNR {
+						errs <- fmt.Errorf("output %d = %+v; want %+v", i, output, expected)
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			if len(logger.InfoMessages) == 0 {
+				t.Error("InfoMessages is empty; want logs of all runs")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for detect.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"failed to read PNG data: %w": "PNGデータの読み込みに失敗しました: %w",
+		"failed to open PNG file: %w": "PNGファイルを開けませんでした: %w",
+	})
+}
+
+// maxDetectTextChunkSize はDetectMarkerが読み込むテキストチャンクの最大サイズです。
+// これより大きなテキストチャンクはLightFileコメントではないとみなして読み飛ばします。
+const maxDetectTextChunkSize = 1 << 20
+
+// DetectMarker は、PNGデータをチャンク単位で先頭から読み進め、LightFileコメントを探します。
+// PNG全体を読み込んで解析するReadCommentと異なり、テキストチャンク以外の本体
+// （IDATなど）は読み込まずに読み飛ばし、コメントが見つかった時点で読み込みを終了します。
+// CRCの検証は行いません。
+//
+// コメントをIDATより前に配置したファイル（CommentBeforeIDAT）であれば、
+// 先頭の数百バイトを読むだけで判定が完了します。
+//
+// 戻り値はReadCommentと同じです。シグネチャが不正な場合はDataErrorを返しますが、
+// 途中で途切れたファイルはその時点までにコメントが見つからなければnilを返します。
+func DetectMarker(r io.ReaderAt) (*LightFileComment, string, error) {
+	signature := make([]byte, len(pngSignature))
+	if _, err := r.ReadAt(signature, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", NewSystemErrorf(CodeIO, l10n.T("failed to read PNG data: %w"), err)
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return nil, "", NewDataErrorCodef(CodeInvalidSignature, l10n.T("not a PNG file: invalid signature"))
+	}
+
+	offset := int64(len(pngSignature))
+	header := make([]byte, 8)
+	for {
+		if _, err := r.ReadAt(header, offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, "", nil
+			}
+			return nil, "", NewSystemErrorf(CodeIO, l10n.T("failed to read PNG data: %w"), err)
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		chunkType := string(header[4:8])
+
+		if chunkType == "IEND" {
+			return nil, "", nil
+		}
+
+		if isTextChunk(chunkType) && length <= maxDetectTextChunkSize {
+			data := make([]byte, length)
+			if _, err := r.ReadAt(data, offset+8); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, "", nil
+				}
+				return nil, "", NewSystemErrorf(CodeIO, l10n.T("failed to read PNG data: %w"), err)
+			}
+
+			if comment, raw, found := parseCommentChunk(chunkType, data); found {
+				return comment, raw, nil
+			}
+		}
+
+		// 長さ、タイプ、データ、CRCを読み飛ばす
+		offset += 12 + length
+	}
+}
+
+// DetectMarkerFile は、ファイルに対してDetectMarkerを実行します。
+func DetectMarkerFile(path string) (*LightFileComment, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", NewSystemErrorf(CodeIO, l10n.T("failed to open PNG file: %w"), err)
+	}
+	defer file.Close()
+
+	return DetectMarker(file)
+}
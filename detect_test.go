@@ -0,0 +1,154 @@
+package png
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingReaderAt は読み込んだバイト数を記録するio.ReaderAtです
+type countingReaderAt struct {
+	r    *bytes.Reader
+	read int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read += n
+	return n, err
+}
+
+func TestDetectMarker(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		expectBy string
+	}{
+		{"コメントなし", "testdata/variations/metadata_text.png", ""},
+		{"旧形式", "testdata/optimize/already-lightfile.png", "LightFile6"},
+		{"正しい形式", "testdata/optimize/already-lightfile-truly.png", "LightFile6"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+
+			comment, raw, err := DetectMarker(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("DetectMarker() = %v; want nil", err)
+			}
+
+			// ReadCommentと同じ結果になること
+			expected, expectedRaw, err := ReadComment(data)
+			if err != nil {
+				t.Fatalf("ReadComment() = %v; want nil", err)
+			}
+			if raw != expectedRaw {
+				t.Errorf("raw = %q; want %q", raw, expectedRaw)
+			}
+
+			if tc.expectBy == "" {
+				if comment != nil {
+					t.Errorf("DetectMarker() = %+v; want nil", comment)
+				}
+				return
+			}
+			if comment == nil || comment.By != tc.expectBy || comment.After != expected.After {
+				t.Errorf("DetectMarker() = %+v; want %+v", comment, expected)
+			}
+		})
+	}
+
+	t.Run("PNG以外", func(t *testing.T) {
+		_, _, err := DetectMarker(bytes.NewReader([]byte("not a png file")))
+		if AsDataError(err) == nil {
+			t.Errorf("DetectMarker() = %v; want DataError", err)
+		}
+	})
+
+	t.Run("途中で途切れたファイル", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/variations/metadata_none.png")
+		if err != nil {
+			t.Fatalf("os.ReadFile() = %v; want nil", err)
+		}
+		comment, _, err := DetectMarker(bytes.NewReader(data[:len(data)/2]))
+		if err != nil || comment != nil {
+			t.Errorf("DetectMarker() = %+v, %v; want nil, nil", comment, err)
+		}
+	})
+}
+
+func TestDetectMarker_SkipsImageData(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/metadata_none.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	comment := &LightFileComment{Schema: CommentSchemaVersion, By: "LightFile", Before: 2048, After: 1024}
+
+	cases := []struct {
+		name      string
+		placement CommentPlacement
+		maxRead   int
+	}{
+		{"IENDの前", CommentBeforeIEND, len(original) / 10},
+		{"IDATの前", CommentBeforeIDAT, 512},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			manager := &PNGMetaManager{Placement: tc.placement}
+			data, err := manager.WriteComment(original, comment)
+			if err != nil {
+				t.Fatalf("WriteComment() = %v; want nil", err)
+			}
+
+			reader := &countingReaderAt{r: bytes.NewReader(data)}
+			detected, _, err := DetectMarker(reader)
+			if err != nil {
+				t.Fatalf("DetectMarker() = %v; want nil", err)
+			}
+			if detected == nil || detected.After != comment.After {
+				t.Errorf("DetectMarker() = %+v; want %+v", detected, comment)
+			}
+			if reader.read > tc.maxRead {
+				t.Errorf("DetectMarker() read %d bytes; want <= %d", reader.read, tc.maxRead)
+			}
+		})
+	}
+}
+
+func TestOptimize_MarkerBeforeIDAT(t *testing.T) {
+	t.Parallel()
+	destPath := filepath.Join(t.TempDir(), "before-idat.png")
+
+	optimizer := NewOptimizer("")
+	optimizer.MarkerPlacement = CommentBeforeIDAT
+	if _, err := optimizer.Run("testdata/optimize/psnr-will-50.png", destPath); err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+
+	comment, _, err := DetectMarkerFile(destPath)
+	if err != nil {
+		t.Fatalf("DetectMarkerFile() = %v; want nil", err)
+	}
+	if comment == nil || comment.By != "LightFile" {
+		t.Errorf("DetectMarkerFile() = %+v; want LightFile comment", comment)
+	}
+
+	// コメントがIDATより前にあるため、先頭付近を読むだけで見つかる
+	data, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	reader := &countingReaderAt{r: bytes.NewReader(data)}
+	if _, _, err := DetectMarker(reader); err != nil {
+		t.Fatalf("DetectMarker() = %v; want nil", err)
+	}
+	if reader.read > 1024 {
+		t.Errorf("DetectMarker() read %d bytes; want <= 1024", reader.read)
+	}
+}
@@ -13,8 +13,141 @@ import (
 //
 // インスタンスの作成にはNewDataErrorを使用し、エラーがDataErrorかどうかを
 // 確認するにはAsDataErrorを使用してください。
+//
+// メッセージは翻訳されるため、エラーの種類で処理を分ける場合はCodeを、
+// 発生したパイプラインのステージを知りたい場合はStageを使用してください。
 type DataError struct {
 	message string
+	code    ErrorCode
+	stage   Stage
+	cause   error
+	stack   []byte
+}
+
+// ErrorCode はDataErrorとSystemErrorの原因の種類を表します。
+type ErrorCode int
+
+const (
+	// CodeUnknown は種類が分類されていないエラーです。
+	CodeUnknown ErrorCode = iota
+	// CodeLimitExceeded は画像がLimitsの上限を超えていることを示します。
+	CodeLimitExceeded
+	// CodeInvalidSignature はPNGのシグネチャが不正であることを示します。
+	CodeInvalidSignature
+	// CodeCRCMismatch はチャンクのCRCが一致しないことを示します。
+	CodeCRCMismatch
+	// CodeInvalidStructure はチャンクの並びを解析できないことを示します。
+	CodeInvalidStructure
+	// CodeMissingChunk はIHDR、IDAT、IENDなどの必須のチャンクがないことを示します。
+	CodeMissingChunk
+	// CodeInvalidHeader はIHDRの内容が不正であることを示します。
+	CodeInvalidHeader
+	// CodeUnsupportedColorType はサポートされていないカラータイプであることを示します。
+	CodeUnsupportedColorType
+	// CodeMalformedChunk は補助チャンク（テキスト、メタデータなど）の内容が不正であることを示します。
+	CodeMalformedChunk
+	// CodeDecodeFailed は画像のデコードに失敗したことを示します。
+	CodeDecodeFailed
+	// CodeEncodeFailed は画像やチャンクのエンコードに失敗したことを示します。
+	CodeEncodeFailed
+	// CodeStripFailed はメタデータの削除に失敗したことを示します。
+	CodeStripFailed
+	// CodeQuantizeFailed は減色に失敗したことを示します。
+	CodeQuantizeFailed
+	// CodeMetricFailed はPSNRなどの画質の指標の計算に失敗したことを示します。
+	CodeMetricFailed
+	// CodeCommentFailed はLightFileコメントの構築や書き込みに失敗したことを示します。
+	CodeCommentFailed
+	// CodePixelsChanged は可逆であるはずのステージでピクセルが変わったことを示します。
+	CodePixelsChanged
+	// CodeIO はファイルの読み書きに失敗したことを示します（SystemErrorのみ）。
+	CodeIO
+	// CodeOutOfMemory は減色の際にメモリが不足したことを示します（SystemErrorのみ）。
+	CodeOutOfMemory
+	// CodePanic は処理中に発生したパニックを回復したことを示します。
+	// DataError.Stackでパニック発生時のスタックトレースを参照できます。
+	CodePanic
+	// CodeWorkerCrashed は減色を行う子プロセスが応答せずに終了したことを示します。
+	CodeWorkerCrashed
+	// CodeWorkerTimeout は減色を行う子プロセスが制限時間内に応答しなかったことを示します。
+	CodeWorkerTimeout
+	// CodeInvalidOption はマーカーの保存方式などの設定が不正であることを示します（SystemErrorのみ）。
+	CodeInvalidOption
+	// CodeCommentNotFound はLightFileコメントが存在しないことを示します（ErrCommentNotFound）。
+	CodeCommentNotFound
+	// CodeCommentNotSigned はLightFileコメントに署名がないことを示します（ErrCommentNotSigned）。
+	CodeCommentNotSigned
+	// CodeSignatureMismatch はLightFileコメントの署名が一致しないことを示します（ErrSignatureMismatch）。
+	CodeSignatureMismatch
+	// CodeVerificationFailed は書き込んだ出力ファイルの検証に失敗したことを示します（ErrVerificationFailed）。
+	CodeVerificationFailed
+	// CodeWorkerMemoryLimit は減色を行う子プロセスがWorkerPool.MemoryLimitを超えて終了したことを示します。
+	CodeWorkerMemoryLimit
+	// CodeWorkerPoolClosed はCloseを呼び出した後のWorkerPoolで減色しようとしたことを示します（SystemErrorのみ）。
+	CodeWorkerPoolClosed
+)
+
+// String はエラーコードの名前を返します。
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeUnknown:
+		return "unknown"
+	case CodeLimitExceeded:
+		return "limit_exceeded"
+	case CodeInvalidSignature:
+		return "invalid_signature"
+	case CodeCRCMismatch:
+		return "crc_mismatch"
+	case CodeInvalidStructure:
+		return "invalid_structure"
+	case CodeMissingChunk:
+		return "missing_chunk"
+	case CodeInvalidHeader:
+		return "invalid_header"
+	case CodeUnsupportedColorType:
+		return "unsupported_color_type"
+	case CodeMalformedChunk:
+		return "malformed_chunk"
+	case CodeDecodeFailed:
+		return "decode_failed"
+	case CodeEncodeFailed:
+		return "encode_failed"
+	case CodeStripFailed:
+		return "strip_failed"
+	case CodeQuantizeFailed:
+		return "quantize_failed"
+	case CodeMetricFailed:
+		return "metric_failed"
+	case CodeCommentFailed:
+		return "comment_failed"
+	case CodePixelsChanged:
+		return "pixels_changed"
+	case CodeIO:
+		return "io"
+	case CodeOutOfMemory:
+		return "out_of_memory"
+	case CodePanic:
+		return "panic"
+	case CodeWorkerCrashed:
+		return "worker_crashed"
+	case CodeWorkerTimeout:
+		return "worker_timeout"
+	case CodeInvalidOption:
+		return "invalid_option"
+	case CodeCommentNotFound:
+		return "comment_not_found"
+	case CodeCommentNotSigned:
+		return "comment_not_signed"
+	case CodeSignatureMismatch:
+		return "signature_mismatch"
+	case CodeVerificationFailed:
+		return "verification_failed"
+	case CodeWorkerMemoryLimit:
+		return "worker_memory_limit"
+	case CodeWorkerPoolClosed:
+		return "worker_pool_closed"
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
 }
 
 // NewDataError は、指定されたメッセージで新しいDataErrorを作成します。
@@ -36,13 +169,48 @@ func (e *DataError) Error() string {
 }
 
 // NewDataErrorf は、フォーマット文字列とその引数から新しいDataErrorを作成します。
-// fmt.Sprintf と同じフォーマット規則を使用します。
+// fmt.Errorf と同じフォーマット規則を使用します。
+// 引数に含まれるエラー（%wまたは%vで指定したもの）は原因として保持され、
+// errors.Is や errors.As で参照できます。
 //
 // 例:
 //
 //	return NewDataErrorf("invalid marker: %02X", marker)
 func NewDataErrorf(format string, args ...interface{}) *DataError {
-	return &DataError{message: fmt.Sprintf(format, args...)}
+	return NewDataErrorCodef(CodeUnknown, format, args...)
+}
+
+// NewDataErrorCodef は、エラーコードを指定して新しいDataErrorを作成します。
+// フォーマットはNewDataErrorfと同じです。
+//
+// 例:
+//
+//	return NewDataErrorCodef(CodeLimitExceeded, "image width %d exceeds limit %d", width, limit)
+func NewDataErrorCodef(code ErrorCode, format string, args ...interface{}) *DataError {
+	message, cause := formatError(format, args...)
+	return &DataError{message: message, code: code, cause: cause}
+}
+
+// Code はエラーの種類を返します。コードを指定せずに作成された場合はCodeUnknownです。
+func (e *DataError) Code() ErrorCode {
+	return e.code
+}
+
+// Stage はエラーが発生したパイプラインのステージを返します。
+// Optimizerの外で発生した場合は空です。
+func (e *DataError) Stage() Stage {
+	return e.stage
+}
+
+// Unwrap はエラーの原因を返します。
+func (e *DataError) Unwrap() error {
+	return e.cause
+}
+
+// Stack は、パニックから作成されたエラー（CodePanic）の場合に、
+// パニック発生時のスタックトレースを返します。それ以外の場合はnilです。
+func (e *DataError) Stack() []byte {
+	return e.stack
 }
 
 // AsDataError は、提供されたエラーがDataErrorかどうかをチェックし、
@@ -65,3 +233,158 @@ func AsDataError(err error) *DataError {
 	}
 	return nil
 }
+
+// SystemError は、ファイルの読み書きなどデータ以外の原因によるエラーを表します。
+// DataErrorと同じくコード、ステージ、原因を持ちます。
+//
+// Optimizer.Runが返すエラーのうちDataErrorでないものは、すべてSystemErrorを含みます。
+// 確認するにはAsSystemErrorを使用してください。
+type SystemError struct {
+	message string
+	code    ErrorCode
+	stage   Stage
+	cause   error
+}
+
+// NewSystemErrorf は、エラーコードとフォーマット文字列から新しいSystemErrorを作成します。
+// フォーマットと原因の扱いはNewDataErrorfと同じです。
+//
+// 例:
+//
+//	return NewSystemErrorf(CodeIO, "failed to read PNG file: %w", err)
+func NewSystemErrorf(code ErrorCode, format string, args ...interface{}) *SystemError {
+	message, cause := formatError(format, args...)
+	return &SystemError{message: message, code: code, cause: cause}
+}
+
+// Error はerrorインターフェースを実装し、エラーメッセージを返します。
+func (e *SystemError) Error() string {
+	return e.message
+}
+
+// Code はエラーの種類を返します。
+func (e *SystemError) Code() ErrorCode {
+	return e.code
+}
+
+// Stage はエラーが発生したパイプラインのステージを返します。
+func (e *SystemError) Stage() Stage {
+	return e.stage
+}
+
+// Unwrap はエラーの原因を返します。
+func (e *SystemError) Unwrap() error {
+	return e.cause
+}
+
+// AsSystemError は、提供されたエラーがSystemErrorかどうかをチェックし、
+// そうであればそれを返します。SystemErrorでない場合はnilを返します。
+func AsSystemError(err error) *SystemError {
+	var systemErr *SystemError
+	if errors.As(err, &systemErr) {
+		return systemErr
+	}
+	return nil
+}
+
+// CodeOf は、errのチェーンで最も外側にあるDataErrorまたはSystemErrorのエラーコードを返します。
+// libimagequantのQuantizeErrorは、メモリ不足がCodeOutOfMemory、それ以外がCodeQuantizeFailedです。
+// いずれも含まない場合はCodeUnknownを返します。
+func CodeOf(err error) ErrorCode {
+	switch e := outermostError(err).(type) {
+	case *DataError:
+		return e.code
+	case *SystemError:
+		return e.code
+	case *QuantizeError:
+		if e.Code == OutOfMemory {
+			return CodeOutOfMemory
+		}
+		return CodeQuantizeFailed
+	}
+	return CodeUnknown
+}
+
+// StageOf は、errのチェーンで最も外側にあるDataErrorまたはSystemErrorのステージを返します。
+// どちらも含まない場合は空を返します。
+func StageOf(err error) Stage {
+	switch e := outermostError(err).(type) {
+	case *DataError:
+		return e.stage
+	case *SystemError:
+		return e.stage
+	}
+	return ""
+}
+
+// outermostError は、errのチェーンで最も外側にあるDataError、SystemError、QuantizeErrorを返します。
+// errors.Joinなどで複数のエラーをラップしている場合は、errors.Asと同じ順序で探します。
+func outermostError(err error) error {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		switch e.(type) {
+		case *DataError, *SystemError, *QuantizeError:
+			return e
+		}
+	}
+	if dataErr := AsDataError(err); dataErr != nil {
+		return dataErr
+	}
+	if systemErr := AsSystemError(err); systemErr != nil {
+		return systemErr
+	}
+	var quantizeErr *QuantizeError
+	if errors.As(err, &quantizeErr) {
+		return quantizeErr
+	}
+	return nil
+}
+
+// formatError は、fmt.Errorfと同じ規則でメッセージを作成し、原因となるエラーを取り出します。
+// %wで指定したエラーがなければ、引数の中の最初のエラーを原因とします。
+func formatError(format string, args ...interface{}) (string, error) {
+	err := fmt.Errorf(format, args...)
+	if cause := errors.Unwrap(err); cause != nil {
+		return err.Error(), cause
+	}
+	for _, arg := range args {
+		if cause, ok := arg.(error); ok {
+			return err.Error(), cause
+		}
+	}
+	return err.Error(), nil
+}
+
+// wrapError は、errをformat（%wでerrを参照）のメッセージでラップします。
+// errの最も外側がSystemErrorであればSystemError、それ以外はDataErrorでラップし、
+// コードはerrのものを引き継ぎます。errのコードが不明な場合はcodeを使用します。
+func wrapError(err error, code ErrorCode, format string) error {
+	if c := CodeOf(err); c != CodeUnknown {
+		code = c
+	}
+	if _, ok := outermostError(err).(*SystemError); ok {
+		return NewSystemErrorf(code, format, err)
+	}
+	return NewDataErrorCodef(code, format, err)
+}
+
+// withStage は、エラーにパイプラインのステージを記録したエラーを返します。
+// 元のエラーは変更せず、最も外側のDataErrorまたはSystemErrorと同じ種類とコードのエラーで
+// errをラップします。ステージが記録済みの場合はerrをそのまま返し、
+// どちらも含まない場合はSystemErrorでラップします。
+func withStage(err error, stage Stage) error {
+	if err == nil {
+		return nil
+	}
+	switch e := outermostError(err).(type) {
+	case *DataError:
+		if e.stage != "" {
+			return err
+		}
+		return &DataError{message: err.Error(), code: e.code, stage: stage, cause: err, stack: e.stack}
+	case *SystemError:
+		if e.stage != "" {
+			return err
+		}
+	}
+	return &SystemError{message: err.Error(), code: CodeOf(err), stage: stage, cause: err}
+}
@@ -1,8 +1,12 @@
 package png
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -56,3 +60,208 @@ func TestDataError(t *testing.T) {
 		t.Error("AsDataError should return nil for wrapped regular error")
 	}
 }
+
+func TestDataError_Code(t *testing.T) {
+	if code := NewDataError("test error").Code(); code != CodeUnknown {
+		t.Errorf("Code() = %v; want %v", code, CodeUnknown)
+	}
+
+	err := fmt.Errorf("wrapper: %w", NewDataErrorCodef(CodeLimitExceeded, "width %d", 100000))
+	dataErr := AsDataError(err)
+	if dataErr == nil || dataErr.Code() != CodeLimitExceeded {
+		t.Fatalf("AsDataError() = %v; want CodeLimitExceeded", dataErr)
+	}
+	if dataErr.Error() != "width 100000" {
+		t.Errorf("Error() = %q; want %q", dataErr.Error(), "width 100000")
+	}
+	if s := CodeLimitExceeded.String(); s != "limit_exceeded" {
+		t.Errorf("String() = %q; want %q", s, "limit_exceeded")
+	}
+	if code := CodeOf(err); code != CodeLimitExceeded {
+		t.Errorf("CodeOf() = %v; want %v", code, CodeLimitExceeded)
+	}
+}
+
+func TestDataError_Unwrap(t *testing.T) {
+	cause := errors.New("cause")
+
+	cases := []struct {
+		name     string
+		err      *DataError
+		expected string
+	}{
+		{"%w", NewDataErrorf("failed: %w", cause), "failed: cause"},
+		{"%v", NewDataErrorf("failed: %v", cause), "failed: cause"},
+		{"コード付き", NewDataErrorCodef(CodeDecodeFailed, "failed < %v", cause), "failed < cause"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.err.Error() != tc.expected {
+				t.Errorf("Error() = %q; want %q", tc.err.Error(), tc.expected)
+			}
+			if !errors.Is(tc.err, cause) {
+				t.Error("errors.Is should find the cause of DataError")
+			}
+		})
+	}
+
+	if err := NewDataErrorf("no cause: %d", 1); err.Unwrap() != nil {
+		t.Errorf("Unwrap() = %v; want nil", err.Unwrap())
+	}
+}
+
+func TestSystemError(t *testing.T) {
+	err := fmt.Errorf("wrapper: %w", NewSystemErrorf(CodeIO, "failed to read: %w", os.ErrNotExist))
+
+	systemErr := AsSystemError(err)
+	if systemErr == nil || systemErr.Code() != CodeIO {
+		t.Fatalf("AsSystemError() = %v; want CodeIO", systemErr)
+	}
+	if AsDataError(err) != nil {
+		t.Error("AsDataError should return nil for SystemError")
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Error("errors.Is should find the cause of SystemError")
+	}
+	if AsSystemError(NewDataError("test error")) != nil {
+		t.Error("AsSystemError should return nil for DataError")
+	}
+}
+
+func TestWithStage(t *testing.T) {
+	dataErr := NewDataErrorCodef(CodeMalformedChunk, "malformed")
+	staged := withStage(fmt.Errorf("wrapper: %w", dataErr), StageStrip)
+	if AsDataError(staged) == nil || CodeOf(staged) != CodeMalformedChunk || StageOf(staged) != StageStrip {
+		t.Errorf("withStage() = %v (code %v, stage %q); want DataError with %v at %q", staged, CodeOf(staged), StageOf(staged), CodeMalformedChunk, StageStrip)
+	}
+	if !errors.Is(staged, dataErr) || staged.Error() != "wrapper: malformed" {
+		t.Errorf("withStage() = %v; want to wrap %v", staged, dataErr)
+	}
+	// 元のエラー（共有されたセンチネルなど）は変更しない
+	if dataErr.Stage() != "" {
+		t.Errorf("dataErr.Stage() = %q; want empty", dataErr.Stage())
+	}
+
+	// 先に記録されたステージは上書きしない
+	if err := withStage(staged, StageWrite); StageOf(err) != StageStrip {
+		t.Errorf("StageOf() = %q; want %q", StageOf(err), StageStrip)
+	}
+
+	// SystemErrorの内側のDataErrorではなく、SystemErrorにステージを記録する
+	systemErr := NewSystemErrorf(CodeIO, "io: %w", dataErr)
+	if err := withStage(systemErr, StageWrite); AsSystemError(err).Stage() != StageWrite || CodeOf(err) != CodeIO {
+		t.Errorf("withStage() = %v (code %v, stage %q); want SystemError with %v at %q", err, CodeOf(err), StageOf(err), CodeIO, StageWrite)
+	}
+	if systemErr.Stage() != "" || dataErr.Stage() != "" {
+		t.Errorf("stages = %q, %q; want empty", systemErr.Stage(), dataErr.Stage())
+	}
+
+	// DataErrorでもSystemErrorでもないエラーはSystemErrorでラップする
+	plain := errors.New("plain")
+	err := withStage(plain, StageWrite)
+	if systemErr := AsSystemError(err); systemErr == nil || systemErr.Stage() != StageWrite || systemErr.Code() != CodeUnknown {
+		t.Errorf("withStage() = %#v; want SystemError at %q", err, StageWrite)
+	}
+	if !errors.Is(err, plain) || err.Error() != "plain" {
+		t.Errorf("withStage() = %v; want to wrap %v", err, plain)
+	}
+
+	if withStage(nil, StageWrite) != nil {
+		t.Error("withStage(nil) should return nil")
+	}
+}
+
+func TestCodeOf(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		expect ErrorCode
+	}{
+		{"nil", nil, CodeUnknown},
+		{"分類されていないエラー", errors.New("plain"), CodeUnknown},
+		{"DataError", fmt.Errorf("wrapper: %w", NewDataErrorCodef(CodeCRCMismatch, "crc")), CodeCRCMismatch},
+		// 最も外側のエラーのコードを返す
+		{"DataErrorを含むSystemError", NewSystemErrorf(CodeIO, "io: %w", NewDataErrorCodef(CodeCRCMismatch, "crc")), CodeIO},
+		{"QuantizeError", &QuantizeError{Code: InternalError}, CodeQuantizeFailed},
+		{"メモリ不足のQuantizeError", fmt.Errorf("wrapper: %w", ErrOutOfMemory), CodeOutOfMemory},
+		{"コメントなし", ErrCommentNotFound, CodeCommentNotFound},
+		{"署名なし", ErrCommentNotSigned, CodeCommentNotSigned},
+		{"署名の不一致", ErrSignatureMismatch, CodeSignatureMismatch},
+		{"検証の失敗", withStage(verificationError("reason"), StageVerify), CodeVerificationFailed},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := CodeOf(tc.err); got != tc.expect {
+				t.Errorf("CodeOf() = %v; want %v", got, tc.expect)
+			}
+		})
+	}
+}
+
+func TestOptimize_ErrorStage(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	cases := []struct {
+		name   string
+		file   string
+		repair bool
+		code   ErrorCode
+		stage  Stage
+	}{
+		{"修復時のシグネチャ不正", "testdata/binding/jpeg.png", true, CodeInvalidSignature, StageRepair},
+		{"コメント読み込み時のシグネチャ不正", "testdata/binding/jpeg.png", false, CodeInvalidSignature, StageMarker},
+		{"存在しないファイル", "testdata/binding/missing.png", false, CodeIO, StageRead},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			optimizer := NewOptimizer("")
+			optimizer.Repair = tc.repair
+			_, err := optimizer.Run(tc.file, filepath.Join(tempDir, "out.png"))
+			if err == nil {
+				t.Fatal("Run() = nil; want error")
+			}
+			if code := CodeOf(err); code != tc.code {
+				t.Errorf("CodeOf() = %v; want %v (%v)", code, tc.code, err)
+			}
+			if stage := StageOf(err); stage != tc.stage {
+				t.Errorf("StageOf() = %q; want %q", stage, tc.stage)
+			}
+		})
+	}
+}
+
+func TestDecodeErrorCode(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/colortype_rgb.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	badCRC := bytes.Clone(original)
+	ihdr := findChunkOffset(t, badCRC, "IHDR")
+	badCRC[ihdr+8+13] ^= 0xff
+
+	cases := []struct {
+		name     string
+		data     []byte
+		expected ErrorCode
+	}{
+		{"CRCの不一致", badCRC, CodeCRCMismatch},
+		{"シグネチャ不正", []byte("not a png file at all"), CodeInvalidSignature},
+		{"途切れたファイル", original[:len(original)/2], CodeDecodeFailed},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := png.Decode(bytes.NewReader(tc.data))
+			if err == nil {
+				t.Fatal("png.Decode() = nil; want error")
+			}
+			if code := decodeErrorCode(err); code != tc.expected {
+				t.Errorf("decodeErrorCode(%v) = %v; want %v", err, code, tc.expected)
+			}
+		})
+	}
+}
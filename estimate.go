@@ -0,0 +1,353 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+	"github.com/dustin/go-humanize"
+	"github.com/ideamans/go-l10n"
+	"github.com/ideamans/go-psnr"
+)
+
+func init() {
+	// Register Japanese translations for estimate.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"failed to decode PNG for estimate: %v": "見積もりのためのPNGのデコードに失敗しました: %v",
+		"failed to encode estimate sample: %v":  "見積もり用サンプルのエンコードに失敗しました: %v",
+	})
+}
+
+// DefaultEstimateSamplePixels はOptimizer.EstimateSamplePixelsが0の場合のサンプルのピクセル数です。
+const DefaultEstimateSamplePixels = 512 * 512
+
+// runEstimate は見積もりモードで、メタデータ削除後のデータから残りのステージの結果を予測します。
+// 画像を縮小したサンプルを減色し、そのPSNRとサイズの比率から最終的なサイズを見積もります。
+// サンプルは画像全体をデコードせずに作成します（decodeSample）。
+// メタデータの削除は可逆であるため、減色しない場合の最終PSNRは無限大とみなします。
+// ファイルの書き込みは一切行いません。
+func (o *Optimizer) runEstimate(output *OptimizePNGOutput, originalData, data []byte, stages []string, sourceHash [sha256.Size]byte, previous *LightFileComment) (*OptimizePNGOutput, error) {
+	output.Estimated = true
+	projectedSize := int64(len(data))
+	finalPSNR := math.Inf(1)
+	quantizedSize := int64(-1) // 減色の見積もりができなかった場合は負の値
+
+	samplePixels := o.EstimateSamplePixels
+	if samplePixels <= 0 {
+		samplePixels = DefaultEstimateSamplePixels
+	}
+	// Small images are quantized as they are, which gives the exact result
+	sampleData, sampleWidth, sampleHeight, err := decodeSample(data, samplePixels)
+	if err != nil {
+		return nil, err
+	}
+
+	quantized, wasQuantized, err := o.quantize(sampleData)
+	switch {
+	case err != nil:
+		if err := o.handleQuantizeError(output, err); err != nil {
+			return nil, err
+		}
+	case !wasQuantized:
+		output.IsIndexedColor = true
+	default:
+		psnrValue, err := psnr.Compute(sampleData, quantized)
+		if err != nil {
+			output.PNGQuantError = withStage(NewDataErrorCodef(CodeMetricFailed, l10n.T("failed to calculate PSNR for estimate: %v"), err), StagePNGQuant)
+			break
+		}
+		output.PNGQuant.PSNR = psnrValue
+
+		ratio := float64(len(quantized)) / float64(len(sampleData))
+		o.logDebug("Estimated from %dx%d sample: PSNR %.2f dB, size ratio %.3f",
+			sampleWidth, sampleHeight, psnrValue, ratio)
+		quantizedSize = int64(float64(projectedSize) * ratio)
+		if isAcceptablePSNR(o.Quality, psnrValue) {
+			output.PNGQuant.Applied = true
+			projectedSize = quantizedSize
+			finalPSNR = psnrValue
+			stages = append(stages, string(StagePNGQuant))
+		}
+	}
+	output.SizeAfterPNGQuant = projectedSize
+
+	// The analysis decodes the whole image, unlike the estimate itself
+	if o.Analyze {
+		if err := o.analyze(output, originalData, quantizedSize); err != nil {
+			return nil, withStage(err, StageAnalyze)
+		}
+	}
+
+	// The comment is counted as in Run, with the projected values
+	commentSizeIncrease := 0
+	if o.MarkerStorage == MarkerEmbedded {
+		comment := o.newComment(output, projectedSize, finalPSNR, stages, sourceHash, previous)
+		_, commentSizeIncrease, err = defaultPNGMetaManager.BuildComment(comment)
+		if err != nil {
+			return nil, withStage(wrapError(err, CodeCommentFailed, l10n.T("failed to build comment: %w")), StageComment)
+		}
+	}
+
+	finalSize := projectedSize + int64(commentSizeIncrease)
+	if finalSize >= output.BeforeSize && output.Reoptimize != ReoptimizeForce {
+		output.CantOptimize = true
+		o.logInfo("Cannot optimize: final size (%s) >= original size (%s)",
+			humanize.Bytes(uint64(finalSize)), humanize.Bytes(uint64(output.BeforeSize)))
+		return output, nil
+	}
+
+	output.FinalPSNR = finalPSNR
+	if !math.IsInf(finalPSNR, 1) && finalPSNR < o.psnrThreshold() {
+		output.InspectionFailed = true
+		o.logWarn("PSNR inspection failed: %.2f dB < %.2f dB", finalPSNR, o.psnrThreshold())
+		return output, nil
+	}
+
+	output.AfterSize = finalSize
+	o.logInfo("Estimated result: %s -> %s, PSNR: %.2f dB",
+		humanize.Bytes(uint64(output.BeforeSize)), humanize.Bytes(uint64(output.AfterSize)), finalPSNR)
+
+	return output, nil
+}
+
+// sampleSize は、width×heightの画像をピクセル数がmaxPixels以下になるよう縮小したサイズを返します。
+// 縦横比はできるだけ維持し、各辺は1以上になります。
+func sampleSize(width, height, maxPixels int) (int, int) {
+	if width*height <= maxPixels {
+		return width, height
+	}
+
+	scale := math.Sqrt(float64(maxPixels) / float64(width*height))
+	sampleWidth := max(1, int(float64(width)*scale))
+	sampleHeight := max(1, int(float64(height)*scale))
+	// 極端に細長い画像では短い辺が1に切り上げられるため、長い辺を縮めて調整する
+	sampleWidth = min(sampleWidth, max(1, maxPixels/sampleHeight))
+	sampleHeight = min(sampleHeight, max(1, maxPixels/sampleWidth))
+	return sampleWidth, sampleHeight
+}
+
+// decodeSample は、ピクセル数がmaxPixels以下になるよう最近傍法で縮小したサンプルのPNGデータと、そのサイズを返します。
+// 画像がmaxPixels以下の場合はdataをそのまま返します。
+//
+// 画像全体をデコードせず、IDATを展開しながらサンプルに使う行だけを残すため、
+// メモリは1行分とサンプルの大きさで済みます。Adam7インターレースの画像では、
+// 8ピクセルおきの画素からなる最初のパスだけを展開します。
+// 新しい色を作らないよう補間は行わず、ビット深度、カラータイプ、パレットと透明色は元の画像のまま維持します。
+// サンプルは元の画像と比較できるよう、image/pngでエンコードし直します。
+func decodeSample(data []byte, maxPixels int) ([]byte, int, int, error) {
+	header, palette, transparency, idat, err := readSampleChunks(data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if header.Width*header.Height <= maxPixels {
+		return data, header.Width, header.Height, nil
+	}
+
+	// 元の画像（インターレースの場合は最初のパス）から縮小する
+	gridWidth, gridHeight := header.Width, header.Height
+	if header.Interlace != 0 {
+		gridWidth, gridHeight = (header.Width+7)/8, (header.Height+7)/8
+	}
+	sampleWidth, sampleHeight := sampleSize(gridWidth, gridHeight, maxPixels)
+
+	zr, err := zlib.NewReader(io.MultiReader(idat...))
+	if err != nil {
+		return nil, 0, 0, NewDataErrorCodef(CodeDecodeFailed, l10n.T("failed to decode PNG for estimate: %v"), err)
+	}
+	defer zr.Close()
+
+	pixelBits := header.channels() * header.BitDepth
+	filterBytes := max(1, pixelBits/8)
+	rowBytes := int(header.rowBytes(gridWidth))
+	sampleRowBytes := int(header.rowBytes(sampleWidth))
+
+	var raw bytes.Buffer
+	line := make([]byte, 1+rowBytes)
+	current, previous := make([]byte, rowBytes), make([]byte, rowBytes)
+	sampleRow := make([]byte, 1+sampleRowBytes) // 先頭はフィルタタイプ（None）
+	for y, sampleY := 0, 0; sampleY < sampleHeight; y++ {
+		if _, err := io.ReadFull(zr, line); err != nil {
+			return nil, 0, 0, NewDataErrorCodef(CodeDecodeFailed, l10n.T("failed to decode PNG for estimate: %v"), err)
+		}
+		if err := unfilterRow(line[0], line[1:], previous, current, filterBytes); err != nil {
+			return nil, 0, 0, err
+		}
+		current, previous = previous, current
+
+		if y != sampleY*gridHeight/sampleHeight {
+			continue
+		}
+		clear(sampleRow[1:])
+		for x := 0; x < sampleWidth; x++ {
+			copyPixel(sampleRow[1:], x, previous, x*gridWidth/sampleWidth, pixelBits)
+		}
+		raw.Write(sampleRow)
+		sampleY++
+	}
+
+	sample, err := encodeSample(header, sampleWidth, sampleHeight, palette, transparency, raw.Bytes())
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return sample, sampleWidth, sampleHeight, nil
+}
+
+// readSampleChunks は、サンプルの作成に必要なIHDR、PLTE、tRNSとIDATのデータ部を、コピーせずに読み出します。
+// CRCは検証しません。
+func readSampleChunks(data []byte) (*pngHeader, []byte, []byte, []io.Reader, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, nil, nil, nil, NewDataErrorCodef(CodeInvalidSignature, l10n.T("failed to decode PNG for estimate: %v"), png.FormatError("not a PNG file"))
+	}
+
+	var header *pngHeader
+	var palette, transparency []byte
+	var idat []io.Reader
+	for offset := len(pngSignature); offset+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		chunkType := string(data[offset+4 : offset+8])
+		if length < 0 || offset+12+length > len(data) {
+			break
+		}
+		chunkData := data[offset+8 : offset+8+length]
+		switch chunkType {
+		case "IHDR":
+			var err error
+			if header, err = parseIHDR(chunkData); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		case "PLTE":
+			palette = chunkData
+		case "tRNS":
+			transparency = chunkData
+		case "IDAT":
+			idat = append(idat, bytes.NewReader(chunkData))
+		}
+		offset += 12 + length
+	}
+	if header == nil {
+		return nil, nil, nil, nil, NewDataErrorCodef(CodeMissingChunk, l10n.T("png file missing IHDR chunk"))
+	}
+	if len(idat) == 0 {
+		return nil, nil, nil, nil, NewDataErrorCodef(CodeMissingChunk, l10n.T("png file missing IDAT chunk"))
+	}
+	return header, palette, transparency, idat, nil
+}
+
+// unfilterRow は、フィルタタイプfilterの行lineを1行前のprevious（フィルタ解除済み）を使って解除し、dstに書き込みます。
+// bppはフィルタの計算に使う1ピクセルのバイト数（1未満の場合は1）です。
+func unfilterRow(filter byte, line, previous, dst []byte, bpp int) error {
+	switch filter {
+	case 0:
+		copy(dst, line)
+	case 1:
+		for i := range line {
+			var left byte
+			if i >= bpp {
+				left = dst[i-bpp]
+			}
+			dst[i] = line[i] + left
+		}
+	case 2:
+		for i := range line {
+			dst[i] = line[i] + previous[i]
+		}
+	case 3:
+		for i := range line {
+			var left int
+			if i >= bpp {
+				left = int(dst[i-bpp])
+			}
+			dst[i] = line[i] + byte((left+int(previous[i]))/2)
+		}
+	case 4:
+		for i := range line {
+			var left, upLeft int
+			if i >= bpp {
+				left, upLeft = int(dst[i-bpp]), int(previous[i-bpp])
+			}
+			dst[i] = line[i] + paeth(left, int(previous[i]), upLeft)
+		}
+	default:
+		return NewDataErrorCodef(CodeDecodeFailed, l10n.T("failed to decode PNG for estimate: %v"), fmt.Sprintf("invalid filter type %d", filter))
+	}
+	return nil
+}
+
+// paeth はPaethフィルタの予測値を返します。
+func paeth(a, b, c int) byte {
+	p := a + b - c
+	pa, pb, pc := abs(p-a), abs(p-b), abs(p-c)
+	switch {
+	case pa <= pb && pa <= pc:
+		return byte(a)
+	case pb <= pc:
+		return byte(b)
+	}
+	return byte(c)
+}
+
+// abs は整数の絶対値を返します。
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// copyPixel は、1ピクセルがpixelBitsビットの行srcのsrcX番目のピクセルを、dstのdstX番目にコピーします。
+// 8ビット未満のピクセルはビット単位でコピーします（dstの該当するビットは0である必要があります）。
+func copyPixel(dst []byte, dstX int, src []byte, srcX int, pixelBits int) {
+	if pixelBits >= 8 {
+		size := pixelBits / 8
+		copy(dst[dstX*size:(dstX+1)*size], src[srcX*size:(srcX+1)*size])
+		return
+	}
+	mask := byte(1<<pixelBits - 1)
+	srcShift := 8 - pixelBits - srcX*pixelBits%8
+	dstShift := 8 - pixelBits - dstX*pixelBits%8
+	value := src[srcX*pixelBits/8] >> srcShift & mask
+	dst[dstX*pixelBits/8] |= value << dstShift
+}
+
+// encodeSample は、フィルタ済みの行rawからheaderと同じ形式のwidth×heightのPNGを作成し、
+// image/pngでエンコードし直したデータを返します。
+func encodeSample(header *pngHeader, width, height int, palette, transparency, raw []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(raw)
+	zw.Close()
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = byte(header.BitDepth)
+	ihdr[9] = byte(header.ColorType)
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	writeChunk(&buf, &pngstructure.Chunk{Type: "IHDR", Data: ihdr})
+	if palette != nil {
+		writeChunk(&buf, &pngstructure.Chunk{Type: "PLTE", Data: palette})
+	}
+	if transparency != nil {
+		writeChunk(&buf, &pngstructure.Chunk{Type: "tRNS", Data: transparency})
+	}
+	writeChunk(&buf, &pngstructure.Chunk{Type: "IDAT", Data: compressed.Bytes()})
+	writeChunk(&buf, &pngstructure.Chunk{Type: "IEND"})
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		return nil, NewDataErrorCodef(decodeErrorCode(err), l10n.T("failed to decode PNG for estimate: %v"), err)
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, NewDataErrorCodef(CodeEncodeFailed, l10n.T("failed to encode estimate sample: %v"), err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,229 @@
+package png
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSampleSize(t *testing.T) {
+	cases := []struct {
+		name                      string
+		width, height, maxPixels  int
+		expectWidth, expectHeight int
+	}{
+		{"縮小不要", 100, 50, 5000, 100, 50},
+		{"縮小", 400, 200, 5000, 100, 50},
+		{"細長い画像", 10000, 1, 100, 100, 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			width, height := sampleSize(tc.width, tc.height, tc.maxPixels)
+			if width != tc.expectWidth || height != tc.expectHeight {
+				t.Errorf("sampleSize() = %dx%d; want %dx%d", width, height, tc.expectWidth, tc.expectHeight)
+			}
+		})
+	}
+}
+
+func TestDecodeSample(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		step int // サンプルの元になる画素の間隔（インターレースでは最初のパスの8）
+	}{
+		{"RGBA", "testdata/variations/alpha_transparent.png", 1},
+		{"パレット", "testdata/variations/colortype_palette.png", 1},
+		{"1ビット", "testdata/variations/depth_1bit.png", 1},
+		{"16ビット", "testdata/variations/depth_16bit.png", 1},
+		{"グレースケールとアルファ", "testdata/variations/colortype_grayscale_alpha.png", 1},
+		{"全フィルタ", "testdata/variations/critical_maxcompression_paeth.png", 1},
+		{"インターレース", "testdata/variations/interlace_adam7.png", 8},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+			full, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("png.Decode() = %v; want nil", err)
+			}
+
+			// 縮小しない場合は元のデータのまま
+			bounds := full.Bounds()
+			if same, _, _, err := decodeSample(data, bounds.Dx()*bounds.Dy()); err != nil || !bytes.Equal(same, data) {
+				t.Errorf("decodeSample(all pixels) = %d bytes, %v; want the original data", len(same), err)
+			}
+
+			sampleData, width, height, err := decodeSample(data, 64*64)
+			if err != nil {
+				t.Fatalf("decodeSample() = %v; want nil", err)
+			}
+			sample, err := png.Decode(bytes.NewReader(sampleData))
+			if err != nil {
+				t.Fatalf("png.Decode(sample) = %v; want nil", err)
+			}
+			if sample.Bounds().Dx() != width || sample.Bounds().Dy() != height || width*height > 64*64 {
+				t.Fatalf("sample size = %v; want %dx%d within %d pixels", sample.Bounds(), width, height, 64*64)
+			}
+			// 画像の型は維持される
+			if fmt.Sprintf("%T", sample) != fmt.Sprintf("%T", full) {
+				t.Errorf("sample type = %T; want %T", sample, full)
+			}
+
+			// 各画素は元の画像の最近傍の画素と一致する
+			gridWidth, gridHeight := (bounds.Dx()+tc.step-1)/tc.step, (bounds.Dy()+tc.step-1)/tc.step
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					srcX, srcY := x*gridWidth/width*tc.step, y*gridHeight/height*tc.step
+					if !reflect.DeepEqual(sample.At(x, y), full.At(srcX, srcY)) {
+						t.Fatalf("sample.At(%d, %d) = %v; want %v at (%d, %d)", x, y, sample.At(x, y), full.At(srcX, srcY), srcX, srcY)
+					}
+				}
+			}
+		})
+	}
+
+	if _, _, _, err := decodeSample([]byte("not a png"), 100); CodeOf(err) != CodeInvalidSignature {
+		t.Errorf("decodeSample(not a png) = %v; want code %s", err, CodeInvalidSignature)
+	}
+}
+
+func TestOptimize_DryRun(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	src := "testdata/optimize/psnr-will-50.png"
+
+	// 比較のため実際に最適化する
+	expected, err := NewOptimizer("").Run(src, filepath.Join(tempDir, "real.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+
+	for _, storage := range []MarkerStorage{MarkerEmbedded, MarkerSidecar} {
+		t.Run(storage.String(), func(t *testing.T) {
+			destPath := filepath.Join(tempDir, "dry-run-"+storage.String()+".png")
+
+			optimizer := NewOptimizer("")
+			optimizer.DryRun = true
+			optimizer.MarkerStorage = storage
+			output, err := optimizer.Run(src, destPath)
+			if err != nil {
+				t.Fatalf("Run() = %v; want nil", err)
+			}
+
+			if _, err := os.Stat(destPath); !os.IsNotExist(err) {
+				t.Errorf("os.Stat(destPath) = %v; want not exist", err)
+			}
+			if _, err := os.Stat(SidecarPath(destPath)); !os.IsNotExist(err) {
+				t.Errorf("os.Stat(sidecar) = %v; want not exist", err)
+			}
+
+			if output.CantOptimize || output.InspectionFailed || output.Estimated {
+				t.Errorf("Unexpected result: %+v", output)
+			}
+			if output.FinalPSNR != expected.FinalPSNR {
+				t.Errorf("FinalPSNR = %v; want %v", output.FinalPSNR, expected.FinalPSNR)
+			}
+			// 埋め込むコメントは時刻を含み、圧縮後のサイズが数バイト変わることがある
+			if storage == MarkerEmbedded && (output.AfterSize < expected.AfterSize-4 || output.AfterSize > expected.AfterSize+4) {
+				t.Errorf("AfterSize = %d; want %d", output.AfterSize, expected.AfterSize)
+			}
+			if storage == MarkerSidecar && output.AfterSize != expected.SizeAfterPNGQuant {
+				t.Errorf("AfterSize = %d; want %d", output.AfterSize, expected.SizeAfterPNGQuant)
+			}
+		})
+	}
+}
+
+func TestOptimize_Estimate(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	t.Run("サンプルより小さい画像", func(t *testing.T) {
+		src := "testdata/optimize/psnr-will-50.png"
+		expected, err := NewOptimizer("").Run(src, filepath.Join(tempDir, "real.png"))
+		if err != nil {
+			t.Fatalf("Run() = %v; want nil", err)
+		}
+
+		destPath := filepath.Join(tempDir, "estimate.png")
+		optimizer := NewOptimizer("")
+		optimizer.Estimate = true
+		output, err := optimizer.Run(src, destPath)
+		if err != nil {
+			t.Fatalf("Run() = %v; want nil", err)
+		}
+		if _, err := os.Stat(destPath); !os.IsNotExist(err) {
+			t.Errorf("os.Stat(destPath) = %v; want not exist", err)
+		}
+
+		// 縮小しない場合は実際の最適化と同じ結果になる
+		if !output.Estimated || output.PNGQuant.Applied != expected.PNGQuant.Applied {
+			t.Errorf("Unexpected result: %+v", output)
+		}
+		if output.PNGQuant.PSNR != expected.PNGQuant.PSNR {
+			t.Errorf("PNGQuant.PSNR = %v; want %v", output.PNGQuant.PSNR, expected.PNGQuant.PSNR)
+		}
+		if !SizesWithinTolerance(output.AfterSize, expected.AfterSize, 0.001) {
+			t.Errorf("AfterSize = %d; want %d", output.AfterSize, expected.AfterSize)
+		}
+	})
+
+	t.Run("縮小したサンプル", func(t *testing.T) {
+		destPath := filepath.Join(tempDir, "sampled.png")
+		optimizer := NewOptimizer("")
+		optimizer.Estimate = true
+		optimizer.EstimateSamplePixels = 128 * 128
+		output, err := optimizer.Run("testdata/variations/alpha_transparent.png", destPath)
+		if err != nil {
+			t.Fatalf("Run() = %v; want nil", err)
+		}
+		if _, err := os.Stat(destPath); !os.IsNotExist(err) {
+			t.Errorf("os.Stat(destPath) = %v; want not exist", err)
+		}
+		if !output.Estimated || !output.PNGQuant.Applied {
+			t.Errorf("Unexpected result: %+v", output)
+		}
+		if output.AfterSize <= 0 || output.AfterSize >= output.SizeAfterStrip {
+			t.Errorf("AfterSize = %d; want between 0 and %d", output.AfterSize, output.SizeAfterStrip)
+		}
+	})
+
+	t.Run("解析", func(t *testing.T) {
+		optimizer := NewOptimizer("")
+		optimizer.Estimate = true
+		optimizer.Analyze = true
+		optimizer.EstimateSamplePixels = 128 * 128
+		output, err := optimizer.Run("testdata/variations/alpha_transparent.png", filepath.Join(tempDir, "analyze.png"))
+		if err != nil {
+			t.Fatalf("Run() = %v; want nil", err)
+		}
+		if output.Analysis == nil || len(output.Analysis.Estimates) != 2 {
+			t.Fatalf("Analysis = %+v; want strip and pngquant estimates", output.Analysis)
+		}
+		if quantized := output.Analysis.Estimates[1]; quantized.Stage != StagePNGQuant || quantized.Size != output.SizeAfterPNGQuant {
+			t.Errorf("Estimates[1] = %+v; want pngquant with size %d", quantized, output.SizeAfterPNGQuant)
+		}
+	})
+
+	t.Run("インデックスカラー", func(t *testing.T) {
+		optimizer := NewOptimizer("")
+		optimizer.Estimate = true
+		output, err := optimizer.Run("testdata/variations/colortype_palette.png", filepath.Join(tempDir, "palette.png"))
+		if err != nil {
+			t.Fatalf("Run() = %v; want nil", err)
+		}
+		if !output.IsIndexedColor || output.PNGQuant.Applied {
+			t.Errorf("Unexpected result: %+v", output)
+		}
+	})
+}
@@ -3,19 +3,19 @@ module github.com/ideamans/lightfile6-png
 go 1.22.2
 
 require (
+	github.com/dsoprea/go-exif/v3 v3.0.0-20210428042052-dca55bf8ca15
 	github.com/dsoprea/go-png-image-structure/v2 v2.0.0-20210512210324-29b889a6093d
+	github.com/dustin/go-humanize v1.0.1
 	github.com/ideamans/go-l10n v1.0.2
 	github.com/ideamans/go-png-meta-web-strip v1.0.0
+	github.com/ideamans/go-psnr v1.0.1
 )
 
 require (
-	github.com/dsoprea/go-exif/v3 v3.0.0-20210428042052-dca55bf8ca15 // indirect
 	github.com/dsoprea/go-logging v0.0.0-20200517223158-a10564966e9d // indirect
 	github.com/dsoprea/go-utility/v2 v2.0.0-20200717064901-2fccff4aa15e // indirect
-	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/go-errors/errors v1.1.1 // indirect
 	github.com/golang/geo v0.0.0-20200319012246-673a6f80352d // indirect
-	github.com/ideamans/go-psnr v1.0.1 // indirect
 	golang.org/x/net v0.0.0-20200520182314-0ba52f642ac2 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/yaml.v2 v2.3.0 // indirect
@@ -0,0 +1,100 @@
+package png
+
+import (
+	"encoding/json"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for history.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"invalid history entry: %v": "履歴エントリが不正です: %v",
+	})
+}
+
+// DefaultMaxHistory はOptimizer.MaxHistoryが0の場合に保持する履歴の最大件数です。
+const DefaultMaxHistory = 8
+
+// HistoryEntry は過去に行われた最適化1回分の記録です。
+// コメントのサイズを抑えるため、JSONでは [by, before, after, psnr, ts] の配列として表現されます。
+type HistoryEntry struct {
+	By        string   // 最適化ツールの識別子
+	Before    int64    // 最適化前のファイルサイズ
+	After     int64    // 最適化後のファイルサイズ
+	PSNR      MaybeInf // 最適化前後のPSNR（無限大はnull）
+	Timestamp int64    // 最適化した時刻（Unix秒、不明な場合は0）
+}
+
+// MarshalJSON はjson.Marshalerを実装し、エントリを配列として出力します。
+func (e HistoryEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.By, e.Before, e.After, e.PSNR, e.Timestamp})
+}
+
+// UnmarshalJSON はjson.Unmarshalerを実装し、配列形式のエントリを読み込みます。
+// 将来要素が追加された場合に備えて、余分な要素は無視します。
+func (e *HistoryEntry) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return NewDataErrorCodef(CodeMalformedChunk, l10n.T("invalid history entry: %v"), err)
+	}
+
+	targets := []interface{}{&e.By, &e.Before, &e.After, &e.PSNR, &e.Timestamp}
+	for i, target := range targets {
+		if i >= len(fields) {
+			break
+		}
+		if err := json.Unmarshal(fields[i], target); err != nil {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("invalid history entry: %v"), err)
+		}
+	}
+	return nil
+}
+
+// historyEntry はコメントの内容（履歴を除く）を履歴エントリに変換します。
+func (c *LightFileComment) historyEntry() HistoryEntry {
+	return HistoryEntry{
+		By:        c.By,
+		Before:    c.Before,
+		After:     c.After,
+		PSNR:      c.PSNR,
+		Timestamp: c.Timestamp,
+	}
+}
+
+// Lineage は、過去の履歴とこのコメント自身の最適化を古い順に並べて返します。
+func (c *LightFileComment) Lineage() []HistoryEntry {
+	lineage := make([]HistoryEntry, 0, len(c.History)+1)
+	lineage = append(lineage, c.History...)
+	return append(lineage, c.historyEntry())
+}
+
+// ReadLineage は、PNGデータに埋め込まれたLightFileコメントから最適化の系譜を読み込みます。
+// コメントがない場合は空のスライスを返します。
+func ReadLineage(data []byte) ([]HistoryEntry, error) {
+	comment, _, err := ReadComment(data)
+	if err != nil {
+		return nil, err
+	}
+	if comment == nil {
+		return nil, nil
+	}
+	return comment.Lineage(), nil
+}
+
+// appendHistory は、直前のコメントを履歴の末尾に追加し、最大件数を超えた古いエントリを取り除きます。
+// maxが負の場合は履歴を保持しません。
+func appendHistory(previous *LightFileComment, max int) []HistoryEntry {
+	if max < 0 || previous == nil {
+		return nil
+	}
+	if max == 0 {
+		max = DefaultMaxHistory
+	}
+
+	history := previous.Lineage()
+	if len(history) > max {
+		history = history[len(history)-max:]
+	}
+	return history
+}
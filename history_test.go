@@ -0,0 +1,132 @@
+package png
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHistoryEntry_JSON(t *testing.T) {
+	entries := []HistoryEntry{
+		{By: "LightFile", Before: 2048, After: 1024, PSNR: 44.5, Timestamp: 1700000000},
+		{By: "LightFile6", Before: 1024, After: 1000, PSNR: MaybeInf(math.Inf(1))},
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v; want nil", err)
+	}
+
+	expected := `[["LightFile",2048,1024,44.5,1700000000],["LightFile6",1024,1000,null,0]]`
+	if string(data) != expected {
+		t.Errorf("json.Marshal() = %s; want %s", data, expected)
+	}
+
+	var decoded []HistoryEntry
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() = %v; want nil", err)
+	}
+	if !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("json.Unmarshal() = %+v; want %+v", decoded, entries)
+	}
+
+	// 要素が少ない、または多い配列も読み込める
+	var short HistoryEntry
+	if err := json.Unmarshal([]byte(`["x",1]`), &short); err != nil || short.By != "x" || short.Before != 1 {
+		t.Errorf("json.Unmarshal(short) = %+v, %v", short, err)
+	}
+	var long HistoryEntry
+	if err := json.Unmarshal([]byte(`["x",1,2,3,4,"future"]`), &long); err != nil || long.Timestamp != 4 {
+		t.Errorf("json.Unmarshal(long) = %+v, %v", long, err)
+	}
+
+	var invalid HistoryEntry
+	if err := json.Unmarshal([]byte(`{"by":"x"}`), &invalid); err == nil {
+		t.Error("json.Unmarshal(object) = nil; want error")
+	}
+}
+
+func TestAppendHistory(t *testing.T) {
+	previous := &LightFileComment{
+		By:     "LightFile",
+		Before: 300,
+		After:  200,
+		History: []HistoryEntry{
+			{By: "LightFile", Before: 500, After: 400},
+			{By: "LightFile", Before: 400, After: 300},
+		},
+	}
+
+	cases := []struct {
+		name         string
+		max          int
+		expectBefore []int64
+	}{
+		{"デフォルト", 0, []int64{500, 400, 300}},
+		{"上限で古いものを削除", 2, []int64{400, 300}},
+		{"無効", -1, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			history := appendHistory(previous, tc.max)
+			var befores []int64
+			for _, entry := range history {
+				befores = append(befores, entry.Before)
+			}
+			if !reflect.DeepEqual(befores, tc.expectBefore) {
+				t.Errorf("appendHistory() befores = %v; want %v", befores, tc.expectBefore)
+			}
+		})
+	}
+
+	if history := appendHistory(nil, 0); history != nil {
+		t.Errorf("appendHistory(nil) = %v; want nil", history)
+	}
+}
+
+func TestOptimize_History(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	optimizer := NewOptimizer("")
+	optimizer.ReoptimizePolicy = ForceReoptimize
+
+	// 1回目の最適化
+	firstPath := filepath.Join(tempDir, "first.png")
+	first, err := optimizer.Run("testdata/optimize/psnr-will-50.png", firstPath)
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if first.CantOptimize || first.InspectionFailed {
+		t.Fatalf("Unexpected result: %+v", first)
+	}
+
+	// 2回目の最適化（強制再最適化）
+	secondPath := filepath.Join(tempDir, "second.png")
+	if _, err := optimizer.Run(firstPath, secondPath); err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+
+	data, err := os.ReadFile(secondPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	lineage, err := ReadLineage(data)
+	if err != nil {
+		t.Fatalf("ReadLineage() = %v; want nil", err)
+	}
+
+	if len(lineage) != 2 {
+		t.Fatalf("len(lineage) = %d; want 2", len(lineage))
+	}
+	if lineage[0].Before != first.BeforeSize {
+		t.Errorf("lineage[0].Before = %d; want %d", lineage[0].Before, first.BeforeSize)
+	}
+	if lineage[1].Before != first.AfterSize {
+		t.Errorf("lineage[1].Before = %d; want %d", lineage[1].Before, first.AfterSize)
+	}
+}
@@ -0,0 +1,143 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for limits.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"PNG has more than %d chunks":                          "PNGのチャンク数が上限 %d を超えています",
+		"image width %d exceeds limit %d":                      "画像の幅 %d が上限 %d を超えています",
+		"image height %d exceeds limit %d":                     "画像の高さ %d が上限 %d を超えています",
+		"image of %d pixels exceeds limit %d":                  "画像のピクセル数 %d が上限 %d を超えています",
+		"decompressed image data of %d bytes exceeds limit %d": "展開後の画像データ %d バイトが上限 %d を超えています",
+		"%s chunk of %d bytes exceeds limit %d":                "%sチャンクのサイズ %d バイトが上限 %d を超えています",
+	})
+}
+
+// Limits は、処理する画像に許容するリソースの上限です。
+// IHDRで巨大なサイズを宣言した小さなPNG（展開爆弾）によって、デコードや減色の際に
+// 大量のメモリを確保してしまうことを防ぎます。
+//
+// 0の項目はDefaultLimitsの値を使用し、負の項目は制限しません。
+type Limits struct {
+	// MaxWidth と MaxHeight は画像の幅と高さの上限です。
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels は画像のピクセル数（幅×高さ）の上限です。
+	MaxPixels int64
+	// MaxDecompressedSize は、IDATを展開した後の画像データ（フィルタタイプのバイトを含む）の上限です。
+	MaxDecompressedSize int64
+	// MaxTextChunkSize は、1つのテキストチャンク（tEXt、zTXt、iTXt）のデータ長の上限です。
+	MaxTextChunkSize int64
+	// MaxChunks はファイルに含まれるチャンク数の上限です。
+	MaxChunks int
+}
+
+// DefaultLimits はLimitsの項目が0の場合に使用される上限です。
+var DefaultLimits = Limits{
+	MaxWidth:            32768,
+	MaxHeight:           32768,
+	MaxPixels:           64 << 20,
+	MaxDecompressedSize: 512 << 20,
+	MaxTextChunkSize:    maxTextDecompressedSize,
+	MaxChunks:           65536,
+}
+
+// withDefaults は0の項目をDefaultLimitsの値で補ったLimitsを返します。
+func (l Limits) withDefaults() Limits {
+	if l.MaxWidth == 0 {
+		l.MaxWidth = DefaultLimits.MaxWidth
+	}
+	if l.MaxHeight == 0 {
+		l.MaxHeight = DefaultLimits.MaxHeight
+	}
+	if l.MaxPixels == 0 {
+		l.MaxPixels = DefaultLimits.MaxPixels
+	}
+	if l.MaxDecompressedSize == 0 {
+		l.MaxDecompressedSize = DefaultLimits.MaxDecompressedSize
+	}
+	if l.MaxTextChunkSize == 0 {
+		l.MaxTextChunkSize = DefaultLimits.MaxTextChunkSize
+	}
+	if l.MaxChunks == 0 {
+		l.MaxChunks = DefaultLimits.MaxChunks
+	}
+	return l
+}
+
+// exceedsLimit は値が上限を超えているかを判定します。上限が0以下の場合は制限しません。
+func exceedsLimit(value, limit int64) bool {
+	return limit > 0 && value > limit
+}
+
+// Check は、画像をデコードせずにチャンクの長さとIHDRの宣言だけを調べ、上限を超えていないかを確認します。
+// 上限を超えている場合はコードがCodeLimitExceededのDataErrorを返します。
+//
+// PNGとして解析できない部分は検査の対象外です。シグネチャが不正な場合や
+// IHDRが不正な場合のエラーは、その後の処理に任せます。
+func (l Limits) Check(data []byte) error {
+	l = l.withDefaults()
+	if len(data) < len(pngSignature) || !bytes.Equal(data[:len(pngSignature)], pngSignature) {
+		return nil
+	}
+
+	count := 0
+	for offset := int64(len(pngSignature)); offset+8 <= int64(len(data)); {
+		length := int64(binary.BigEndian.Uint32(data[offset : offset+4]))
+		chunkType := string(data[offset+4 : offset+8])
+
+		count++
+		if exceedsLimit(int64(count), int64(l.MaxChunks)) {
+			return NewDataErrorCodef(CodeLimitExceeded, l10n.T("PNG has more than %d chunks"), l.MaxChunks)
+		}
+
+		switch {
+		case chunkType == "IHDR":
+			end := offset + 8 + length
+			if end > int64(len(data)) {
+				break
+			}
+			header, err := parseIHDR(data[offset+8 : end])
+			if err != nil {
+				break
+			}
+			if err := l.checkHeader(header); err != nil {
+				return err
+			}
+		case isTextChunk(chunkType):
+			if exceedsLimit(length, l.MaxTextChunkSize) {
+				return NewDataErrorCodef(CodeLimitExceeded, l10n.T("%s chunk of %d bytes exceeds limit %d"), chunkType, length, l.MaxTextChunkSize)
+			}
+		case chunkType == "IEND":
+			return nil
+		}
+
+		offset += 12 + length
+	}
+
+	return nil
+}
+
+// checkHeader はIHDRで宣言された画像サイズと展開後のデータ量を上限と比較します。
+func (l Limits) checkHeader(header *pngHeader) error {
+	if exceedsLimit(int64(header.Width), int64(l.MaxWidth)) {
+		return NewDataErrorCodef(CodeLimitExceeded, l10n.T("image width %d exceeds limit %d"), header.Width, l.MaxWidth)
+	}
+	if exceedsLimit(int64(header.Height), int64(l.MaxHeight)) {
+		return NewDataErrorCodef(CodeLimitExceeded, l10n.T("image height %d exceeds limit %d"), header.Height, l.MaxHeight)
+	}
+	pixels := int64(header.Width) * int64(header.Height)
+	if exceedsLimit(pixels, l.MaxPixels) {
+		return NewDataErrorCodef(CodeLimitExceeded, l10n.T("image of %d pixels exceeds limit %d"), pixels, l.MaxPixels)
+	}
+	if size := header.rawDataSize(); exceedsLimit(size, l.MaxDecompressedSize) {
+		return NewDataErrorCodef(CodeLimitExceeded, l10n.T("decompressed image data of %d bytes exceeds limit %d"), size, l.MaxDecompressedSize)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+)
+
+// setIHDRSize はIHDRで宣言された画像サイズを書き換え、CRCを再計算します
+func setIHDRSize(t *testing.T, data []byte, width, height uint32) []byte {
+	data = bytes.Clone(data)
+	ihdr := findChunkOffset(t, data, "IHDR")
+	binary.BigEndian.PutUint32(data[ihdr+8:ihdr+12], width)
+	binary.BigEndian.PutUint32(data[ihdr+12:ihdr+16], height)
+	binary.BigEndian.PutUint32(data[ihdr+21:ihdr+25], chunkCRC("IHDR", data[ihdr+8:ihdr+21]))
+	return data
+}
+
+func TestLimits_Check(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/colortype_rgba.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	bomb := setIHDRSize(t, original, 100000, 100000)
+	withText := insertChunkBeforeIEND(t, original, &pngstructure.Chunk{Type: "tEXt", Data: append([]byte("Comment\x00"), make([]byte, 1024)...)})
+	manyChunks := original
+	for i := 0; i < 10; i++ {
+		manyChunks = insertChunkBeforeIEND(t, manyChunks, &pngstructure.Chunk{Type: "prVt", Data: []byte{1}})
+	}
+
+	cases := []struct {
+		name        string
+		limits      Limits
+		data        []byte
+		expectError bool
+	}{
+		{"デフォルトの上限内", Limits{}, original, false},
+		{"展開爆弾", Limits{}, bomb, true},
+		{"制限なし", Limits{MaxWidth: -1, MaxHeight: -1, MaxPixels: -1, MaxDecompressedSize: -1}, bomb, false},
+		{"幅", Limits{MaxWidth: 10}, original, true},
+		{"高さ", Limits{MaxHeight: 10}, original, true},
+		{"ピクセル数", Limits{MaxPixels: 100}, original, true},
+		{"展開後のサイズ", Limits{MaxDecompressedSize: 100}, original, true},
+		{"テキストチャンク", Limits{MaxTextChunkSize: 1000}, withText, true},
+		{"テキストチャンクの上限内", Limits{MaxTextChunkSize: 2000}, withText, false},
+		{"チャンク数", Limits{MaxChunks: 10}, manyChunks, true},
+		{"PNGではない", Limits{}, []byte("not a png"), false},
+		{"途切れたファイル", Limits{}, bomb[:40], true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.limits.Check(tc.data)
+			if !tc.expectError {
+				if err != nil {
+					t.Errorf("Check() = %v; want nil", err)
+				}
+				return
+			}
+			dataErr := AsDataError(err)
+			if dataErr == nil || dataErr.Code() != CodeLimitExceeded {
+				t.Errorf("Check() = %v; want DataError with CodeLimitExceeded", err)
+			}
+		})
+	}
+}
+
+func TestOptimize_Limits(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	original, err := os.ReadFile("testdata/variations/colortype_rgba.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	srcPath := filepath.Join(tempDir, "bomb.png")
+	if err := os.WriteFile(srcPath, setIHDRSize(t, original, 100000, 100000), 0644); err != nil {
+		t.Fatalf("os.WriteFile() = %v; want nil", err)
+	}
+	destPath := filepath.Join(tempDir, "out.png")
+
+	optimizer := NewOptimizer("")
+	_, err = optimizer.Run(srcPath, destPath)
+	if dataErr := AsDataError(err); dataErr == nil || dataErr.Code() != CodeLimitExceeded {
+		t.Fatalf("Run() = %v; want DataError with CodeLimitExceeded", err)
+	}
+	if _, err := os.Stat(destPath); !os.IsNotExist(err) {
+		t.Errorf("os.Stat() = %v; want not exist", err)
+	}
+}
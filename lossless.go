@@ -0,0 +1,126 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for lossless.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"failed to decode PNG before lossless stage: %v": "可逆ステージの前のPNGのデコードに失敗しました: %v",
+		"failed to decode PNG after lossless stage: %v":  "可逆ステージの後のPNGのデコードに失敗しました: %v",
+		"image size changed from %dx%d to %dx%d":         "画像のサイズが %dx%d から %dx%d に変わりました",
+		"pixel at (%d, %d) changed":                      "(%d, %d) のピクセルが変わりました",
+		"lossless check of %s stage failed: %v":          "%sステージの可逆性の確認に失敗しました: %v",
+		"metadata strip changed pixels: %v":              "メタデータの削除でピクセルが変わりました: %v",
+		"comment insertion changed pixels: %v":           "コメントの追加でピクセルが変わりました: %v",
+	})
+}
+
+// checkLossless は、可逆であるはずのステージの前後のPNGデータをデコードし、
+// ピクセルが完全に一致することを確認します。
+// ピクセルはpixelHashと同じく16ビットの非乗算アルファ（NRGBA64）に揃えて比較するため、
+// カラータイプやビット深度の表現が異なっても、同じ色であれば一致とみなします。
+// 完全に透明なピクセルの色が変わった場合も不一致とします。
+// 一致しない場合は最初に異なったピクセルの位置を含むDataErrorを返します。
+func checkLossless(before, after []byte) error {
+	beforeImage, err := png.Decode(bytes.NewReader(before))
+	if err != nil {
+		return NewDataErrorCodef(decodeErrorCode(err), l10n.T("failed to decode PNG before lossless stage: %v"), err)
+	}
+	afterImage, err := png.Decode(bytes.NewReader(after))
+	if err != nil {
+		return NewDataErrorCodef(decodeErrorCode(err), l10n.T("failed to decode PNG after lossless stage: %v"), err)
+	}
+
+	beforeBounds, afterBounds := beforeImage.Bounds(), afterImage.Bounds()
+	if beforeBounds.Dx() != afterBounds.Dx() || beforeBounds.Dy() != afterBounds.Dy() {
+		return NewDataErrorCodef(CodePixelsChanged, l10n.T("image size changed from %dx%d to %dx%d"),
+			beforeBounds.Dx(), beforeBounds.Dy(), afterBounds.Dx(), afterBounds.Dy())
+	}
+
+	beforePix, afterPix := toNRGBA64(beforeImage), toNRGBA64(afterImage)
+	if bytes.Equal(beforePix.Pix, afterPix.Pix) {
+		return nil
+	}
+
+	// 最初に異なったピクセルを探してエラーに含める
+	for y := 0; y < beforeBounds.Dy(); y++ {
+		row := y * beforePix.Stride
+		if bytes.Equal(beforePix.Pix[row:row+beforePix.Stride], afterPix.Pix[row:row+afterPix.Stride]) {
+			continue
+		}
+		for x := 0; x < beforeBounds.Dx(); x++ {
+			i := row + x*8
+			if !bytes.Equal(beforePix.Pix[i:i+8], afterPix.Pix[i:i+8]) {
+				return NewDataErrorCodef(CodePixelsChanged, l10n.T("pixel at (%d, %d) changed"), x, y)
+			}
+		}
+	}
+	return nil
+}
+
+// losslessStageError は、checkLosslessのエラーをstageのエラーとして記録する形に変換します。
+// ピクセルが実際に変わった場合だけchangedFormatのメッセージでCodePixelsChangedとし、
+// デコードの失敗など比較できなかった場合は元のエラーのコードを維持します。
+func losslessStageError(err error, stage Stage, changedFormat string) error {
+	if CodeOf(err) == CodePixelsChanged {
+		return withStage(NewDataErrorCodef(CodePixelsChanged, l10n.T(changedFormat), err), stage)
+	}
+	return withStage(NewDataErrorCodef(CodeOf(err), l10n.T("lossless check of %s stage failed: %v"), stage, err), stage)
+}
+
+// toNRGBA64 は画像を原点から始まる非乗算アルファのNRGBA64に変換します。
+// draw.Drawは乗算済みアルファを経由するため完全に透明なピクセルの色が失われますが、
+// ここでは非乗算のサンプルをそのまま16ビットに広げるため、透明なピクセルの色も保たれます。
+// checkLossless、pixelHash、analyzePixelsはこの変換を共有します。
+func toNRGBA64(img image.Image) *image.NRGBA64 {
+	bounds := img.Bounds()
+	if nrgba, ok := img.(*image.NRGBA64); ok && bounds.Min == (image.Point{}) {
+		return nrgba
+	}
+
+	dst := image.NewNRGBA64(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	switch src := img.(type) {
+	case *image.NRGBA64:
+		for y := 0; y < bounds.Dy(); y++ {
+			i := src.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(dst.Pix[y*dst.Stride:(y+1)*dst.Stride], src.Pix[i:i+bounds.Dx()*8])
+		}
+	case *image.NRGBA:
+		for y := 0; y < bounds.Dy(); y++ {
+			i := src.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			row := dst.Pix[y*dst.Stride : (y+1)*dst.Stride]
+			for j, v := range src.Pix[i : i+bounds.Dx()*4] {
+				row[j*2], row[j*2+1] = v, v
+			}
+		}
+	default:
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				dst.SetNRGBA64(x, y, nrgba64Color(img.At(bounds.Min.X+x, bounds.Min.Y+y)))
+			}
+		}
+	}
+	return dst
+}
+
+// nrgba64Color は色を非乗算アルファの16ビットの色に変換します。
+// color.NRGBA64Modelは8ビットのcolor.NRGBA（パレットの色など）を乗算済みアルファを経由して変換するため、
+// color.NRGBAはそのまま16ビットに広げます。
+func nrgba64Color(c color.Color) color.NRGBA64 {
+	if nrgba, ok := c.(color.NRGBA); ok {
+		return color.NRGBA64{
+			R: uint16(nrgba.R) * 0x101,
+			G: uint16(nrgba.G) * 0x101,
+			B: uint16(nrgba.B) * 0x101,
+			A: uint16(nrgba.A) * 0x101,
+		}
+	}
+	return color.NRGBA64Model.Convert(c).(color.NRGBA64)
+}
@@ -0,0 +1,179 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pngmetawebstrip "github.com/ideamans/go-png-meta-web-strip"
+)
+
+func TestCheckLossless(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/colortype_rgba.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	img, err := png.Decode(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("png.Decode() = %v; want nil", err)
+	}
+	bounds := img.Bounds()
+
+	encode := func(img image.Image, level png.CompressionLevel) []byte {
+		var buf bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: level}
+		if err := encoder.Encode(&buf, img); err != nil {
+			t.Fatalf("Encode() = %v; want nil", err)
+		}
+		return buf.Bytes()
+	}
+
+	stripped, _, err := pngmetawebstrip.Strip(original)
+	if err != nil {
+		t.Fatalf("Strip() = %v; want nil", err)
+	}
+
+	// 同じピクセルを別の圧縮レベルで再エンコード
+	recompressed := encode(img, png.BestCompression)
+
+	// 1ピクセルだけ変更
+	changed := image.NewNRGBA(bounds)
+	draw.Draw(changed, bounds, img, bounds.Min, draw.Src)
+	c := changed.NRGBAAt(bounds.Min.X+1, bounds.Min.Y+2)
+	c.R ^= 0xff
+	changed.SetNRGBA(bounds.Min.X+1, bounds.Min.Y+2, c)
+
+	// サイズを変更
+	cropped := changed.SubImage(image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X-1, bounds.Max.Y))
+
+	// カラータイプだけが異なる同じ画像
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 16)
+	}
+	rgb := image.NewRGBA(gray.Bounds())
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			v := gray.GrayAt(x, y).Y
+			rgb.SetRGBA(x, y, color.RGBA{v, v, v, 0xff})
+		}
+	}
+
+	// 完全に透明なピクセルの色だけを変更
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := range transparent.Pix {
+		transparent.Pix[i] = 0xff
+	}
+	transparent.SetNRGBA(1, 1, color.NRGBA{0x10, 0x20, 0x30, 0})
+	transparentChanged := image.NewNRGBA(transparent.Bounds())
+	copy(transparentChanged.Pix, transparent.Pix)
+	transparentChanged.SetNRGBA(1, 1, color.NRGBA{0x40, 0x50, 0x60, 0})
+
+	cases := []struct {
+		name        string
+		before      []byte
+		after       []byte
+		expectError bool
+		expectCode  ErrorCode
+	}{
+		{"同一", original, original, false, CodeUnknown},
+		{"メタデータの削除", original, stripped, false, CodeUnknown},
+		{"再圧縮", original, recompressed, false, CodeUnknown},
+		{"カラータイプの違い", encode(gray, png.DefaultCompression), encode(rgb, png.DefaultCompression), false, CodeUnknown},
+		{"ピクセルの変更", original, encode(changed, png.DefaultCompression), true, CodePixelsChanged},
+		{"透明なピクセルの色の変更", encode(transparent, png.DefaultCompression), encode(transparentChanged, png.DefaultCompression), true, CodePixelsChanged},
+		{"サイズの変更", original, encode(cropped, png.DefaultCompression), true, CodePixelsChanged},
+		{"デコードできない", original, original[:len(original)/2], true, CodeDecodeFailed},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkLossless(tc.before, tc.after)
+			if tc.expectError {
+				if AsDataError(err) == nil || CodeOf(err) != tc.expectCode {
+					t.Errorf("checkLossless() = %v (code %v); want DataError with code %v", err, CodeOf(err), tc.expectCode)
+				}
+			} else if err != nil {
+				t.Errorf("checkLossless() = %v; want nil", err)
+			}
+		})
+	}
+}
+
+func TestToNRGBA64(t *testing.T) {
+	transparent := color.NRGBA{0x10, 0x20, 0x30, 0}
+	expected := color.NRGBA64{0x1010, 0x2020, 0x3030, 0}
+
+	nrgba := image.NewNRGBA(image.Rect(2, 3, 6, 7))
+	nrgba.SetNRGBA(3, 4, transparent)
+	paletted := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.NRGBA{0, 0, 0, 0xff}, transparent})
+	paletted.SetColorIndex(1, 1, 1)
+
+	cases := []struct {
+		name string
+		img  image.Image
+	}{
+		{"NRGBA", nrgba},
+		{"パレット", paletted},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := toNRGBA64(tc.img)
+			if actual.Bounds() != image.Rect(0, 0, 4, 4) {
+				t.Fatalf("Bounds() = %v; want %v", actual.Bounds(), image.Rect(0, 0, 4, 4))
+			}
+			if c := actual.NRGBA64At(1, 1); c != expected {
+				t.Errorf("NRGBA64At(1, 1) = %v; want %v", c, expected)
+			}
+		})
+	}
+}
+
+func TestLosslessStageError(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		expectCode ErrorCode
+	}{
+		{"ピクセルの変更", NewDataErrorCodef(CodePixelsChanged, "pixel changed"), CodePixelsChanged},
+		{"デコードの失敗", NewDataErrorCodef(CodeDecodeFailed, "truncated"), CodeDecodeFailed},
+		{"分類されていないエラー", NewDataErrorf("unknown"), CodeUnknown},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := losslessStageError(tc.err, StageStrip, "metadata strip changed pixels: %v")
+			if CodeOf(err) != tc.expectCode || StageOf(err) != StageStrip {
+				t.Errorf("losslessStageError() = %v (code %v, stage %v); want code %v, stage %v", err, CodeOf(err), StageOf(err), tc.expectCode, StageStrip)
+			}
+		})
+	}
+}
+
+func TestOptimize_LosslessStages(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	for _, name := range []string{"metadata_text.png", "colortype_palette.png", "depth_16bit.png", "interlace_adam7.png"} {
+		t.Run(name, func(t *testing.T) {
+			optimizer := NewOptimizer("")
+			optimizer.CheckLossless = true
+			output, err := optimizer.Run(filepath.Join("testdata/variations", name), filepath.Join(tempDir, name))
+			if err != nil {
+				t.Fatalf("Run() = %v; want nil", err)
+			}
+			if output.StripError != nil {
+				t.Errorf("StripError = %v; want nil", output.StripError)
+			}
+			if output.CommentError != nil {
+				t.Errorf("CommentError = %v; want nil", output.CommentError)
+			}
+		})
+	}
+}
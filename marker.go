@@ -0,0 +1,197 @@
+package png
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for marker.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"failed to read sidecar marker: %w":        "サイドカーマーカーの読み込みに失敗しました: %w",
+		"failed to write sidecar marker: %w":       "サイドカーマーカーの書き込みに失敗しました: %w",
+		"failed to read extended attribute: %w":    "拡張属性の読み込みに失敗しました: %w",
+		"failed to write extended attribute: %w":   "拡張属性の書き込みに失敗しました: %w",
+		"unsupported marker storage: %d":           "サポートされていないマーカー保存方式です: %d",
+		"unknown marker storage: %s":               "不明なマーカー保存方式です: %s",
+		"embedded markers cannot be written to %s": "埋め込みマーカーは %s に直接書き込めません",
+
+		// マーカーを書き込むファイルのハッシュ
+		"failed to read file for marker: %w": "マーカーを書き込むファイルの読み込みに失敗しました: %w",
+	})
+}
+
+// MarkerStorage は最適化済みマーカー（LightFileコメント）の保存先を表します。
+type MarkerStorage int
+
+const (
+	// MarkerEmbedded はPNG内のテキストチャンクにマーカーを埋め込みます（デフォルト）
+	MarkerEmbedded MarkerStorage = iota
+	// MarkerNone はマーカーを一切保存せず、検出も行いません。
+	// 出力にチャンクが追加されない代わりに、同じファイルは毎回最適化の対象になります。
+	MarkerNone
+	// MarkerXattr は出力ファイルの拡張属性（Linuxのみ）にマーカーを保存します
+	MarkerXattr
+	// MarkerSidecar は出力ファイルと同じディレクトリのJSONファイルにマーカーを保存します
+	MarkerSidecar
+)
+
+// XattrName はMarkerXattrで使用する拡張属性の名前です。
+const XattrName = "user.lightfile"
+
+// SidecarSuffix はMarkerSidecarで使用するサイドカーファイルの拡張子です。
+const SidecarSuffix = ".lightfile.json"
+
+// ErrXattrUnsupported は実行中のプラットフォームで拡張属性が利用できないことを示します。
+var ErrXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// String はマーカー保存方式の名前を返します。
+func (s MarkerStorage) String() string {
+	switch s {
+	case MarkerEmbedded:
+		return "embedded"
+	case MarkerNone:
+		return "none"
+	case MarkerXattr:
+		return "xattr"
+	case MarkerSidecar:
+		return "sidecar"
+	}
+	return fmt.Sprintf("MarkerStorage(%d)", int(s))
+}
+
+// ParseMarkerStorage はマーカー保存方式の名前（embedded, none, xattr, sidecar）を解析します。
+func ParseMarkerStorage(name string) (MarkerStorage, error) {
+	for _, s := range []MarkerStorage{MarkerEmbedded, MarkerNone, MarkerXattr, MarkerSidecar} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return MarkerEmbedded, NewSystemErrorf(CodeInvalidOption, l10n.T("unknown marker storage: %s"), name)
+}
+
+// SidecarPath はPNGファイルに対応するサイドカーファイルのパスを返します。
+func SidecarPath(pngPath string) string {
+	return pngPath + SidecarSuffix
+}
+
+// ReadMarker は、指定された保存方式に従って最適化済みマーカーを読み込みます。
+// MarkerEmbeddedではdataからReadCommentと同様に読み込み、
+// MarkerXattrとMarkerSidecarではpathのファイルに対応する保存先から読み込みます。
+// マーカーが存在しない場合はnilと空文字列を返します。
+//
+// ファイルの外部に保存されたマーカーは、記録されたOutputHashがdataのハッシュと
+// 一致する場合のみ有効です。最適化の後にファイルが置き換えられた場合などに
+// 残ったマーカーは、存在しないものとして扱います。
+func ReadMarker(storage MarkerStorage, path string, data []byte) (*LightFileComment, string, error) {
+	switch storage {
+	case MarkerEmbedded:
+		return ReadComment(data)
+	case MarkerNone:
+		return nil, "", nil
+	case MarkerXattr:
+		text, err := getXattr(path, XattrName)
+		if err != nil {
+			return nil, "", NewSystemErrorf(CodeIO, l10n.T("failed to read extended attribute: %w"), err)
+		}
+		comment, raw := matchingMarker(text, data)
+		return comment, raw, nil
+	case MarkerSidecar:
+		text, err := os.ReadFile(SidecarPath(path))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, "", nil
+		}
+		if err != nil {
+			return nil, "", NewSystemErrorf(CodeIO, l10n.T("failed to read sidecar marker: %w"), err)
+		}
+		comment, raw := matchingMarker(text, data)
+		return comment, raw, nil
+	}
+	return nil, "", NewSystemErrorf(CodeInvalidOption, l10n.T("unsupported marker storage: %d"), storage)
+}
+
+// WriteMarker は、ファイルの外部にマーカーを保存する方式（MarkerXattr、MarkerSidecar）で
+// pathのファイルに対するマーカーを書き込みます。
+// MarkerNoneでは何もしません。MarkerEmbeddedはPNGデータの書き換えが必要なため、
+// PNGMetaManager.WriteCommentを使用してください。
+// MarkerSidecarのファイルはDefaultOutputModeのパーミッションでアトミックに書き込みます。
+//
+// comment.OutputHashが空の場合は、pathのファイルの現在の内容のハッシュを記録します。
+// コメントに署名する場合は、署名の前にOutputHashを設定してください。
+func WriteMarker(storage MarkerStorage, path string, comment *LightFileComment) error {
+	if comment.OutputHash == "" && (storage == MarkerXattr || storage == MarkerSidecar) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return NewSystemErrorf(CodeIO, l10n.T("failed to read file for marker: %w"), err)
+		}
+		hashed := *comment
+		hashed.OutputHash = contentHash(data)
+		comment = &hashed
+	}
+	return writeMarker(storage, path, comment, outputAttributes{mode: DefaultOutputMode})
+}
+
+// writeMarker はWriteMarkerの本体です。MarkerSidecarのファイルにはattrsを設定します。
+func writeMarker(storage MarkerStorage, path string, comment *LightFileComment, attrs outputAttributes) error {
+	switch storage {
+	case MarkerNone:
+		return nil
+	case MarkerEmbedded:
+		return NewSystemErrorf(CodeInvalidOption, l10n.T("embedded markers cannot be written to %s"), path)
+	}
+
+	jsonData, err := json.Marshal(comment)
+	if err != nil {
+		return NewDataErrorCodef(CodeCommentFailed, l10n.T("failed to marshal comment to JSON: %v"), err)
+	}
+
+	switch storage {
+	case MarkerXattr:
+		if err := setXattr(path, XattrName, jsonData); err != nil {
+			return NewSystemErrorf(CodeIO, l10n.T("failed to write extended attribute: %w"), err)
+		}
+		return nil
+	case MarkerSidecar:
+		if err := writeFileAtomic(SidecarPath(path), jsonData, attrs); err != nil {
+			return NewSystemErrorf(CodeIO, l10n.T("failed to write sidecar marker: %w"), err)
+		}
+		return nil
+	}
+	return NewSystemErrorf(CodeInvalidOption, l10n.T("unsupported marker storage: %d"), storage)
+}
+
+// contentHash はファイルの内容のハッシュを"sha256:<hex>"の形式で返します。
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// matchingMarker はファイルの外部に保存されたマーカーのテキストを解析し、
+// OutputHashがdataのハッシュと一致しない場合はマーカーがないものとしてnilと空文字列を返します。
+func matchingMarker(text []byte, data []byte) (*LightFileComment, string) {
+	comment, raw := parseCommentText(text)
+	if comment != nil && comment.OutputHash != contentHash(data) {
+		return nil, ""
+	}
+	return comment, raw
+}
+
+// parseCommentText はマーカーのテキストをLightFileCommentとして解析します。
+// マーカーが空の場合はnilと空文字列を、JSONとして解析できない場合はnilと生のテキストを返します。
+func parseCommentText(text []byte) (*LightFileComment, string) {
+	if len(text) == 0 {
+		return nil, ""
+	}
+
+	var comment LightFileComment
+	if err := json.Unmarshal(text, &comment); err != nil {
+		return nil, string(text)
+	}
+	return &comment, string(text)
+}
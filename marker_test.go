@@ -0,0 +1,162 @@
+package png
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseMarkerStorage(t *testing.T) {
+	for _, storage := range []MarkerStorage{MarkerEmbedded, MarkerNone, MarkerXattr, MarkerSidecar} {
+		parsed, err := ParseMarkerStorage(storage.String())
+		if err != nil {
+			t.Errorf("ParseMarkerStorage(%q) = %v; want nil", storage.String(), err)
+		}
+		if parsed != storage {
+			t.Errorf("ParseMarkerStorage(%q) = %v; want %v", storage.String(), parsed, storage)
+		}
+	}
+
+	if _, err := ParseMarkerStorage("unknown"); CodeOf(err) != CodeInvalidOption {
+		t.Errorf("ParseMarkerStorage(unknown) = %v; want code %s", err, CodeInvalidOption)
+	}
+}
+
+func TestWriteMarker_InvalidStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.png")
+	for _, storage := range []MarkerStorage{MarkerEmbedded, MarkerStorage(99)} {
+		err := WriteMarker(storage, path, &LightFileComment{By: "LightFile"})
+		if AsSystemError(err) == nil || CodeOf(err) != CodeInvalidOption {
+			t.Errorf("WriteMarker(%v) = %v; want SystemError with code %s", storage, err, CodeInvalidOption)
+		}
+	}
+	if _, _, err := ReadMarker(MarkerStorage(99), path, nil); CodeOf(err) != CodeInvalidOption {
+		t.Errorf("ReadMarker(99) = %v; want code %s", err, CodeInvalidOption)
+	}
+}
+
+func TestWriteAndReadMarker(t *testing.T) {
+	tempDir := t.TempDir()
+	comment := &LightFileComment{
+		Schema: CommentSchemaVersion,
+		By:     "LightFile",
+		Before: 2048,
+		After:  1024,
+	}
+
+	for _, storage := range []MarkerStorage{MarkerSidecar, MarkerXattr} {
+		t.Run(storage.String(), func(t *testing.T) {
+			path := filepath.Join(tempDir, storage.String()+".png")
+			data := []byte("dummy")
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatalf("os.WriteFile() = %v; want nil", err)
+			}
+
+			// マーカーがない場合はnil
+			read, raw, err := ReadMarker(storage, path, data)
+			if err != nil {
+				if errors.Is(err, ErrXattrUnsupported) || errors.Is(err, syscall.ENOTSUP) {
+					t.Skipf("extended attributes are not available: %v", err)
+				}
+				t.Fatalf("ReadMarker() = %v; want nil", err)
+			}
+			if read != nil || raw != "" {
+				t.Errorf("ReadMarker() = %+v, %q; want nil", read, raw)
+			}
+
+			if err := WriteMarker(storage, path, comment); err != nil {
+				if errors.Is(err, syscall.ENOTSUP) {
+					t.Skipf("extended attributes are not available: %v", err)
+				}
+				t.Fatalf("WriteMarker() = %v; want nil", err)
+			}
+
+			read, _, err = ReadMarker(storage, path, data)
+			if err != nil {
+				t.Fatalf("ReadMarker() = %v; want nil", err)
+			}
+			if read == nil || read.By != comment.By || read.After != comment.After {
+				t.Errorf("ReadMarker() = %+v; want %+v", read, comment)
+			}
+			if read != nil && read.OutputHash != contentHash(data) {
+				t.Errorf("OutputHash = %q; want %q", read.OutputHash, contentHash(data))
+			}
+
+			// 内容が変わったファイルのマーカーは無視する
+			read, raw, err = ReadMarker(storage, path, []byte("replaced"))
+			if err != nil || read != nil || raw != "" {
+				t.Errorf("ReadMarker(replaced) = %+v, %q, %v; want nil", read, raw, err)
+			}
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/optimize/already-lightfile-truly.png")
+		if err != nil {
+			t.Fatalf("os.ReadFile() = %v; want nil", err)
+		}
+		read, _, err := ReadMarker(MarkerNone, "", data)
+		if err != nil || read != nil {
+			t.Errorf("ReadMarker(MarkerNone) = %+v, %v; want nil, nil", read, err)
+		}
+	})
+}
+
+func TestOptimize_MarkerSidecar(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	destPath := filepath.Join(tempDir, "sidecar.png")
+
+	optimizer := NewOptimizer("")
+	optimizer.MarkerStorage = MarkerSidecar
+	optimizer.OutputMode = 0o640
+
+	result, err := optimizer.Run("testdata/optimize/psnr-will-50.png", destPath)
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if result.CantOptimize || result.InspectionFailed {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+
+	// PNG自体にはコメントが追加されない
+	data, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	embedded, _, err := ReadComment(data)
+	if err != nil {
+		t.Fatalf("ReadComment() = %v; want nil", err)
+	}
+	if embedded != nil {
+		t.Errorf("Output should not have an embedded comment, got: %+v", embedded)
+	}
+
+	// サイドカーは出力と同じパーミッションで書き込まれる
+	if info, err := os.Stat(SidecarPath(destPath)); err != nil {
+		t.Errorf("Sidecar file should exist: %v", err)
+	} else if info.Mode().Perm() != 0o640 {
+		t.Errorf("Sidecar mode = %v; want %v", info.Mode().Perm(), os.FileMode(0o640))
+	}
+
+	// サイドカーを参照して最適化済みと判定される
+	result, err = optimizer.Run(destPath, filepath.Join(tempDir, "again.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if !result.AlreadyOptimized {
+		t.Error("Output with sidecar marker should be treated as already optimized")
+	}
+
+	// 別の画像に置き換えられたファイルは、サイドカーが残っていても最適化する
+	copyTestFile(t, "testdata/optimize/psnr-will-50.png", destPath, 0o640)
+	result, err = optimizer.Run(destPath, filepath.Join(tempDir, "replaced.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if result.AlreadyOptimized {
+		t.Error("Replaced file with a stale sidecar marker should not be treated as already optimized")
+	}
+}
@@ -0,0 +1,312 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	exif "github.com/dsoprea/go-exif/v3"
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+	"github.com/ideamans/go-l10n"
+)
+
+// Metadata はPNGに含まれるメタデータ（補助チャンク）の内容です。
+// 該当するチャンクが存在しない項目はゼロ値（ポインタの場合はnil）になります。
+type Metadata struct {
+	Text           []TextEntry         // テキストチャンク（tEXt、zTXt、iTXt）を出現順に並べたもの
+	ICCProfile     *ICCProfile         // iCCPチャンク
+	SRGBIntent     *int                // sRGBチャンクのレンダリングインテント（0〜3）
+	Gamma          float64             // gAMAチャンクのガンマ値（存在しない場合は0）
+	Chromaticities *Chromaticities     // cHRMチャンク
+	Physical       *PhysicalDimensions // pHYsチャンク
+	ModTime        time.Time           // tIMEチャンクの最終更新時刻（UTC）
+	Background     *Background         // bKGDチャンク
+	Exif           []byte              // eXIfチャンクの生データ
+	ExifTags       []ExifTag           // eXIfチャンクを解析したタグ（解析できない場合はnil）
+	CICP           *CICP               // cICPチャンク
+
+	Transparency    *Transparency // tRNSチャンク
+	SignificantBits []uint8       // sBITチャンクの各チャネルの有効ビット数（カラータイプの順）
+	Histogram       []uint16      // hISTチャンクのパレットの各色の使用頻度
+	Unknown         []ChunkInfo   // 上記以外の補助チャンク
+
+	colorType int // IHDRのカラータイプ（tRNSとsBITの解釈に使用）
+}
+
+// TextEntry はテキストチャンク1件の内容です。
+type TextEntry struct {
+	Type              string // チャンクタイプ（tEXt、zTXt、iTXt）
+	Keyword           string // キーワード
+	Text              string // 本文（圧縮されている場合は展開後）
+	Compressed        bool   // 本文が圧縮されていたかどうか
+	Language          string // 言語タグ（iTXtのみ）
+	TranslatedKeyword string // 翻訳済みキーワード（iTXtのみ）
+}
+
+// ICCProfile はiCCPチャンクに埋め込まれたICCプロファイルです。
+type ICCProfile struct {
+	Name string // プロファイル名
+	Data []byte // 展開後のプロファイル本体
+}
+
+// Chromaticities はcHRMチャンクの白色点と原色の色度座標です。
+type Chromaticities struct {
+	WhiteX, WhiteY float64
+	RedX, RedY     float64
+	GreenX, GreenY float64
+	BlueX, BlueY   float64
+}
+
+// PhysicalDimensions はpHYsチャンクのピクセル密度です。
+type PhysicalDimensions struct {
+	X, Y  uint32 // 単位あたりのピクセル数
+	Meter bool   // 単位がメートルの場合はtrue、縦横比のみの場合はfalse
+}
+
+// Background はbKGDチャンクの背景色です。
+// どの項目が有効かは画像のカラータイプによって異なります。
+type Background struct {
+	PaletteIndex     int    // パレット番号（カラータイプ3以外は-1）
+	Gray             uint16 // グレースケール値（カラータイプ0、4）
+	Red, Green, Blue uint16 // RGB値（カラータイプ2、6）
+}
+
+// Transparency はtRNSチャンクの透明色です。
+// どの項目が有効かは画像のカラータイプによって異なります。
+type Transparency struct {
+	PaletteAlpha     []uint8 // パレットの各色のアルファ値（カラータイプ3）
+	Gray             uint16  // 透明として扱うグレースケール値（カラータイプ0）
+	Red, Green, Blue uint16  // 透明として扱うRGB値（カラータイプ2）
+}
+
+// CICP はcICPチャンクの符号化非依存コードポイント（ITU-T H.273）です。
+type CICP struct {
+	ColourPrimaries         uint8
+	TransferCharacteristics uint8
+	MatrixCoefficients      uint8
+	FullRange               bool
+}
+
+// ExifTag はeXIfチャンクに含まれるExifタグ1件です。
+type ExifTag struct {
+	IFD       string      // IFDのパス（例: IFD、IFD/Exif）
+	ID        uint16      // タグID
+	Name      string      // タグ名
+	Value     interface{} // 解析した値
+	Formatted string      // 表示用に整形した値
+}
+
+// ChunkInfo はチャンクの種類とデータ部のサイズです。
+type ChunkInfo struct {
+	Type string
+	Size int
+}
+
+// ReadMetadata は、PNGデータに含まれるメタデータを読み込みます。
+// 画像データに関わる必須チャンク（IHDR、PLTE、IDAT、IEND）は対象外です。
+// 既知のチャンクの形式が不正な場合はDataErrorを返しますが、eXIfの内容が
+// 解析できない場合は生データのみを返します。
+// チャンク数とテキストチャンクのサイズにはDefaultLimitsを適用し、上限を超える場合は
+// コードがCodeLimitExceededのDataErrorを返します。
+func ReadMetadata(data []byte) (*Metadata, error) {
+	if err := (Limits{}).Check(data); err != nil {
+		return nil, err
+	}
+	pmp := pngstructure.NewPngMediaParser()
+
+	mediaContext, err := pmp.ParseBytes(data)
+	if err != nil {
+		return nil, NewDataErrorCodef(structureErrorCode(err), l10n.T("failed to parse PNG structure: %v"), err)
+	}
+
+	cs, ok := mediaContext.(*pngstructure.ChunkSlice)
+	if !ok {
+		return nil, NewDataErrorCodef(CodeInvalidStructure, l10n.T("unexpected media context type"))
+	}
+
+	metadata := &Metadata{}
+	for _, chunk := range cs.Chunks() {
+		if err := metadata.readChunk(chunk.Type, chunk.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// readChunk はチャンク1件の内容をメタデータに反映します。
+func (m *Metadata) readChunk(chunkType string, data []byte) error {
+	switch chunkType {
+	case "IHDR":
+		if len(data) >= 10 {
+			m.colorType = int(data[9])
+		}
+		return nil
+
+	case "PLTE", "IDAT", "IEND":
+		return nil
+
+	case "tEXt", "zTXt", "iTXt":
+		keyword, text, err := decodeTextChunk(chunkType, data)
+		if err != nil {
+			return err
+		}
+		entry := TextEntry{Type: chunkType, Keyword: keyword, Text: text, Compressed: chunkType == "zTXt"}
+		if chunkType == "iTXt" {
+			entry.Compressed, entry.Language, entry.TranslatedKeyword, _ = itxtAttributes(data)
+		}
+		m.Text = append(m.Text, entry)
+
+	case "iCCP":
+		// profile name\0, compression method, compressed profile
+		name, ok := textChunkKeyword(data)
+		if !ok || len(data) < len(name)+2 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		if data[len(name)+1] != 0 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("unsupported compression method in %s chunk"), chunkType)
+		}
+		profile, err := inflateText(chunkType, data[len(name)+2:])
+		if err != nil {
+			return err
+		}
+		m.ICCProfile = &ICCProfile{Name: name, Data: profile}
+
+	case "sRGB":
+		if len(data) != 1 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		intent := int(data[0])
+		m.SRGBIntent = &intent
+
+	case "gAMA":
+		if len(data) != 4 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		m.Gamma = float64(binary.BigEndian.Uint32(data)) / 100000
+
+	case "cHRM":
+		if len(data) != 32 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		values := make([]float64, 8)
+		for i := range values {
+			values[i] = float64(binary.BigEndian.Uint32(data[i*4:])) / 100000
+		}
+		m.Chromaticities = &Chromaticities{
+			WhiteX: values[0], WhiteY: values[1],
+			RedX: values[2], RedY: values[3],
+			GreenX: values[4], GreenY: values[5],
+			BlueX: values[6], BlueY: values[7],
+		}
+
+	case "pHYs":
+		if len(data) != 9 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		m.Physical = &PhysicalDimensions{
+			X:     binary.BigEndian.Uint32(data[0:4]),
+			Y:     binary.BigEndian.Uint32(data[4:8]),
+			Meter: data[8] == 1,
+		}
+
+	case "tIME":
+		if len(data) != 7 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		m.ModTime = time.Date(
+			int(binary.BigEndian.Uint16(data[0:2])), time.Month(data[2]), int(data[3]),
+			int(data[4]), int(data[5]), int(data[6]), 0, time.UTC,
+		)
+
+	case "bKGD":
+		background := &Background{PaletteIndex: -1}
+		switch len(data) {
+		case 1:
+			background.PaletteIndex = int(data[0])
+		case 2:
+			background.Gray = binary.BigEndian.Uint16(data)
+		case 6:
+			background.Red = binary.BigEndian.Uint16(data[0:2])
+			background.Green = binary.BigEndian.Uint16(data[2:4])
+			background.Blue = binary.BigEndian.Uint16(data[4:6])
+		default:
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		m.Background = background
+
+	case "eXIf":
+		m.Exif = bytes.Clone(data)
+		m.ExifTags = parseExifTags(data)
+
+	case "cICP":
+		if len(data) != 4 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		m.CICP = &CICP{
+			ColourPrimaries:         data[0],
+			TransferCharacteristics: data[1],
+			MatrixCoefficients:      data[2],
+			FullRange:               data[3] == 1,
+		}
+
+	case "tRNS":
+		transparency := &Transparency{}
+		switch {
+		case m.colorType == 3 && len(data) <= 256:
+			transparency.PaletteAlpha = bytes.Clone(data)
+		case m.colorType == 0 && len(data) == 2:
+			transparency.Gray = binary.BigEndian.Uint16(data)
+		case m.colorType == 2 && len(data) == 6:
+			transparency.Red = binary.BigEndian.Uint16(data[0:2])
+			transparency.Green = binary.BigEndian.Uint16(data[2:4])
+			transparency.Blue = binary.BigEndian.Uint16(data[4:6])
+		default:
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		m.Transparency = transparency
+
+	case "sBIT":
+		// グレースケール、RGB（パレットを含む）、グレースケール+アルファ、RGBA の順にチャネル数が変わる
+		channels := map[int]int{0: 1, 2: 3, 3: 3, 4: 2, 6: 4}[m.colorType]
+		if channels == 0 || len(data) != channels {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		m.SignificantBits = bytes.Clone(data)
+
+	case "hIST":
+		if len(data)%2 != 0 {
+			return NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		m.Histogram = make([]uint16, len(data)/2)
+		for i := range m.Histogram {
+			m.Histogram[i] = binary.BigEndian.Uint16(data[i*2:])
+		}
+
+	default:
+		m.Unknown = append(m.Unknown, ChunkInfo{Type: chunkType, Size: len(data)})
+	}
+
+	return nil
+}
+
+// parseExifTags はeXIfチャンクのデータ部（TIFFヘッダーから始まるExif）を解析します。
+// 解析できない場合はnilを返します。
+func parseExifTags(data []byte) []ExifTag {
+	flat, _, err := exif.GetFlatExifData(data, nil)
+	if err != nil {
+		return nil
+	}
+
+	tags := make([]ExifTag, 0, len(flat))
+	for _, tag := range flat {
+		tags = append(tags, ExifTag{
+			IFD:       tag.IfdPath,
+			ID:        tag.TagId,
+			Name:      tag.TagName,
+			Value:     tag.Value,
+			Formatted: tag.Formatted,
+		})
+	}
+	return tags
+}
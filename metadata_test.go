@@ -0,0 +1,196 @@
+package png
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+)
+
+func TestReadMetadata(t *testing.T) {
+	cases := []struct {
+		name  string
+		file  string
+		check func(t *testing.T, m *Metadata)
+	}{
+		{
+			name: "eXIf、pHYs、sRGB",
+			file: "testdata/optimize/me2020.png",
+			check: func(t *testing.T, m *Metadata) {
+				if m.SRGBIntent == nil || *m.SRGBIntent != 0 {
+					t.Errorf("SRGBIntent = %v; want 0", m.SRGBIntent)
+				}
+				if m.Physical == nil || m.Physical.X != 5669 || !m.Physical.Meter {
+					t.Errorf("Physical = %+v; want X=5669 Meter=true", m.Physical)
+				}
+				if len(m.Exif) == 0 {
+					t.Error("Exif is empty")
+				}
+				found := false
+				for _, tag := range m.ExifTags {
+					if tag.Name == "PixelXDimension" && tag.Formatted == "[534]" {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("ExifTags = %+v; want PixelXDimension=534", m.ExifTags)
+				}
+				if len(m.Text) != 1 || m.Text[0].Type != "iTXt" || m.Text[0].Keyword != "XML:com.adobe.xmp" {
+					t.Errorf("Text = %+v; want one XMP iTXt", m.Text)
+				}
+			},
+		},
+		{
+			name: "ICCプロファイル",
+			file: "testdata/optimize/with-mac-icc.png",
+			check: func(t *testing.T, m *Metadata) {
+				if m.ICCProfile == nil || m.ICCProfile.Name != "kCGColorSpaceDisplayP3" {
+					t.Fatalf("ICCProfile = %+v; want kCGColorSpaceDisplayP3", m.ICCProfile)
+				}
+				// ICCプロファイルの先頭4バイトはプロファイルのサイズ
+				profile := m.ICCProfile.Data
+				if len(profile) < 128 || int(binary.BigEndian.Uint32(profile[0:4])) != len(profile) {
+					t.Errorf("len(ICCProfile.Data) = %d; want complete profile", len(profile))
+				}
+			},
+		},
+		{
+			name: "gAMA",
+			file: "testdata/optimize/psnr-will-27.png",
+			check: func(t *testing.T, m *Metadata) {
+				if m.Gamma != 0.55556 {
+					t.Errorf("Gamma = %v; want 0.55556", m.Gamma)
+				}
+			},
+		},
+		{
+			name: "cHRM、tIME、bKGD、テキスト",
+			file: "testdata/variations/alpha_semitransparent.png",
+			check: func(t *testing.T, m *Metadata) {
+				if m.Chromaticities == nil || m.Chromaticities.WhiteX != 0.3127 || m.Chromaticities.BlueY != 0.06 {
+					t.Errorf("Chromaticities = %+v; want D65/sRGB primaries", m.Chromaticities)
+				}
+				if expected := time.Date(2025, 5, 31, 5, 43, 30, 0, time.UTC); !m.ModTime.Equal(expected) {
+					t.Errorf("ModTime = %v; want %v", m.ModTime, expected)
+				}
+				if m.Background == nil || m.Background.PaletteIndex != -1 || m.Background.Red != 255 {
+					t.Errorf("Background = %+v; want white RGB", m.Background)
+				}
+				compressed := 0
+				for _, entry := range m.Text {
+					if entry.Compressed {
+						compressed++
+					}
+				}
+				if len(m.Text) != 18 || compressed != 1 {
+					t.Errorf("Text = %d entries (%d compressed); want 18 (1 compressed)", len(m.Text), compressed)
+				}
+			},
+		},
+		{
+			name: "パレットのbKGD",
+			file: "testdata/variations/colortype_palette.png",
+			check: func(t *testing.T, m *Metadata) {
+				if m.Background == nil || m.Background.PaletteIndex != 154 {
+					t.Errorf("Background = %+v; want PaletteIndex=154", m.Background)
+				}
+			},
+		},
+		{
+			name: "メタデータなし",
+			file: "testdata/variations/metadata_none.png",
+			check: func(t *testing.T, m *Metadata) {
+				if len(m.Text) != 0 || m.ICCProfile != nil || m.Background != nil || len(m.Unknown) != 0 {
+					t.Errorf("ReadMetadata() = %+v; want empty", m)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+			m, err := ReadMetadata(data)
+			if err != nil {
+				t.Fatalf("ReadMetadata() = %v; want nil", err)
+			}
+			tc.check(t, m)
+		})
+	}
+}
+
+func TestReadMetadata_InsertedChunks(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/metadata_none.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+
+	data := insertChunkBeforeIEND(t, original, &pngstructure.Chunk{Type: "cICP", Data: []byte{9, 16, 0, 1}})
+	data = insertChunkBeforeIEND(t, data, &pngstructure.Chunk{Type: "iTXt", Data: []byte("Title\x00\x00\x00ja\x00題名\x00タイトル")})
+	data = insertChunkBeforeIEND(t, data, &pngstructure.Chunk{Type: "prVt", Data: make([]byte, 42)})
+	data = insertChunkBeforeIEND(t, data, &pngstructure.Chunk{Type: "sBIT", Data: []byte{8, 8, 8, 4}})
+
+	m, err := ReadMetadata(data)
+	if err != nil {
+		t.Fatalf("ReadMetadata() = %v; want nil", err)
+	}
+
+	expectedCICP := CICP{ColourPrimaries: 9, TransferCharacteristics: 16, MatrixCoefficients: 0, FullRange: true}
+	if m.CICP == nil || *m.CICP != expectedCICP {
+		t.Errorf("CICP = %+v; want %+v", m.CICP, expectedCICP)
+	}
+
+	expectedText := TextEntry{Type: "iTXt", Keyword: "Title", Text: "タイトル", Language: "ja", TranslatedKeyword: "題名"}
+	if len(m.Text) != 1 || m.Text[0] != expectedText {
+		t.Errorf("Text = %+v; want [%+v]", m.Text, expectedText)
+	}
+
+	if len(m.Unknown) != 1 || m.Unknown[0] != (ChunkInfo{Type: "prVt", Size: 42}) {
+		t.Errorf("Unknown = %+v; want [{prVt 42}]", m.Unknown)
+	}
+
+	if string(m.SignificantBits) != string([]byte{8, 8, 8, 4}) {
+		t.Errorf("SignificantBits = %v; want [8 8 8 4]", m.SignificantBits)
+	}
+
+	t.Run("パレットのtRNSとhIST", func(t *testing.T) {
+		palette, err := os.ReadFile("testdata/variations/colortype_palette.png")
+		if err != nil {
+			t.Fatalf("os.ReadFile() = %v; want nil", err)
+		}
+		data := insertChunkBeforeIEND(t, palette, &pngstructure.Chunk{Type: "tRNS", Data: []byte{0, 128, 255}})
+		data = insertChunkBeforeIEND(t, data, &pngstructure.Chunk{Type: "hIST", Data: []byte{0, 1, 1, 0}})
+
+		m, err := ReadMetadata(data)
+		if err != nil {
+			t.Fatalf("ReadMetadata() = %v; want nil", err)
+		}
+		if m.Transparency == nil || string(m.Transparency.PaletteAlpha) != string([]byte{0, 128, 255}) {
+			t.Errorf("Transparency = %+v; want PaletteAlpha=[0 128 255]", m.Transparency)
+		}
+		if len(m.Histogram) != 2 || m.Histogram[0] != 1 || m.Histogram[1] != 256 {
+			t.Errorf("Histogram = %v; want [1 256]", m.Histogram)
+		}
+		if len(m.Unknown) != 0 {
+			t.Errorf("Unknown = %+v; want empty", m.Unknown)
+		}
+	})
+
+	t.Run("不正なチャンク", func(t *testing.T) {
+		for _, chunk := range []*pngstructure.Chunk{
+			{Type: "gAMA", Data: []byte{1, 2}},
+			{Type: "tRNS", Data: []byte{1, 2}}, // RGBAの画像にはtRNSを含められない
+			{Type: "sBIT", Data: []byte{8, 8, 8}},
+		} {
+			malformed := insertChunkBeforeIEND(t, original, chunk)
+			if _, err := ReadMetadata(malformed); AsDataError(err) == nil {
+				t.Errorf("ReadMetadata(%s) = %v; want DataError", chunk.Type, err)
+			}
+		}
+	})
+}
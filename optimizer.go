@@ -1,9 +1,12 @@
 package png
 
 import (
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"math"
 	"os"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/ideamans/go-l10n"
@@ -11,20 +14,125 @@ import (
 	"github.com/ideamans/go-psnr"
 )
 
-// Optimizer is the main interface for PNG optimization
+// Optimizer is the main interface for PNG optimization.
+//
+// An Optimizer is safe for concurrent use by multiple goroutines, so one
+// instance can be shared by HTTP handlers. Its fields must not be changed
+// while Run is in progress, and the Logger must also be safe for concurrent
+// use. Concurrent quantizations are bounded process-wide by
+// SetMaxConcurrentQuantizations.
 type Optimizer struct {
 	Quality string
 	Logger  Logger
+	// PSNRThreshold is the minimum final PSNR in dB. Results below it fail the
+	// inspection. NewOptimizer sets it from the package-level PSNRThreshold,
+	// and 0 means DefaultPSNRThreshold.
+	PSNRThreshold float64
+	// Repair enables repairing damaged PNG structure (bad CRCs, trailing data,
+	// missing IEND, truncated IDAT) before optimization
+	Repair bool
+	// ReoptimizePolicy decides how to handle files that already have a LightFile
+	// comment. SkipOptimized is used when nil.
+	ReoptimizePolicy ReoptimizePolicy
+	// SigningKey enables signed comments. When set, new comments are signed and
+	// existing comments are trusted only if their signature verifies with this key.
+	SigningKey []byte
+	// MarkerStorage selects where the LightFile comment is stored and looked up.
+	// The default MarkerEmbedded stores it as a text chunk inside the PNG.
+	MarkerStorage MarkerStorage
+	// MaxHistory is the maximum number of previous optimizations kept in the
+	// comment history when re-optimizing. 0 means DefaultMaxHistory and a
+	// negative value disables the history.
+	MaxHistory int
+	// MarkerPlacement selects where an embedded comment is inserted.
+	// CommentBeforeIDAT lets DetectMarker stop reading early.
+	MarkerPlacement CommentPlacement
+	// CheckLossless decodes the data before and after the metadata strip and
+	// the comment insertion, and skips a stage whose pixels differ, recording
+	// CodePixelsChanged in StripError or CommentError. It costs up to four
+	// extra decodes of the image per run.
+	CheckLossless bool
+	// Analyze fills OptimizePNGOutput.Analysis with a size breakdown of the
+	// source image and the savings of each stage measured during this run.
+	Analyze bool
+	// DryRun runs the whole pipeline without writing destPath or the marker.
+	// AfterSize reports the size the output would have.
+	DryRun bool
+	// Estimate predicts the result of PNGQuant from a downsampled sample of at
+	// most EstimateSamplePixels pixels instead of the whole image. The sample is
+	// built while inflating the image data, so the image is never decoded as a
+	// whole. Nothing is written and OptimizePNGOutput.Estimated is set.
+	// Analyze is still honored, but it decodes the whole image.
+	Estimate bool
+	// EstimateSamplePixels is the pixel budget of the sample in estimate mode.
+	// 0 means DefaultEstimateSamplePixels.
+	EstimateSamplePixels int
+	// OutputMode is the permission of the output file. 0 means DefaultOutputMode.
+	OutputMode os.FileMode
+	// PreserveMode, PreserveOwner and PreserveTimes copy the permission, the
+	// owner and group, and the modification time of the source to the output.
+	// PreserveMode takes precedence over OutputMode. PreserveOwner is ignored
+	// on platforms without file ownership, and when the owner cannot be
+	// changed for lack of permission. When the output replaces the source
+	// (see RunInPlace), its mode and owner are kept unless OutputMode is set.
+	PreserveMode  bool
+	PreserveOwner bool
+	PreserveTimes bool
+	// Backup keeps the original file before it is replaced when the output is
+	// written over the source (see RunInPlace). Backup.Restore rolls it back.
+	Backup *Backup
+	// Verify re-reads the written file and checks its structure and CRCs, that
+	// it decodes, that the embedded comment reads back and that its PSNR against
+	// the original matches FinalPSNR. On mismatch the previous destination is
+	// restored and an error wrapping ErrVerificationFailed is returned.
+	Verify bool
+	// Limits rejects images that declare more pixels, image data, text or
+	// chunks than allowed before anything is decoded. Zero fields mean the
+	// values of DefaultLimits and negative fields disable the limit. The
+	// Repair stage applies the same limits before salvaging image data.
+	Limits Limits
+	// QuantizeCommand runs PNGQuant in a new child process for each image,
+	// so that a crash inside libimagequant only kills the child. It is the
+	// command and its arguments, and the command must call ServeQuantize with
+	// its standard input and output.
+	QuantizeCommand []string
+
+	// Workers runs PNGQuant in the persistent child processes of the pool
+	// instead of starting one per image. It takes precedence over
+	// QuantizeCommand. The pool is not closed by the optimizer.
+	Workers *WorkerPool
+
+	// Scheduler admits the run only when its estimated peak memory fits in
+	// the scheduler's budget, so that a shared scheduler bounds the memory of
+	// concurrent runs. The estimate is made from IHDR after Limits are checked.
+	Scheduler *Scheduler
 }
 
 // NewOptimizer creates a new PNG optimizer with the specified quality setting
 func NewOptimizer(quality string) *Optimizer {
 	opt := &Optimizer{
-		Quality: quality,
+		Quality:       quality,
+		PSNRThreshold: PSNRThreshold,
 	}
 	return opt
 }
 
+// RunInPlace optimizes the file at path and replaces it with the result.
+// The file is replaced atomically, and kept in o.Backup first if configured.
+// Its mode and owner are kept unless OutputMode is set. Set PreserveTimes to
+// keep its modification time as well.
+func (o *Optimizer) RunInPlace(path string) (*OptimizePNGOutput, error) {
+	return o.Run(path, path)
+}
+
+// psnrThreshold returns o.PSNRThreshold, or DefaultPSNRThreshold when it is 0
+func (o *Optimizer) psnrThreshold() float64 {
+	if o.PSNRThreshold != 0 {
+		return o.PSNRThreshold
+	}
+	return DefaultPSNRThreshold
+}
+
 // SetLogger sets the logger for this optimizer
 func (o *Optimizer) SetLogger(logger Logger) {
 	o.Logger = logger
@@ -51,33 +159,118 @@ func (o *Optimizer) logWarn(format string, args ...interface{}) {
 	}
 }
 
-// Run performs PNG optimization from srcPath to destPath
-func (o *Optimizer) Run(srcPath, destPath string) (*OptimizePNGOutput, error) {
+// Run performs PNG optimization from srcPath to destPath.
+// A panic in any stage, for example in a decoder fed with a malformed image,
+// is recovered and returned as a DataError with CodePanic and the stack trace.
+func (o *Optimizer) Run(srcPath, destPath string) (output *OptimizePNGOutput, err error) {
+	stage := StageRead
+	defer func() {
+		if r := recover(); r != nil {
+			output, err = nil, newPanicError(stage, r)
+			o.logWarn("Recovered from panic: %v", err)
+		}
+	}()
+	return o.run(srcPath, destPath, &stage)
+}
+
+// run is the body of Run. It keeps stage up to date so that a recovered
+// panic can be attributed to the stage it occurred in.
+func (o *Optimizer) run(srcPath, destPath string, stage *Stage) (*OptimizePNGOutput, error) {
 	o.logInfo("Starting PNG optimization (quality: %s)", o.Quality)
 	output := OptimizePNGOutput{}
 
 	// Read PNG file
 	pngData, err := os.ReadFile(srcPath)
 	if err != nil {
-		return nil, fmt.Errorf(l10n.T("failed to read PNG file: %w"), err)
+		return nil, withStage(NewSystemErrorf(CodeIO, l10n.T("failed to read PNG file: %w"), err), StageRead)
 	}
 	output.BeforeSize = int64(len(pngData))
+	sourceData := pngData
+
+	// Reject decompression bombs from the header before any decoding
+	*stage = StageLimits
+	if err := o.Limits.Check(pngData); err != nil {
+		return nil, withStage(err, StageLimits)
+	}
+
+	// Wait until the estimated peak memory fits in the scheduler's budget
+	output.PeakMemoryEstimate = EstimatePeakMemory(pngData)
+	o.logDebug("Estimated peak memory: %s", humanize.Bytes(uint64(output.PeakMemoryEstimate)))
+	if o.Scheduler != nil {
+		o.Scheduler.Acquire(output.PeakMemoryEstimate)
+		defer o.Scheduler.Release(output.PeakMemoryEstimate)
+	}
+
+	// Stat the source before anything is written, since destPath may be srcPath
+	*stage = StageRead
+	inPlace := isSameFile(srcPath, destPath)
+	var srcInfo os.FileInfo
+	if o.PreserveMode || o.PreserveOwner || o.PreserveTimes || o.Backup != nil || inPlace {
+		srcInfo, err = os.Stat(srcPath)
+		if err != nil {
+			return nil, withStage(NewSystemErrorf(CodeIO, l10n.T("failed to stat source file: %w"), err), StageRead)
+		}
+	}
+	sourceHash := sha256.Sum256(pngData)
+
+	// Stages applied to the image, recorded in the comment
+	var stages []string
+
+	// Repair damaged PNG structure if enabled
+	*stage = StageRepair
+	if o.Repair {
+		repairedData, repairs, err := RepairPNGWithLimits(pngData, o.Limits)
+		if err != nil {
+			return nil, withStage(err, StageRepair)
+		}
+		if len(repairs) > 0 {
+			for _, repair := range repairs {
+				o.logDebug("Repaired %s at offset %d: %s %s", repair.Kind, repair.Offset, repair.Chunk, repair.Detail)
+			}
+			o.logInfo("Repaired %d problem(s) in PNG structure", len(repairs))
+			output.Repairs = repairs
+			pngData = repairedData
+			stages = append(stages, string(StageRepair))
+		}
+	}
 
 	// Create metadata manager
-	metaManager := &PNGMetaManager{}
+	metaManager := &PNGMetaManager{Placement: o.MarkerPlacement}
 
-	// Check if already optimized using ReadComment
-	comment, _, err := metaManager.ReadComment(pngData)
+	// Check if already optimized using the configured marker storage
+	*stage = StageMarker
+	comment, rawComment, err := ReadMarker(o.MarkerStorage, srcPath, pngData)
 	if err != nil {
-		return nil, fmt.Errorf(l10n.T("failed to read PNG comment: %w"), err)
+		return nil, withStage(wrapError(err, CodeMalformedChunk, l10n.T("failed to read PNG comment: %w")), StageMarker)
 	}
 
-	// If already optimized, return early
+	// With a signing key, ignore comments that do not verify
+	if comment != nil && comment.By != "" && len(o.SigningKey) > 0 {
+		if err := verifyCommentSignature(pngData, comment, rawComment, o.SigningKey); err != nil {
+			o.logWarn("Ignoring untrusted LightFile comment: %v", err)
+			output.UntrustedComment = true
+			comment = nil
+		}
+	}
+
+	// If already optimized, let the policy decide whether to skip or re-optimize
+	var previousComment *LightFileComment
 	if comment != nil && comment.By != "" {
-		output.AlreadyOptimized = true
-		output.AlreadyOptimizedBy = comment.By
-		o.logInfo("Already optimized by %s, skipping", comment.By)
-		return &output, nil
+		policy := o.ReoptimizePolicy
+		if policy == nil {
+			policy = SkipOptimized
+		}
+		output.Reoptimize = policy(comment)
+
+		if output.Reoptimize != ReoptimizeRerun && output.Reoptimize != ReoptimizeForce {
+			output.Reoptimize = ReoptimizeSkip
+			output.AlreadyOptimized = true
+			output.AlreadyOptimizedBy = comment.By
+			o.logInfo("Already optimized by %s, skipping", comment.By)
+			return &output, nil
+		}
+		o.logInfo("Already optimized by %s, re-optimizing (%s)", comment.By, output.Reoptimize)
+		previousComment = comment
 	}
 
 	// Keep original data for PSNR comparison
@@ -85,30 +278,49 @@ func (o *Optimizer) Run(srcPath, destPath string) (*OptimizePNGOutput, error) {
 	copy(originalData, pngData)
 
 	// Strip metadata using pngmetawebstrip
+	*stage = StageStrip
 	o.logDebug("Stripping metadata")
 	strippedData, stripResult, err := pngmetawebstrip.Strip(pngData)
 	if err != nil {
 		// stripは外部パッケージで行うのでデータエラーの区別がない
 		// しかし本質的にオンメモリのデータ処理だけなのでデータエラーとして扱う
-		output.StripError = NewDataErrorf(l10n.T("failed to strip metadata: %v"), err)
+		output.StripError = withStage(NewDataErrorCodef(CodeStripFailed, l10n.T("failed to strip metadata: %v"), err), StageStrip)
 		o.logWarn("Failed to strip metadata: %v", err)
+	} else if err := o.checkLossless(pngData, strippedData); err != nil {
+		// Stripping must not change pixels; keep the unstripped data if it did
+		output.StripError = losslessStageError(err, StageStrip, "metadata strip changed pixels: %v")
+		o.logWarn("Lossless check failed, keeping previous data: %v", output.StripError)
 	} else {
 		output.Strip = stripResult
 		pngData = strippedData
+		if stripResult.Total > 0 {
+			stages = append(stages, string(StageStrip))
+		}
 		o.logDebug("Stripped metadata - size: %s -> %s", humanize.Bytes(uint64(output.BeforeSize)), humanize.Bytes(uint64(len(pngData))))
 	}
 	output.SizeAfterStrip = int64(len(pngData))
 
+	// In estimate mode, predict the remaining stages from a downsampled sample
+	*stage = StagePNGQuant
+	if o.Estimate {
+		estimated, err := o.runEstimate(&output, originalData, pngData, stages, sourceHash, previousComment)
+		if err != nil {
+			return nil, withStage(err, StagePNGQuant)
+		}
+		return estimated, nil
+	}
+
 	// PngquantはPSNRにより棄却する可能性がある
 	beforePNGQuant := make([]byte, len(pngData))
 	copy(beforePNGQuant, pngData)
 
 	// Perform PNG quantization using Pngquant
-	quantizedData, wasQuantized, err := PNGQuant(pngData)
+	quantizedData, wasQuantized, err := o.quantize(pngData)
 	if err != nil {
-		// Set quantize error and continue with stripped data
-		output.PNGQuantError = err
-		o.logWarn("Failed to quantize: %v", err)
+		// Continue with stripped data unless the failure must abort the run
+		if err := o.handleQuantizeError(&output, err); err != nil {
+			return nil, err
+		}
 	} else {
 		// If the image was already indexed color (wasQuantized == false)
 		if !wasQuantized {
@@ -119,7 +331,7 @@ func (o *Optimizer) Run(srcPath, destPath string) (*OptimizePNGOutput, error) {
 			// Calculate PSNR between before and after quantization
 			psnrValue, psnrErr := psnr.Compute(beforePNGQuant, quantizedData)
 			if psnrErr != nil {
-				output.PNGQuantError = NewDataErrorf(l10n.T("failed to calculate PSNR after PNGQuant: %w"), psnrErr)
+				output.PNGQuantError = withStage(NewDataErrorCodef(CodeMetricFailed, l10n.T("failed to calculate PSNR after PNGQuant: %w"), psnrErr), StagePNGQuant)
 				o.logWarn("Failed to calculate PSNR after PNGQuant: %v", psnrErr)
 			} else {
 				output.PNGQuant.PSNR = psnrValue
@@ -127,6 +339,7 @@ func (o *Optimizer) Run(srcPath, destPath string) (*OptimizePNGOutput, error) {
 				if isAcceptablePSNR(o.Quality, psnrValue) {
 					output.PNGQuant.Applied = true
 					pngData = quantizedData
+					stages = append(stages, string(StagePNGQuant))
 					o.logDebug("PNGQuant applied - PSNR: %.2f dB, size: %s", psnrValue, humanize.Bytes(uint64(len(pngData))))
 				} else {
 					o.logDebug("PNGQuant rejected - PSNR: %.2f dB below threshold", psnrValue)
@@ -136,64 +349,149 @@ func (o *Optimizer) Run(srcPath, destPath string) (*OptimizePNGOutput, error) {
 	}
 	output.SizeAfterPNGQuant = int64(len(pngData))
 
+	// Analyze the source image, reusing the stage results of this run as estimates
+	*stage = StageAnalyze
+	if o.Analyze {
+		quantizedSize := int64(-1)
+		if wasQuantized && output.PNGQuantError == nil {
+			quantizedSize = int64(len(quantizedData))
+		}
+		if err := o.analyze(&output, originalData, quantizedSize); err != nil {
+			return nil, withStage(err, StageAnalyze)
+		}
+	}
+
 	// Calculate final PSNR between original and final
+	*stage = StageInspect
 	finalPSNR, err := psnr.Compute(originalData, pngData)
 	if err != nil {
-		return nil, NewDataErrorf(l10n.T("failed to calculate final PSNR: %w"), err)
+		return nil, withStage(NewDataErrorCodef(CodeMetricFailed, l10n.T("failed to calculate final PSNR: %w"), err), StageInspect)
 	}
 
 	// Build comment with optimization information
-	comment = &LightFileComment{
-		By:       "LightFile",
-		Before:   output.BeforeSize,
-		After:    int64(len(pngData)),
-		PNGQuant: output.PNGQuant.Applied,
-		PSNR:     MaybeInf(finalPSNR),
+	*stage = StageComment
+	comment = o.newComment(&output, int64(len(pngData)), finalPSNR, stages, sourceHash, previousComment)
+
+	// Markers stored outside the PNG record the output they belong to, so that
+	// a file replaced later is not mistaken for an optimized one
+	if o.MarkerStorage != MarkerEmbedded {
+		comment.OutputHash = contentHash(pngData)
 	}
 
-	// Calculate comment size and check if final size would exceed original
-	_, commentSizeIncrease, err := metaManager.BuildComment(comment)
-	if err != nil {
-		return nil, fmt.Errorf(l10n.T("failed to build comment: %w"), err)
+	// Sign the comment over the final pixels if a key is configured
+	if len(o.SigningKey) > 0 {
+		if err := SignComment(pngData, comment, o.SigningKey); err != nil {
+			return nil, withStage(err, StageComment)
+		}
+	}
+
+	// Calculate comment size and check if final size would exceed original.
+	// Markers stored outside the PNG do not add any bytes.
+	commentSizeIncrease := 0
+	if o.MarkerStorage == MarkerEmbedded {
+		_, commentSizeIncrease, err = metaManager.BuildComment(comment)
+		if err != nil {
+			return nil, withStage(wrapError(err, CodeCommentFailed, l10n.T("failed to build comment: %w")), StageComment)
+		}
 	}
 
 	// Check if adding comment would make file larger than original
 	currentSize := int64(len(pngData))
 	finalSizeWithComment := currentSize + int64(commentSizeIncrease)
-	if finalSizeWithComment >= output.BeforeSize {
+	if finalSizeWithComment >= output.BeforeSize && output.Reoptimize != ReoptimizeForce {
 		output.CantOptimize = true
 		o.logInfo("Cannot optimize: final size (%s) >= original size (%s)",
 			humanize.Bytes(uint64(finalSizeWithComment)), humanize.Bytes(uint64(output.BeforeSize)))
 		return &output, nil
 	}
 
-	// Write the comment
-	commentedData, err := metaManager.WriteComment(pngData, comment)
-	if err != nil {
-		return nil, fmt.Errorf(l10n.T("failed to write comment: %w"), err)
+	// Write the comment, keeping the data without it if the pixels changed
+	commentEmbedded := false
+	if o.MarkerStorage == MarkerEmbedded {
+		commentedData, err := metaManager.WriteComment(pngData, comment)
+		if err != nil {
+			return nil, withStage(wrapError(err, CodeCommentFailed, l10n.T("failed to write comment: %w")), StageComment)
+		}
+		if err := o.checkLossless(pngData, commentedData); err != nil {
+			output.CommentError = losslessStageError(err, StageComment, "comment insertion changed pixels: %v")
+			o.logWarn("Lossless check failed, keeping previous data: %v", output.CommentError)
+		} else {
+			pngData = commentedData
+			commentEmbedded = true
+		}
 	}
-	pngData = commentedData
 
 	// Calculate PSNR for quality inspection
 	output.FinalPSNR = finalPSNR
 
 	// Check PSNR threshold (infinity is always acceptable)
-	if !math.IsInf(finalPSNR, 1) && finalPSNR < PSNRThreshold {
+	if !math.IsInf(finalPSNR, 1) && finalPSNR < o.psnrThreshold() {
 		output.InspectionFailed = true
-		o.logWarn("PSNR inspection failed: %.2f dB < %.2f dB", finalPSNR, PSNRThreshold)
+		o.logWarn("PSNR inspection failed: %.2f dB < %.2f dB", finalPSNR, o.psnrThreshold())
+		return &output, nil
+	}
+
+	// In dry-run mode, report the size the output would have without writing it
+	if o.DryRun {
+		output.AfterSize = int64(len(pngData))
+		o.logInfo("Dry run: output would be %s", humanize.Bytes(uint64(output.AfterSize)))
 		return &output, nil
 	}
 
-	// Write the optimized PNG to destination path
-	err = os.WriteFile(destPath, pngData, 0600)
+	// Keep the original before it is replaced in place
+	*stage = StageWrite
+	if o.Backup != nil && inPlace {
+		saved, err := o.Backup.save(srcPath, sourceData, srcInfo)
+		if err != nil {
+			return nil, withStage(err, StageWrite)
+		}
+		if !saved {
+			o.logDebug("Keeping the existing backup of %s", srcPath)
+		}
+	}
+
+	// Keep the current destination so that a failed verification can put it back
+	var previous *previousFile
+	if o.Verify {
+		previous, err = readPreviousFile(destPath)
+		if err != nil {
+			return nil, withStage(NewSystemErrorf(CodeIO, l10n.T("failed to read destination file: %w"), err), StageVerify)
+		}
+	}
+
+	// Write the optimized PNG to destination path atomically
+	attrs := o.outputAttributes(srcInfo, inPlace)
+	err = writeFileAtomic(destPath, pngData, attrs)
 	if err != nil {
-		return nil, fmt.Errorf(l10n.T("failed to write optimized PNG: %w"), err)
+		return nil, withStage(NewSystemErrorf(CodeIO, l10n.T("failed to write optimized PNG: %w"), err), StageWrite)
+	}
+
+	// Verify the written file, restoring the previous destination on mismatch
+	*stage = StageVerify
+	if o.Verify {
+		var embeddedComment *LightFileComment
+		if commentEmbedded {
+			embeddedComment = comment
+		}
+		if err := o.verifyWritten(destPath, previous, originalData, embeddedComment, finalPSNR); err != nil {
+			return nil, withStage(err, StageVerify)
+		}
+	}
+
+	// Store the marker outside the PNG if configured, with the same permission
+	// and owner as the output
+	*stage = StageMarker
+	if o.MarkerStorage != MarkerEmbedded {
+		if err := writeMarker(o.MarkerStorage, destPath, comment, outputAttributes{mode: attrs.mode, owner: attrs.owner}); err != nil {
+			return nil, withStage(err, StageMarker)
+		}
 	}
 
 	// Get file size after optimization
+	*stage = StageWrite
 	destInfo, err := os.Stat(destPath)
 	if err != nil {
-		return nil, fmt.Errorf(l10n.T("failed to stat destination file: %w"), err)
+		return nil, withStage(NewSystemErrorf(CodeIO, l10n.T("failed to stat destination file: %w"), err), StageWrite)
 	}
 	output.AfterSize = destInfo.Size()
 
@@ -204,3 +502,119 @@ func (o *Optimizer) Run(srcPath, destPath string) (*OptimizePNGOutput, error) {
 
 	return &output, nil
 }
+
+// quantize runs PNGQuant in this process, in a worker of o.Workers, or in a
+// child process when QuantizeCommand is set
+func (o *Optimizer) quantize(data []byte) ([]byte, bool, error) {
+	if o.Workers != nil {
+		return o.Workers.Quantize(data)
+	}
+	if len(o.QuantizeCommand) > 0 {
+		return quantizeSubprocess(o.QuantizeCommand, data)
+	}
+	return PNGQuant(data)
+}
+
+// handleQuantizeError classifies a PNGQuant failure. QualityTooLow means the
+// result is not good enough and leaves the image as is without an error.
+// OutOfMemory and system errors of a child process (CodeWorkerCrashed,
+// CodeWorkerTimeout) are returned to abort the run, and other failures are
+// recorded in output.PNGQuantError.
+func (o *Optimizer) handleQuantizeError(output *OptimizePNGOutput, err error) error {
+	var quantizeErr *QuantizeError
+	switch {
+	case errors.Is(err, ErrQualityTooLow):
+		o.logDebug("PNGQuant not applied: %v", err)
+		return nil
+	case errors.Is(err, ErrOutOfMemory):
+		return withStage(NewSystemErrorf(CodeOutOfMemory, "%w", err), StagePNGQuant)
+	case AsSystemError(err) != nil:
+		// The child process crashed, timed out or could not be started
+		return withStage(err, StagePNGQuant)
+	case errors.As(err, &quantizeErr):
+		output.PNGQuantError = withStage(NewDataErrorCodef(CodeQuantizeFailed, "%w", err), StagePNGQuant)
+	default:
+		output.PNGQuantError = withStage(err, StagePNGQuant)
+	}
+	o.logWarn("Failed to quantize: %v", err)
+	return nil
+}
+
+// newComment builds the LightFile comment recorded for an optimization result
+func (o *Optimizer) newComment(output *OptimizePNGOutput, after int64, finalPSNR float64, stages []string, sourceHash [sha256.Size]byte, previous *LightFileComment) *LightFileComment {
+	return &LightFileComment{
+		Schema:     CommentSchemaVersion,
+		By:         "LightFile",
+		Version:    Version,
+		Profile:    qualityProfile(o.Quality),
+		Before:     output.BeforeSize,
+		After:      after,
+		PNGQuant:   output.PNGQuant.Applied,
+		Metric:     "psnr",
+		PSNR:       MaybeInf(finalPSNR),
+		Stages:     stages,
+		Timestamp:  time.Now().Unix(),
+		SourceHash: "sha256:" + hex.EncodeToString(sourceHash[:]),
+		History:    appendHistory(previous, o.MaxHistory),
+	}
+}
+
+// checkLossless confirms that a lossless stage kept the pixels when
+// CheckLossless is enabled
+func (o *Optimizer) checkLossless(before, after []byte) error {
+	if !o.CheckLossless {
+		return nil
+	}
+	return checkLossless(before, after)
+}
+
+// analyze fills output.Analysis with a size breakdown of originalData and the
+// savings of the stages of this run. quantizedSize is the size after PNGQuant,
+// or negative if PNGQuant was not measured.
+func (o *Optimizer) analyze(output *OptimizePNGOutput, originalData []byte, quantizedSize int64) error {
+	analysis, err := analyzeImage(originalData)
+	if err != nil {
+		return err
+	}
+	if output.Strip != nil {
+		analysis.Estimates = append(analysis.Estimates, StageEstimate{
+			Stage:   StageStrip,
+			Size:    output.SizeAfterStrip,
+			Savings: int64(len(originalData)) - output.SizeAfterStrip,
+		})
+	}
+	if quantizedSize >= 0 {
+		analysis.Estimates = append(analysis.Estimates, StageEstimate{
+			Stage:   StagePNGQuant,
+			Size:    quantizedSize,
+			Savings: output.SizeAfterStrip - quantizedSize,
+			PSNR:    output.PNGQuant.PSNR,
+		})
+	}
+	output.Analysis = analysis
+	return nil
+}
+
+// outputAttributes returns the attributes of the output file, copied from
+// srcInfo as configured by the Preserve options. When inPlace, the mode and
+// owner of the replaced file are kept unless OutputMode is set.
+func (o *Optimizer) outputAttributes(srcInfo os.FileInfo, inPlace bool) outputAttributes {
+	attrs := outputAttributes{mode: o.OutputMode}
+	if attrs.mode == 0 {
+		attrs.mode = DefaultOutputMode
+	}
+	if srcInfo == nil {
+		return attrs
+	}
+
+	if o.PreserveMode || (inPlace && o.OutputMode == 0) {
+		attrs.mode = srcInfo.Mode().Perm()
+	}
+	if o.PreserveOwner || inPlace {
+		attrs.owner = srcInfo
+	}
+	if o.PreserveTimes {
+		attrs.mtime = srcInfo.ModTime()
+	}
+	return attrs
+}
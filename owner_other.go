@@ -0,0 +1,10 @@
+//go:build !unix
+
+package png
+
+import "os"
+
+// copyOwner は所有者の概念がないプラットフォームでは何もしません。
+func copyOwner(file *os.File, source os.FileInfo) error {
+	return nil
+}
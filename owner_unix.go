@@ -0,0 +1,23 @@
+//go:build unix
+
+package png
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// copyOwner はファイルの所有者とグループをsourceと同じにします。
+// 権限がなく所有者を変更できない場合（EPERM）は、書き込みを失敗させずに無視します。
+func copyOwner(file *os.File, source os.FileInfo) error {
+	stat, ok := source.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := file.Chown(int(stat.Uid), int(stat.Gid))
+	if errors.Is(err, syscall.EPERM) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,24 @@
+package png
+
+import (
+	"runtime/debug"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for panic.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"panic in %s stage: %v": "%sステージでパニックが発生しました: %v",
+	})
+}
+
+// newPanicError は、回復したパニックの値からCodePanicのDataErrorを作成します。
+// 呼び出し時点のスタックトレースを保持するため、recoverした遅延関数の中で呼び出してください。
+// パニックの値がエラーの場合は原因として保持します。
+func newPanicError(stage Stage, r interface{}) *DataError {
+	err := NewDataErrorCodef(CodePanic, l10n.T("panic in %s stage: %v"), stage, r)
+	err.stage = stage
+	err.stack = debug.Stack()
+	return err
+}
@@ -20,12 +20,18 @@ func init() {
 		"failed to calculate final PSNR after comment: %w": "コメント追加後の最終PSNR計算に失敗しました: %w",
 		"failed to write optimized PNG: %w":                "最適化されたPNGの書き込みに失敗しました: %w",
 		"failed to stat destination file: %w":              "出力ファイルの情報取得に失敗しました: %w",
+		"failed to stat source file: %w":                   "入力ファイルの情報取得に失敗しました: %w",
+		"failed to read destination file: %w":              "出力先のファイルの読み込みに失敗しました: %w",
 		// Log messages
 		"Starting PNG optimization (quality: %s)":                                          "PNG最適化を開始 (品質: %s)",
 		"Already optimized by %s, skipping":                                                "%sによって既に最適化されています、スキップします",
+		"Already optimized by %s, re-optimizing (%s)":                                      "%sによって既に最適化されています、再最適化します (%s)",
+		"Ignoring untrusted LightFile comment: %v":                                         "信頼できないLightFileコメントを無視します: %v",
 		"Failed to strip metadata: %v":                                                     "メタデータの削除に失敗: %v",
 		"Stripped metadata - size: %s -> %s":                                               "メタデータを削除 - サイズ: %s -> %s",
 		"Failed to quantize: %v":                                                           "量子化に失敗: %v",
+		"Recovered from panic: %v":                                                         "パニックから回復しました: %v",
+		"PNGQuant not applied: %v":                                                         "PNGQuantを適用しません: %v",
 		"Applied PNGQuant - PSNR: %.2f dB, size: %s":                                       "PNGQuant適用 - PSNR: %.2f dB, サイズ: %s",
 		"Rejected PNGQuant - PSNR: %.2f (below threshold for quality: %s)":                 "PNGQuant却下 - PSNR: %.2f (品質 %s の閾値未満)",
 		"Cannot optimize: final size (%s) >= original size (%s)":                           "最適化不可: 最終サイズ (%s) >= 元のサイズ (%s)",
@@ -39,17 +45,56 @@ func init() {
 		"Failed to calculate final PSNR: %v":                                               "最終PSNRの計算に失敗: %v",
 		"Failed to write optimized PNG: %v":                                                "最適化されたPNGの書き込みに失敗: %v",
 		"Failed to stat destination file: %v":                                              "出力ファイルの情報取得に失敗: %v",
+		"Repaired %d problem(s) in PNG structure":                                          "PNG構造の問題を%d件修復しました",
+		"Repaired %s at offset %d: %s %s":                                                  "修復 %s (オフセット %d): %s %s",
+		"Keeping the existing backup of %s":                                                "%s の既存のバックアップを維持します",
+		"Dry run: output would be %s":                                                      "ドライラン: 出力サイズは %s になります",
+		"Estimated from %dx%d sample: PSNR %.2f dB, size ratio %.3f":                       "%dx%dのサンプルから見積もり: PSNR %.2f dB, サイズ比 %.3f",
+		"Verification failed, restoring previous file: %v":                                 "検証に失敗したため元のファイルに戻します: %v",
+		"Lossless check failed, keeping previous data: %v":                                 "可逆性の確認に失敗したため、前のデータを使います: %v",
+		"Estimated result: %s -> %s, PSNR: %.2f dB":                                        "見積もり結果: %s -> %s, PSNR: %.2f dB",
+		"Estimated peak memory: %s":                                                        "推定ピークメモリ: %s",
 	})
 }
 
+// DefaultPSNRThreshold is the minimum final PSNR accepted by the inspection
+// of optimizers whose PSNRThreshold field is 0.
+const DefaultPSNRThreshold = 35.0
+
 var (
-	PSNRThreshold = 35.0
+	// PSNRThreshold is copied to Optimizer.PSNRThreshold by NewOptimizer.
+	// Running optimizers never read it.
+	//
+	// Deprecated: Set Optimizer.PSNRThreshold instead.
+	PSNRThreshold = DefaultPSNRThreshold
+)
+
+// Stage identifies a step of the optimization pipeline. The stages that
+// change the image (StageRepair, StageStrip and StagePNGQuant) are recorded
+// in LightFileComment.Stages, and errors report the stage they occurred in.
+type Stage string
+
+const (
+	StageRead     Stage = "read"
+	StageLimits   Stage = "limits"
+	StageRepair   Stage = "repair"
+	StageMarker   Stage = "marker"
+	StageStrip    Stage = "strip"
+	StagePNGQuant Stage = "pngquant"
+	StageAnalyze  Stage = "analyze"
+	StageInspect  Stage = "inspect"
+	StageComment  Stage = "comment"
+	StageWrite    Stage = "write"
+	StageVerify   Stage = "verify"
 )
 
 type OptimizePNGOutput struct {
 	BeforeSize         int64
+	Repairs            []Repair
 	AlreadyOptimized   bool
 	AlreadyOptimizedBy string
+	Reoptimize         ReoptimizeDecision
+	UntrustedComment   bool
 	Strip              *pngmetawebstrip.Result
 	StripError         error
 	SizeAfterStrip     int64
@@ -60,10 +105,17 @@ type OptimizePNGOutput struct {
 	}
 	SizeAfterPNGQuant int64
 	PNGQuantError     error
+	CommentError      error
 	CantOptimize      bool
 	InspectionFailed  bool
 	FinalPSNR         float64
 	AfterSize         int64
+	Estimated         bool
+	Analysis          *Analysis
+
+	// PeakMemoryEstimate is the peak memory of the run in bytes estimated
+	// from IHDR before decoding (see EstimatePeakMemory)
+	PeakMemoryEstimate int64
 }
 
 func isAcceptablePSNR(quality string, psnr float64) bool {
@@ -81,3 +133,26 @@ func isAcceptablePSNR(quality string, psnr float64) bool {
 		return psnr >= 42
 	}
 }
+
+// qualityProfile normalizes a quality setting to the profile name recorded in comments.
+// Unknown or empty settings fall back to "medium" as in isAcceptablePSNR.
+func qualityProfile(quality string) string {
+	switch quality {
+	case "high", "low", "force":
+		return quality
+	}
+	return "medium"
+}
+
+// qualityRank orders quality profiles from the least to the most strict.
+func qualityRank(profile string) int {
+	switch qualityProfile(profile) {
+	case "force":
+		return 0
+	case "low":
+		return 1
+	case "high":
+		return 3
+	}
+	return 2
+}
@@ -4,6 +4,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -274,6 +275,21 @@ func TestOptimize(t *testing.T) {
 				if comment.PNGQuant != result.PNGQuant.Applied {
 					t.Errorf("Comment.PNGQuant = %v, want %v", comment.PNGQuant, result.PNGQuant.Applied)
 				}
+				if comment.SchemaVersion() != CommentSchemaVersion {
+					t.Errorf("Comment.SchemaVersion() = %v, want %v", comment.SchemaVersion(), CommentSchemaVersion)
+				}
+				if comment.Version != Version {
+					t.Errorf("Comment.Version = %v, want %v", comment.Version, Version)
+				}
+				if comment.Profile != qualityProfile(tc.quality) {
+					t.Errorf("Comment.Profile = %v, want %v", comment.Profile, qualityProfile(tc.quality))
+				}
+				if comment.Timestamp <= 0 {
+					t.Errorf("Comment.Timestamp = %v, want > 0", comment.Timestamp)
+				}
+				if !strings.HasPrefix(comment.SourceHash, "sha256:") {
+					t.Errorf("Comment.SourceHash = %v, want sha256:<hex>", comment.SourceHash)
+				}
 			}
 		})
 	}
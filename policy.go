@@ -0,0 +1,56 @@
+package png
+
+// ReoptimizeDecision は最適化済みのマーカーを持つファイルをどう扱うかを表します。
+// マーカーを持たないファイルでは空文字列になります。
+type ReoptimizeDecision string
+
+const (
+	// ReoptimizeSkip は最適化済みとしてスキップすることを示します（従来の動作）
+	ReoptimizeSkip ReoptimizeDecision = "skip"
+	// ReoptimizeRerun は現在のバイト列から最適化をやり直すことを示します。
+	// 結果が現在のファイルより小さくならない場合は通常どおりCantOptimizeになります。
+	ReoptimizeRerun ReoptimizeDecision = "rerun"
+	// ReoptimizeForce は最適化をやり直し、結果が小さくならない場合でも書き出すことを示します。
+	// マーカーを現在のスキーマで更新したい場合に使用します。
+	ReoptimizeForce ReoptimizeDecision = "force"
+)
+
+// ReoptimizePolicy は、ファイルに記録されたLightFileコメントから
+// 再最適化の要否を判定する関数です。
+// commentはnilではなく、Byが空でないことが保証されます。
+type ReoptimizePolicy func(comment *LightFileComment) ReoptimizeDecision
+
+// SkipOptimized は最適化済みのファイルを常にスキップするポリシーです。
+// Optimizer.ReoptimizePolicyが未設定の場合に使用されます。
+func SkipOptimized(comment *LightFileComment) ReoptimizeDecision {
+	return ReoptimizeSkip
+}
+
+// ForceReoptimize は最適化済みのファイルを常に強制的に再最適化するポリシーです。
+func ForceReoptimize(comment *LightFileComment) ReoptimizeDecision {
+	return ReoptimizeForce
+}
+
+// ReoptimizeBelowSchema は、コメントのスキーマバージョンがschemaより古い場合に
+// 再最適化するポリシーを返します。
+func ReoptimizeBelowSchema(schema int) ReoptimizePolicy {
+	return func(comment *LightFileComment) ReoptimizeDecision {
+		if comment.SchemaVersion() < schema {
+			return ReoptimizeRerun
+		}
+		return ReoptimizeSkip
+	}
+}
+
+// ReoptimizeBelowProfile は、コメントの品質プロファイルがprofileより低い場合に
+// 再最適化するポリシーを返します。
+// プロファイルの高さは force < low < medium < high の順です。
+// プロファイルが記録されていないコメントは最も低いものとして扱います。
+func ReoptimizeBelowProfile(profile string) ReoptimizePolicy {
+	return func(comment *LightFileComment) ReoptimizeDecision {
+		if comment.Profile == "" || qualityRank(comment.Profile) < qualityRank(profile) {
+			return ReoptimizeRerun
+		}
+		return ReoptimizeSkip
+	}
+}
@@ -0,0 +1,105 @@
+package png
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReoptimizePolicies(t *testing.T) {
+	legacy := &LightFileComment{By: "LightFile6"}
+	current := &LightFileComment{Schema: CommentSchemaVersion, By: "LightFile", Profile: "medium"}
+
+	cases := []struct {
+		name     string
+		policy   ReoptimizePolicy
+		comment  *LightFileComment
+		expected ReoptimizeDecision
+	}{
+		{"SkipOptimized legacy", SkipOptimized, legacy, ReoptimizeSkip},
+		{"SkipOptimized current", SkipOptimized, current, ReoptimizeSkip},
+		{"ForceReoptimize", ForceReoptimize, current, ReoptimizeForce},
+		{"BelowSchema legacy", ReoptimizeBelowSchema(CommentSchemaVersion), legacy, ReoptimizeRerun},
+		{"BelowSchema current", ReoptimizeBelowSchema(CommentSchemaVersion), current, ReoptimizeSkip},
+		{"BelowProfile missing profile", ReoptimizeBelowProfile("low"), legacy, ReoptimizeRerun},
+		{"BelowProfile lower", ReoptimizeBelowProfile("high"), current, ReoptimizeRerun},
+		{"BelowProfile same", ReoptimizeBelowProfile("medium"), current, ReoptimizeSkip},
+		{"BelowProfile higher", ReoptimizeBelowProfile("low"), current, ReoptimizeSkip},
+		{"BelowProfile default quality", ReoptimizeBelowProfile(""), current, ReoptimizeSkip},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if decision := tc.policy(tc.comment); decision != tc.expected {
+				t.Errorf("policy(%+v) = %s, want %s", tc.comment, decision, tc.expected)
+			}
+		})
+	}
+}
+
+func TestOptimize_ReoptimizePolicy(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	srcPath := "testdata/optimize/already-lightfile-truly.png"
+
+	testCases := []struct {
+		name                   string
+		policy                 ReoptimizePolicy
+		expectDecision         ReoptimizeDecision
+		expectAlreadyOptimized bool
+	}{
+		{
+			name:                   "Default policy skips",
+			policy:                 nil,
+			expectDecision:         ReoptimizeSkip,
+			expectAlreadyOptimized: true,
+		},
+		{
+			name:           "Older schema is re-run",
+			policy:         ReoptimizeBelowSchema(CommentSchemaVersion),
+			expectDecision: ReoptimizeRerun,
+		},
+		{
+			name:           "Force",
+			policy:         ForceReoptimize,
+			expectDecision: ReoptimizeForce,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			destPath := filepath.Join(tempDir, string(rune('a'+i))+".png")
+
+			optimizer := NewOptimizer("")
+			optimizer.ReoptimizePolicy = tc.policy
+			result, err := optimizer.Run(srcPath, destPath)
+			if err != nil {
+				t.Fatalf("Run() = %v; want nil", err)
+			}
+
+			if result.Reoptimize != tc.expectDecision {
+				t.Errorf("Reoptimize = %s, want %s", result.Reoptimize, tc.expectDecision)
+			}
+			if result.AlreadyOptimized != tc.expectAlreadyOptimized {
+				t.Errorf("AlreadyOptimized = %v, want %v", result.AlreadyOptimized, tc.expectAlreadyOptimized)
+			}
+
+			if tc.expectDecision != ReoptimizeForce {
+				return
+			}
+
+			// Forced re-optimization always writes a file with an updated comment
+			data, err := os.ReadFile(destPath)
+			if err != nil {
+				t.Fatalf("Failed to read output file: %v", err)
+			}
+			comment, _, err := ReadComment(data)
+			if err != nil {
+				t.Fatalf("ReadComment failed: %v", err)
+			}
+			if comment == nil || comment.SchemaVersion() != CommentSchemaVersion {
+				t.Errorf("Expected comment with current schema, got: %+v", comment)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for repair.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"not a PNG file: invalid signature":   "PNGファイルではありません: シグネチャが不正です",
+		"png file missing IHDR chunk":         "PNGファイルにIHDRチャンクがありません",
+		"png file missing IDAT chunk":         "PNGファイルにIDATチャンクがありません",
+		"image data is not recoverable":       "画像データを復元できません",
+		"failed to recompress image data: %v": "画像データの再圧縮に失敗しました: %v",
+	})
+}
+
+// RepairKind は修復処理の種類を表します。
+type RepairKind string
+
+const (
+	// RepairCRC は不正または欠落したCRCを再計算したことを示します
+	RepairCRC RepairKind = "crc"
+	// RepairTrailingData はIEND以降や解析不能な末尾のデータを切り捨てたことを示します
+	RepairTrailingData RepairKind = "trailing-data"
+	// RepairTruncatedChunk は途中で途切れたチャンクを処理したことを示します
+	RepairTruncatedChunk RepairKind = "truncated-chunk"
+	// RepairMissingIEND は欠落していたIENDチャンクを補ったことを示します
+	RepairMissingIEND RepairKind = "missing-iend"
+	// RepairImageData は途切れた画像データから復元可能な行を救出したことを示します
+	RepairImageData RepairKind = "image-data"
+)
+
+// Repair はRepairPNGが行った1件の修復内容を表します。
+type Repair struct {
+	Kind   RepairKind // 修復の種類
+	Chunk  string     // 対象のチャンクタイプ（該当しない場合は空）
+	Offset int64      // 元データ内での位置
+	Detail string     // 補足情報
+}
+
+// RepairPNG は破損したPNGデータのうち、安全に修復できる問題を修復します。
+// 修復の対象は以下の通りです:
+//   - 不正なCRCの再計算
+//   - IEND以降の余分なデータの切り捨て
+//   - 欠落したIENDチャンクの補完
+//   - 途中で途切れたIDATからの復元可能な行の救出（残りはゼロで埋めます）
+//
+// 修復が不要な場合は入力データをそのまま返し、修復内容は空になります。
+// シグネチャ、IHDR、IDATが存在しないなど修復できない場合はDataErrorを返します。
+//
+// 画像データの救出ではIHDRで宣言されたサイズのバッファを確保するため、
+// DefaultLimitsを超える画像はコードがCodeLimitExceededのDataErrorになります。
+// 上限を変更する場合はRepairPNGWithLimitsを使用してください。
+func RepairPNG(data []byte) ([]byte, []Repair, error) {
+	return RepairPNGWithLimits(data, Limits{})
+}
+
+// RepairPNGWithLimits は、limitsの上限を適用してRepairPNGと同じ修復を行います。
+// limitsの0の項目はDefaultLimitsの値を使用し、負の項目は制限しません。
+func RepairPNGWithLimits(data []byte, limits Limits) ([]byte, []Repair, error) {
+	if len(data) < len(pngSignature) || !bytes.Equal(data[:len(pngSignature)], pngSignature) {
+		return nil, nil, NewDataErrorCodef(CodeInvalidSignature, l10n.T("not a PNG file: invalid signature"))
+	}
+	limits = limits.withDefaults()
+	if err := limits.Check(data); err != nil {
+		return nil, nil, err
+	}
+
+	var repairs []Repair
+	var chunks []*pngstructure.Chunk
+	seenIEND := false
+
+	offset := len(pngSignature)
+	for offset < len(data) {
+		remaining := len(data) - offset
+		if remaining < 8 {
+			repairs = append(repairs, Repair{
+				Kind:   RepairTrailingData,
+				Offset: int64(offset),
+				Detail: fmt.Sprintf("dropped %d bytes", remaining),
+			})
+			break
+		}
+
+		length := binary.BigEndian.Uint32(data[offset : offset+4])
+		typeBytes := data[offset+4 : offset+8]
+		if !isValidChunkType(typeBytes) || length > 0x7FFFFFFF {
+			// チャンクとして解釈できないデータ以降は捨てる
+			repairs = append(repairs, Repair{
+				Kind:   RepairTrailingData,
+				Offset: int64(offset),
+				Detail: fmt.Sprintf("dropped %d bytes", remaining),
+			})
+			break
+		}
+
+		chunkType := string(typeBytes)
+		dataStart := offset + 8
+		dataEnd := dataStart + int(length)
+
+		if dataEnd > len(data) {
+			// IDATは途中までのデータを画像データの救出に使い、それ以外は捨てる
+			if chunkType == "IDAT" {
+				chunks = append(chunks, &pngstructure.Chunk{Type: chunkType, Data: data[dataStart:]})
+				repairs = append(repairs, Repair{
+					Kind:   RepairTruncatedChunk,
+					Chunk:  chunkType,
+					Offset: int64(offset),
+					Detail: fmt.Sprintf("kept %d of %d bytes", len(data)-dataStart, length),
+				})
+			} else {
+				repairs = append(repairs, Repair{
+					Kind:   RepairTruncatedChunk,
+					Chunk:  chunkType,
+					Offset: int64(offset),
+					Detail: "dropped",
+				})
+			}
+			break
+		}
+
+		chunkData := data[dataStart:dataEnd]
+		expected := chunkCRC(chunkType, chunkData)
+		if dataEnd+4 > len(data) {
+			repairs = append(repairs, Repair{
+				Kind:   RepairCRC,
+				Chunk:  chunkType,
+				Offset: int64(offset),
+				Detail: "missing",
+			})
+		} else if actual := binary.BigEndian.Uint32(data[dataEnd : dataEnd+4]); actual != expected {
+			repairs = append(repairs, Repair{
+				Kind:   RepairCRC,
+				Chunk:  chunkType,
+				Offset: int64(offset),
+				Detail: fmt.Sprintf("%08x -> %08x", actual, expected),
+			})
+		}
+
+		chunks = append(chunks, &pngstructure.Chunk{Type: chunkType, Data: chunkData})
+		offset = dataEnd + 4
+
+		if chunkType == "IEND" {
+			seenIEND = true
+			if offset < len(data) {
+				repairs = append(repairs, Repair{
+					Kind:   RepairTrailingData,
+					Offset: int64(offset),
+					Detail: fmt.Sprintf("dropped %d bytes", len(data)-offset),
+				})
+			}
+			break
+		}
+	}
+
+	if len(chunks) == 0 || chunks[0].Type != "IHDR" {
+		return nil, nil, NewDataErrorCodef(CodeMissingChunk, l10n.T("png file missing IHDR chunk"))
+	}
+	header, err := parseIHDR(chunks[0].Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !seenIEND {
+		chunks = append(chunks, &pngstructure.Chunk{Type: "IEND"})
+		repairs = append(repairs, Repair{
+			Kind:   RepairMissingIEND,
+			Chunk:  "IEND",
+			Offset: int64(len(data)),
+		})
+	}
+
+	chunks, salvage, err := salvageImageData(chunks, header, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if salvage != nil {
+		repairs = append(repairs, *salvage)
+	}
+
+	if len(repairs) == 0 {
+		return data, nil, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	for _, chunk := range chunks {
+		if err := writeChunk(&buf, chunk); err != nil {
+			return nil, nil, NewDataErrorCodef(CodeEncodeFailed, l10n.T("failed to write chunk: %v"), err)
+		}
+	}
+
+	return buf.Bytes(), repairs, nil
+}
+
+// salvageImageData はIDATチャンクを展開し、データが不足または破損している場合は
+// 復元できた部分をゼロで埋めて再圧縮した単一のIDATに置き換えます。
+// 画像データに問題がなければ、チャンクをそのまま返し修復内容はnilになります。
+// 展開先のバッファを確保する前に、IHDRの宣言をlimitsと比較します。
+func salvageImageData(chunks []*pngstructure.Chunk, header *pngHeader, limits Limits) ([]*pngstructure.Chunk, *Repair, error) {
+	var compressed bytes.Buffer
+	for _, chunk := range chunks {
+		if chunk.Type == "IDAT" {
+			compressed.Write(chunk.Data)
+		}
+	}
+	if compressed.Len() == 0 {
+		return nil, nil, NewDataErrorCodef(CodeMissingChunk, l10n.T("png file missing IDAT chunk"))
+	}
+
+	if err := limits.checkHeader(header); err != nil {
+		return nil, nil, err
+	}
+	expected := header.rawDataSize()
+	raw := make([]byte, expected)
+	recovered := 0
+
+	zr, err := zlib.NewReader(bytes.NewReader(compressed.Bytes()))
+	if err == nil {
+		recovered, err = io.ReadFull(zr, raw)
+		if err == nil {
+			// 期待どおりの量を読めた場合も、ストリームが正しく終端しているか確認する
+			_, err = zr.Read(make([]byte, 1))
+			if err == io.EOF {
+				return chunks, nil, nil
+			}
+		}
+	}
+
+	if recovered == 0 {
+		return nil, nil, NewDataErrorCodef(CodeDecodeFailed, l10n.T("image data is not recoverable"))
+	}
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(raw); err != nil {
+		return nil, nil, NewDataErrorCodef(CodeEncodeFailed, l10n.T("failed to recompress image data: %v"), err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, NewDataErrorCodef(CodeEncodeFailed, l10n.T("failed to recompress image data: %v"), err)
+	}
+
+	// 最初のIDATの位置に再圧縮したデータを置き、残りのIDATは取り除く
+	salvaged := make([]*pngstructure.Chunk, 0, len(chunks))
+	inserted := false
+	for _, chunk := range chunks {
+		if chunk.Type == "IDAT" {
+			if !inserted {
+				salvaged = append(salvaged, &pngstructure.Chunk{Type: "IDAT", Data: buf.Bytes()})
+				inserted = true
+			}
+			continue
+		}
+		salvaged = append(salvaged, chunk)
+	}
+
+	repair := &Repair{
+		Kind:   RepairImageData,
+		Chunk:  "IDAT",
+		Detail: fmt.Sprintf("recovered %d of %d bytes", recovered, expected),
+	}
+	return salvaged, repair, nil
+}
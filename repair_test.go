@@ -0,0 +1,211 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// findChunkOffset はdata中で最初に現れるchunkTypeのチャンクの開始位置を返します
+func findChunkOffset(t *testing.T, data []byte, chunkType string) int {
+	offset := 8
+	for offset+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		if string(data[offset+4:offset+8]) == chunkType {
+			return offset
+		}
+		offset += 12 + length
+	}
+	t.Fatalf("chunk %s not found", chunkType)
+	return -1
+}
+
+func TestRepairPNG(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/colortype_rgb.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+
+	iendOffset := findChunkOffset(t, original, "IEND")
+	idatOffset := findChunkOffset(t, original, "IDAT")
+
+	cases := []struct {
+		name        string
+		damage      func(data []byte) []byte
+		expectKinds []RepairKind
+	}{
+		{
+			name:        "破損なし",
+			damage:      func(data []byte) []byte { return data },
+			expectKinds: nil,
+		},
+		{
+			name: "CRC不正",
+			damage: func(data []byte) []byte {
+				// IHDRのCRCを壊す
+				data[8+8+13] ^= 0xFF
+				return data
+			},
+			expectKinds: []RepairKind{RepairCRC},
+		},
+		{
+			name: "IEND以降のゴミ",
+			damage: func(data []byte) []byte {
+				return append(data, []byte("garbage after IEND")...)
+			},
+			expectKinds: []RepairKind{RepairTrailingData},
+		},
+		{
+			name: "IEND欠落",
+			damage: func(data []byte) []byte {
+				return data[:iendOffset]
+			},
+			expectKinds: []RepairKind{RepairMissingIEND},
+		},
+		{
+			name: "IDAT途中で切断",
+			damage: func(data []byte) []byte {
+				return data[:idatOffset+8+20000]
+			},
+			expectKinds: []RepairKind{RepairTruncatedChunk, RepairMissingIEND, RepairImageData},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			damaged := tc.damage(append([]byte(nil), original...))
+
+			repaired, repairs, err := RepairPNG(damaged)
+			if err != nil {
+				t.Fatalf("RepairPNG() = %v; want nil", err)
+			}
+
+			if len(repairs) != len(tc.expectKinds) {
+				t.Fatalf("len(repairs) = %d; want %d (%+v)", len(repairs), len(tc.expectKinds), repairs)
+			}
+			for i, kind := range tc.expectKinds {
+				if repairs[i].Kind != kind {
+					t.Errorf("repairs[%d].Kind = %s; want %s", i, repairs[i].Kind, kind)
+				}
+			}
+
+			if len(repairs) == 0 && !bytes.Equal(repaired, damaged) {
+				t.Error("RepairPNG() should return input as is when no repair is needed")
+			}
+
+			// 修復後のデータはデコードできること
+			if _, err := png.Decode(bytes.NewReader(repaired)); err != nil {
+				t.Errorf("png.Decode(repaired) = %v; want nil", err)
+			}
+		})
+	}
+}
+
+func TestRepairPNG_Unrecoverable(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+	}{
+		{
+			name: "破損したファイル",
+			file: "testdata/optimize/bad.png",
+		},
+		{
+			name: "実態がJPEGのファイル",
+			file: "testdata/optimize/jpeg.png",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%s) = %v; want nil", tc.file, err)
+			}
+
+			_, _, err = RepairPNG(data)
+			if err == nil {
+				t.Fatal("RepairPNG() = nil; want error")
+			}
+			if AsDataError(err) == nil {
+				t.Errorf("RepairPNG() error should be DataError: %v", err)
+			}
+		})
+	}
+}
+
+func TestRepairPNG_Limits(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/colortype_rgb.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	// 巨大なサイズを宣言し、画像データが途中で途切れたPNG
+	bomb := setIHDRSize(t, original, 30000, 30000)
+	bomb = bomb[:findChunkOffset(t, bomb, "IDAT")+8+100]
+
+	cases := []struct {
+		name   string
+		limits Limits
+	}{
+		{"デフォルトの上限", Limits{}},
+		{"幅", Limits{MaxWidth: 1000, MaxPixels: -1, MaxDecompressedSize: -1}},
+		{"展開後のサイズ", Limits{MaxPixels: -1, MaxDecompressedSize: 1 << 20}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := RepairPNGWithLimits(bomb, tc.limits)
+			if CodeOf(err) != CodeLimitExceeded {
+				t.Errorf("RepairPNGWithLimits() = %v; want CodeLimitExceeded", err)
+			}
+		})
+	}
+
+	// 上限を超えない画像は修復できる
+	truncated := original[:findChunkOffset(t, original, "IDAT")+8+20000]
+	if _, _, err := RepairPNGWithLimits(truncated, Limits{MaxPixels: 1 << 20}); err != nil {
+		t.Errorf("RepairPNGWithLimits() = %v; want nil", err)
+	}
+}
+
+func TestOptimize_Repair(t *testing.T) {
+	tempDir := t.TempDir()
+
+	data, err := os.ReadFile("testdata/optimize/psnr-will-50.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	damaged := append(data[:findChunkOffset(t, data, "IEND")], []byte("trailing garbage")...)
+	srcPath := filepath.Join(tempDir, "damaged.png")
+	if err := os.WriteFile(srcPath, damaged, 0600); err != nil {
+		t.Fatalf("os.WriteFile() = %v; want nil", err)
+	}
+
+	// 修復なしでは失敗する
+	optimizer := NewOptimizer("")
+	if _, err := optimizer.Run(srcPath, filepath.Join(tempDir, "no-repair.png")); err == nil {
+		t.Error("Run() without repair = nil; want error")
+	}
+
+	// 修復ありでは最適化まで進む
+	optimizer.Repair = true
+	destPath := filepath.Join(tempDir, "repaired.png")
+	result, err := optimizer.Run(srcPath, destPath)
+	if err != nil {
+		t.Fatalf("Run() with repair = %v; want nil", err)
+	}
+	if len(result.Repairs) == 0 {
+		t.Error("Repairs should not be empty")
+	}
+
+	output, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) = %v; want nil", destPath, err)
+	}
+	if _, err := png.Decode(bytes.NewReader(output)); err != nil {
+		t.Errorf("png.Decode(output) = %v; want nil", err)
+	}
+}
@@ -0,0 +1,397 @@
+package png
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// ReportSchemaVersion はFileReportとSummaryReportのJSONスキーマのバージョンです。
+// フィールドの削除や意味の変更を行う場合に増やします。フィールドの追加では変更しません。
+const ReportSchemaVersion = 1
+
+// レポートの種類（ReportのTypeフィールド）です。NDJSONの各行を区別するために使用します。
+const (
+	ReportTypeFile    = "file"
+	ReportTypeSummary = "summary"
+)
+
+// ErrorReport はエラーをJSONで表したものです。
+type ErrorReport struct {
+	// Kind は、エラーのチェーンで最も外側がDataErrorの場合は "data"、それ以外は "system" です。
+	Kind string `json:"kind"`
+	// Code はErrorCodeの名前（"crc_mismatch" など）です。
+	Code string `json:"code"`
+	// Stage はエラーが発生したパイプラインのステージです。不明な場合は省略されます。
+	Stage Stage `json:"stage,omitempty"`
+	// Message は翻訳されたエラーメッセージです。処理を分ける場合はCodeを使用してください。
+	Message string `json:"message"`
+}
+
+// NewErrorReport はerrをErrorReportに変換します。errがnilの場合はnilを返します。
+func NewErrorReport(err error) *ErrorReport {
+	if err == nil {
+		return nil
+	}
+	kind := "system"
+	if _, ok := outermostError(err).(*DataError); ok {
+		kind = "data"
+	}
+	return &ErrorReport{
+		Kind:    kind,
+		Code:    CodeOf(err).String(),
+		Stage:   StageOf(err),
+		Message: err.Error(),
+	}
+}
+
+// StripReport はメタデータの削除の結果です。
+type StripReport struct {
+	TextChunks   int `json:"textChunks"`
+	TimeChunks   int `json:"timeChunks"`
+	Background   int `json:"background"`
+	ExifChunks   int `json:"exifChunks"`
+	OtherChunks  int `json:"otherChunks"`
+	BytesRemoved int `json:"bytesRemoved"`
+}
+
+// RepairReport は行った修復の1件です。
+type RepairReport struct {
+	Kind   RepairKind `json:"kind"`
+	Chunk  string     `json:"chunk,omitempty"`
+	Offset int64      `json:"offset"`
+	Detail string     `json:"detail,omitempty"`
+}
+
+// PNGQuantReport は減色の結果です。
+type PNGQuantReport struct {
+	Applied bool `json:"applied"`
+	// PSNR は減色前とのPSNRです。画素が変わっていない場合はnull（無限大）で、
+	// 減色しなかった場合（インデックスカラーの画像、減色の失敗など）は省略されます。
+	PSNR *MaybeInf `json:"psnr,omitempty"`
+}
+
+// UnmarshalJSON はjson.Unmarshalerを実装し、psnrのnullを無限大として読み込みます。
+func (r *PNGQuantReport) UnmarshalJSON(data []byte) error {
+	type plain PNGQuantReport
+	aux := struct {
+		*plain
+		PSNR json.RawMessage `json:"psnr"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	return unmarshalOptionalPSNR(aux.PSNR, &r.PSNR)
+}
+
+// ChunkUsageReport はチャンクタイプごとのバイト数です。
+type ChunkUsageReport struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// StageEstimateReport はステージで削減できるサイズの見積もりです。
+type StageEstimateReport struct {
+	Stage   Stage `json:"stage"`
+	Size    int64 `json:"size"`
+	Savings int64 `json:"savings"`
+	// PSNR はステージ適用前とのPSNRです。pngquant以外では省略され、画素が変わらない場合はnull（無限大）です。
+	PSNR *MaybeInf `json:"psnr,omitempty"`
+}
+
+// UnmarshalJSON はjson.Unmarshalerを実装し、psnrのnullを無限大として読み込みます。
+func (r *StageEstimateReport) UnmarshalJSON(data []byte) error {
+	type plain StageEstimateReport
+	aux := struct {
+		*plain
+		PSNR json.RawMessage `json:"psnr"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	return unmarshalOptionalPSNR(aux.PSNR, &r.PSNR)
+}
+
+// AnalysisReport はAnalysisをJSONで表したものです。
+type AnalysisReport struct {
+	FileSize         int64                 `json:"fileSize"`
+	Width            int                   `json:"width"`
+	Height           int                   `json:"height"`
+	BitDepth         int                   `json:"bitDepth"`
+	ColorType        int                   `json:"colorType"`
+	Interlaced       bool                  `json:"interlaced"`
+	Chunks           []ChunkUsageReport    `json:"chunks"`
+	IDATSize         int64                 `json:"idatSize"`
+	RawDataSize      int64                 `json:"rawDataSize"`
+	CompressionRatio float64               `json:"compressionRatio"`
+	FilterRows       [5]int64              `json:"filterRows"`
+	UniqueColors     int                   `json:"uniqueColors"`
+	Alpha            AlphaUsage            `json:"alpha"`
+	Estimates        []StageEstimateReport `json:"estimates"`
+}
+
+// NewAnalysisReport はAnalysisをAnalysisReportに変換します。analysisがnilの場合はnilを返します。
+func NewAnalysisReport(analysis *Analysis) *AnalysisReport {
+	if analysis == nil {
+		return nil
+	}
+	report := &AnalysisReport{
+		FileSize:         analysis.FileSize,
+		Width:            analysis.Width,
+		Height:           analysis.Height,
+		BitDepth:         analysis.BitDepth,
+		ColorType:        analysis.ColorType,
+		Interlaced:       analysis.Interlaced,
+		Chunks:           []ChunkUsageReport{},
+		IDATSize:         analysis.IDATSize,
+		RawDataSize:      analysis.RawDataSize,
+		CompressionRatio: analysis.CompressionRatio,
+		FilterRows:       analysis.FilterRows,
+		UniqueColors:     analysis.UniqueColors,
+		Alpha:            analysis.Alpha,
+		Estimates:        []StageEstimateReport{},
+	}
+	for _, chunk := range analysis.Chunks {
+		report.Chunks = append(report.Chunks, ChunkUsageReport{Type: chunk.Type, Count: chunk.Count, Bytes: chunk.Bytes})
+	}
+	for _, estimate := range analysis.Estimates {
+		report.Estimates = append(report.Estimates, StageEstimateReport{
+			Stage:   estimate.Stage,
+			Size:    estimate.Size,
+			Savings: estimate.Savings,
+			PSNR:    optionalPSNR(estimate.PSNR),
+		})
+	}
+	return report
+}
+
+// optionalPSNR は、計算されたPSNRをMaybeInfで返します。
+// OptimizePNGOutputなどでは計算されていないPSNRが0のため、0の場合はnilを返します。
+func optionalPSNR(psnr float64) *MaybeInf {
+	if psnr == 0 {
+		return nil
+	}
+	value := MaybeInf(psnr)
+	return &value
+}
+
+// unmarshalOptionalPSNR は、キーがない場合はnil、nullの場合は無限大としてrawをdestに読み込みます。
+// json.Unmarshalはポインタのフィールドのnullをnilにするため、レポートのUnmarshalJSONで使用します。
+func unmarshalOptionalPSNR(raw json.RawMessage, dest **MaybeInf) error {
+	if raw == nil {
+		*dest = nil
+		return nil
+	}
+	var value MaybeInf
+	if err := value.UnmarshalJSON(raw); err != nil {
+		return err
+	}
+	*dest = &value
+	return nil
+}
+
+// FileReport は1つのファイルの最適化の結果を、安定したJSONスキーマで表したものです。
+// OptimizePNGOutputのerrorのフィールドはErrorReportに、無限大になりうる指標はMaybeInfになります。
+type FileReport struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Type          string `json:"type"`
+	Src           string `json:"src"`
+	Dest          string `json:"dest"`
+	// Outcome はBatchOutcomeの名前（"optimized" など）です。
+	Outcome string `json:"outcome"`
+
+	BeforeSize         int64 `json:"beforeSize"`
+	AfterSize          int64 `json:"afterSize"`
+	SizeAfterStrip     int64 `json:"sizeAfterStrip"`
+	SizeAfterPNGQuant  int64 `json:"sizeAfterPngquant"`
+	PeakMemoryEstimate int64 `json:"peakMemoryEstimate"`
+
+	AlreadyOptimizedBy string `json:"alreadyOptimizedBy,omitempty"`
+	UntrustedComment   bool   `json:"untrustedComment,omitempty"`
+	// Reoptimize は最適化済みのマーカーを持つファイルに対するReoptimizePolicyの判定です。
+	// マーカーを持たないファイルでは省略されます。
+	Reoptimize   ReoptimizeDecision `json:"reoptimize,omitempty"`
+	Estimated    bool               `json:"estimated,omitempty"`
+	IndexedColor bool               `json:"indexedColor"`
+	Repairs      []RepairReport     `json:"repairs,omitempty"`
+	Strip        *StripReport       `json:"strip,omitempty"`
+	PNGQuant     *PNGQuantReport    `json:"pngquant,omitempty"`
+	// FinalPSNR は元の画像と最終結果のPSNRです。画素が変わっていない場合はnull（無限大）で、
+	// 検査の前に終了した場合（最適化済み、削減できない、エラーなど）は省略されます。
+	FinalPSNR *MaybeInf `json:"finalPsnr,omitempty"`
+	// Analysis はOptimizer.Analyzeを有効にした場合の解析の結果です。
+	Analysis *AnalysisReport `json:"analysis,omitempty"`
+
+	// DurationMs は処理にかかった時間（ミリ秒）です。BatchResultから作成した場合のみ設定されます。
+	DurationMs int64 `json:"durationMs,omitempty"`
+
+	// Error はOptimizer.Runが返したエラーで、その他はステージで記録されたエラーです。
+	Error         *ErrorReport `json:"error,omitempty"`
+	StripError    *ErrorReport `json:"stripError,omitempty"`
+	PNGQuantError *ErrorReport `json:"pngquantError,omitempty"`
+	CommentError  *ErrorReport `json:"commentError,omitempty"`
+}
+
+// UnmarshalJSON はjson.Unmarshalerを実装し、finalPsnrのnullを無限大として読み込みます。
+func (r *FileReport) UnmarshalJSON(data []byte) error {
+	type plain FileReport
+	aux := struct {
+		*plain
+		FinalPSNR json.RawMessage `json:"finalPsnr"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	return unmarshalOptionalPSNR(aux.FinalPSNR, &r.FinalPSNR)
+}
+
+// NewFileReport は、srcをdestに最適化したOptimizer.Runの戻り値からFileReportを作成します。
+func NewFileReport(src, dest string, output *OptimizePNGOutput, err error) *FileReport {
+	report := &FileReport{
+		SchemaVersion: ReportSchemaVersion,
+		Type:          ReportTypeFile,
+		Src:           src,
+		Dest:          dest,
+		Outcome:       outcomeOf(output, err).String(),
+		Error:         NewErrorReport(err),
+	}
+	if output == nil {
+		return report
+	}
+
+	report.BeforeSize = output.BeforeSize
+	report.AfterSize = output.AfterSize
+	report.SizeAfterStrip = output.SizeAfterStrip
+	report.SizeAfterPNGQuant = output.SizeAfterPNGQuant
+	report.PeakMemoryEstimate = output.PeakMemoryEstimate
+	report.AlreadyOptimizedBy = output.AlreadyOptimizedBy
+	report.UntrustedComment = output.UntrustedComment
+	report.Reoptimize = output.Reoptimize
+	report.Estimated = output.Estimated
+	report.IndexedColor = output.IsIndexedColor
+	report.FinalPSNR = optionalPSNR(output.FinalPSNR)
+	report.Analysis = NewAnalysisReport(output.Analysis)
+	for _, r := range output.Repairs {
+		report.Repairs = append(report.Repairs, RepairReport{Kind: r.Kind, Chunk: r.Chunk, Offset: r.Offset, Detail: r.Detail})
+	}
+	if strip := output.Strip; strip != nil {
+		report.Strip = &StripReport{
+			TextChunks:   strip.Removed.TextChunks,
+			TimeChunks:   strip.Removed.TimeChunk,
+			Background:   strip.Removed.Background,
+			ExifChunks:   strip.Removed.ExifData,
+			OtherChunks:  strip.Removed.OtherChunks,
+			BytesRemoved: strip.Total,
+		}
+	}
+	if !output.AlreadyOptimized {
+		report.PNGQuant = &PNGQuantReport{Applied: output.PNGQuant.Applied, PSNR: optionalPSNR(output.PNGQuant.PSNR)}
+	}
+	report.StripError = NewErrorReport(output.StripError)
+	report.PNGQuantError = NewErrorReport(output.PNGQuantError)
+	report.CommentError = NewErrorReport(output.CommentError)
+	return report
+}
+
+// Report はジョブの結果をFileReportに変換します。
+func (r BatchResult) Report() *FileReport {
+	report := NewFileReport(r.Job.Src, r.Job.Dest, r.Output, r.Err)
+	report.Outcome = r.Outcome.String()
+	report.DurationMs = r.Duration.Milliseconds()
+	return report
+}
+
+// PSNRBucketReport はPSNRの分布の1つの区間です。下限または上限がない場合はnullです。
+type PSNRBucketReport struct {
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Count int      `json:"count"`
+}
+
+// PSNRHistogramReport はPSNRの分布をJSONで表したものです。
+type PSNRHistogramReport struct {
+	Buckets  []PSNRBucketReport `json:"buckets"`
+	Lossless int                `json:"lossless"`
+	Min      float64            `json:"min"`
+	Max      float64            `json:"max"`
+	Mean     float64            `json:"mean"`
+}
+
+// SummaryReport はBatchSummaryを安定したJSONスキーマで表したものです。
+type SummaryReport struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Type          string `json:"type"`
+	Total         int    `json:"total"`
+	// Outcomes はBatchOutcomeの名前ごとのファイル数です。すべての種類を含みます。
+	Outcomes   map[string]int      `json:"outcomes"`
+	BeforeSize int64               `json:"beforeSize"`
+	AfterSize  int64               `json:"afterSize"`
+	BytesSaved int64               `json:"bytesSaved"`
+	PSNR       PSNRHistogramReport `json:"psnr"`
+	DurationMs int64               `json:"durationMs"`
+}
+
+// Report は集計をSummaryReportに変換します。
+func (s *BatchSummary) Report() *SummaryReport {
+	report := &SummaryReport{
+		SchemaVersion: ReportSchemaVersion,
+		Type:          ReportTypeSummary,
+		Total:         s.Total,
+		Outcomes:      make(map[string]int, len(batchOutcomes)),
+		BeforeSize:    s.BeforeSize,
+		AfterSize:     s.AfterSize,
+		BytesSaved:    s.BytesSaved,
+		PSNR: PSNRHistogramReport{
+			Lossless: s.PSNR.Lossless,
+			Min:      s.PSNR.Min,
+			Max:      s.PSNR.Max,
+			Mean:     s.PSNR.Mean,
+		},
+		DurationMs: s.Duration.Milliseconds(),
+	}
+	for _, outcome := range batchOutcomes {
+		report.Outcomes[outcome.String()] = s.Outcomes[outcome]
+	}
+	for i, count := range s.PSNR.Counts {
+		bucket := PSNRBucketReport{Count: count}
+		if i > 0 {
+			bucket.Min = &PSNRBuckets[i-1]
+		}
+		if i < len(PSNRBuckets) {
+			bucket.Max = &PSNRBuckets[i]
+		}
+		report.PSNR.Buckets = append(report.PSNR.Buckets, bucket)
+	}
+	return report
+}
+
+// NDJSONWriter は、レポートを1行に1つのJSON（NDJSON）で書き込みます。
+// 複数のゴルーチンから同時に使用できます。
+//
+// 例:
+//
+//	out := png.NewNDJSONWriter(os.Stdout)
+//	summary := batch.Run(jobs, func(r png.BatchResult) bool {
+//	    out.Write(r.Report())
+//	    return true
+//	})
+//	out.Write(summary.Report())
+type NDJSONWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewNDJSONWriter はwに書き込むNDJSONWriterを作成します。
+func NewNDJSONWriter(w io.Writer) *NDJSONWriter {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &NDJSONWriter{encoder: encoder}
+}
+
+// Write はvをJSONにして1行で書き込みます。
+func (w *NDJSONWriter) Write(v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.encoder.Encode(v)
+}
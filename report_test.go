@@ -0,0 +1,274 @@
+package png
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewErrorReport(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		expect *ErrorReport
+	}{
+		{"nil", nil, nil},
+		{
+			"データエラー",
+			withStage(NewDataErrorCodef(CodeCRCMismatch, "bad crc"), StageRepair),
+			&ErrorReport{Kind: "data", Code: "crc_mismatch", Stage: StageRepair},
+		},
+		{
+			"システムエラー",
+			withStage(NewSystemErrorf(CodeWorkerTimeout, "timeout"), StagePNGQuant),
+			&ErrorReport{Kind: "system", Code: "worker_timeout", Stage: StagePNGQuant},
+		},
+		{
+			// 最も外側のエラーの種類とコードを使う
+			"データエラーを含むシステムエラー",
+			NewSystemErrorf(CodeIO, "io: %w", NewDataErrorCodef(CodeCRCMismatch, "bad crc")),
+			&ErrorReport{Kind: "system", Code: "io"},
+		},
+		{"分類されていないエラー", fmt.Errorf("plain"), &ErrorReport{Kind: "system", Code: "unknown"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := NewErrorReport(tc.err)
+			if tc.expect == nil {
+				if got != nil {
+					t.Errorf("NewErrorReport() = %+v; want nil", got)
+				}
+				return
+			}
+			if got == nil || got.Kind != tc.expect.Kind || got.Code != tc.expect.Code || got.Stage != tc.expect.Stage || got.Message != tc.err.Error() {
+				t.Errorf("NewErrorReport() = %+v; want %+v with message %q", got, tc.expect, tc.err.Error())
+			}
+		})
+	}
+}
+
+func TestFileReport_JSON(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	cases := []struct {
+		name          string
+		src           string
+		expectOutcome string
+		expectError   string
+	}{
+		{"最適化", "testdata/optimize/psnr-will-50.png", "optimized", ""},
+		{"最適化済み", "testdata/optimize/already-lightfile-truly.png", "already_optimized", ""},
+		{"エラー", "testdata/optimize/bad.png", "error", "data"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dest := filepath.Join(tempDir, filepath.Base(tc.src))
+			output, err := NewOptimizer("").Run(tc.src, dest)
+			report := NewFileReport(tc.src, dest, output, err)
+
+			data, jsonErr := json.Marshal(report)
+			if jsonErr != nil {
+				t.Fatalf("json.Marshal() = %v; want nil", jsonErr)
+			}
+			var decoded FileReport
+			if jsonErr := json.Unmarshal(data, &decoded); jsonErr != nil {
+				t.Fatalf("json.Unmarshal() = %v; want nil", jsonErr)
+			}
+
+			if decoded.SchemaVersion != ReportSchemaVersion || decoded.Type != ReportTypeFile {
+				t.Errorf("schemaVersion, type = %d, %q; want %d, %q", decoded.SchemaVersion, decoded.Type, ReportSchemaVersion, ReportTypeFile)
+			}
+			if decoded.Outcome != tc.expectOutcome {
+				t.Errorf("outcome = %q; want %q", decoded.Outcome, tc.expectOutcome)
+			}
+			if tc.expectError == "" {
+				if decoded.Error != nil {
+					t.Errorf("error = %+v; want nil", decoded.Error)
+				}
+			} else if decoded.Error == nil || decoded.Error.Kind != tc.expectError || decoded.Error.Code == "" {
+				t.Errorf("error = %+v; want kind %q with a code", decoded.Error, tc.expectError)
+			}
+			if output != nil && (decoded.BeforeSize != output.BeforeSize || decoded.AfterSize != output.AfterSize) {
+				t.Errorf("sizes = %d -> %d; want %d -> %d", decoded.BeforeSize, decoded.AfterSize, output.BeforeSize, output.AfterSize)
+			}
+		})
+	}
+}
+
+func TestFileReport_PSNR(t *testing.T) {
+	inf := math.Inf(1)
+	cases := []struct {
+		name           string
+		finalPSNR      float64
+		pngquantPSNR   float64
+		expectJSON     []string
+		expectFinal    *float64
+		expectPNGQuant *float64
+	}{
+		{"無限大", inf, inf, []string{`"finalPsnr":null`, `"psnr":null`}, &inf, &inf},
+		{"有限の値", 42.5, 38, []string{`"finalPsnr":42.5`, `"psnr":38`}, ptrFloat(42.5), ptrFloat(38)},
+		// 計算されていないPSNRは0ではなく省略する
+		{"計算されていない", 0, 0, []string{`"pngquant":{"applied":false}`}, nil, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			output := &OptimizePNGOutput{FinalPSNR: tc.finalPSNR}
+			output.PNGQuant.PSNR = tc.pngquantPSNR
+			data, err := json.Marshal(NewFileReport("a.png", "b.png", output, nil))
+			if err != nil {
+				t.Fatalf("json.Marshal() = %v; want nil", err)
+			}
+			for _, expect := range tc.expectJSON {
+				if !strings.Contains(string(data), expect) {
+					t.Errorf("json = %s; want to contain %s", data, expect)
+				}
+			}
+			if tc.expectFinal == nil && strings.Contains(string(data), "finalPsnr") {
+				t.Errorf("json = %s; want no finalPsnr", data)
+			}
+
+			// nullは無限大、省略はnilとして読み込む
+			var decoded FileReport
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("json.Unmarshal() = %v; want nil", err)
+			}
+			if !equalPSNR(decoded.FinalPSNR, tc.expectFinal) || !equalPSNR(decoded.PNGQuant.PSNR, tc.expectPNGQuant) {
+				t.Errorf("finalPsnr, psnr = %v, %v; want %v, %v", decoded.FinalPSNR, decoded.PNGQuant.PSNR, tc.expectFinal, tc.expectPNGQuant)
+			}
+		})
+	}
+}
+
+// ptrFloat はvへのポインタを返します
+func ptrFloat(v float64) *float64 {
+	return &v
+}
+
+// equalPSNR はレポートのPSNRが期待する値（nilは省略）と一致するかを判定します
+func equalPSNR(actual *MaybeInf, expect *float64) bool {
+	if actual == nil || expect == nil {
+		return actual == nil && expect == nil
+	}
+	return float64(*actual) == *expect
+}
+
+func TestFileReport_Reoptimize(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	optimizer := NewOptimizer("")
+	optimizer.ReoptimizePolicy = ForceReoptimize
+	optimizer.Analyze = true
+	src := "testdata/optimize/already-lightfile-truly.png"
+	dest := filepath.Join(tempDir, "out.png")
+	output, err := optimizer.Run(src, dest)
+
+	data, jsonErr := json.Marshal(NewFileReport(src, dest, output, err))
+	if jsonErr != nil {
+		t.Fatalf("json.Marshal() = %v; want nil", jsonErr)
+	}
+	var decoded FileReport
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() = %v; want nil", err)
+	}
+	if decoded.Reoptimize != ReoptimizeForce {
+		t.Errorf("reoptimize = %q; want %q", decoded.Reoptimize, ReoptimizeForce)
+	}
+	if decoded.Analysis == nil || decoded.Analysis.FileSize != output.BeforeSize || len(decoded.Analysis.Chunks) == 0 {
+		t.Errorf("analysis = %+v; want the analysis of %s", decoded.Analysis, src)
+	}
+}
+
+func TestSummaryReport(t *testing.T) {
+	summary := NewBatchSummary()
+	summary.Add(BatchResult{Outcome: OutcomeOptimized, Output: &OptimizePNGOutput{BeforeSize: 100, AfterSize: 60, FinalPSNR: 42}, Duration: time.Second})
+	summary.Add(BatchResult{Outcome: OutcomeOptimized, Output: &OptimizePNGOutput{BeforeSize: 50, AfterSize: 50, FinalPSNR: math.Inf(1)}, Duration: time.Second})
+	summary.Add(BatchResult{Outcome: OutcomeError, Err: fmt.Errorf("failed")})
+
+	report := summary.Report()
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v; want nil", err)
+	}
+	var decoded SummaryReport
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() = %v; want nil", err)
+	}
+
+	if decoded.Type != ReportTypeSummary || decoded.Total != 3 || decoded.BytesSaved != 40 || decoded.DurationMs != 2000 {
+		t.Errorf("summary = %+v; want type %q, total 3, bytesSaved 40, durationMs 2000", decoded, ReportTypeSummary)
+	}
+	// 件数が0の結果の種類も含む
+	expectOutcomes := map[string]int{"optimized": 2, "already_optimized": 0, "cant_optimize": 0, "inspection_failed": 0, "error": 1}
+	if fmt.Sprint(decoded.Outcomes) != fmt.Sprint(expectOutcomes) {
+		t.Errorf("outcomes = %v; want %v", decoded.Outcomes, expectOutcomes)
+	}
+
+	buckets := decoded.PSNR.Buckets
+	if len(buckets) != len(PSNRBuckets)+1 {
+		t.Fatalf("len(buckets) = %d; want %d", len(buckets), len(PSNRBuckets)+1)
+	}
+	if buckets[0].Min != nil || buckets[len(buckets)-1].Max != nil {
+		t.Errorf("first min, last max = %v, %v; want nil", buckets[0].Min, buckets[len(buckets)-1].Max)
+	}
+	if b := buckets[3]; b.Count != 1 || *b.Min != 40 || *b.Max != 45 {
+		t.Errorf("buckets[3] = {%v %v %d}; want {40 45 1}", *b.Min, *b.Max, b.Count)
+	}
+	if decoded.PSNR.Lossless != 1 || decoded.PSNR.Mean != 42 {
+		t.Errorf("lossless, mean = %d, %v; want 1, 42", decoded.PSNR.Lossless, decoded.PSNR.Mean)
+	}
+}
+
+func TestNDJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewNDJSONWriter(&buf)
+
+	// 並行に書き込んでも行が混ざらない
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			writer.Write(NewFileReport(fmt.Sprintf("<%d>.png", i), "out.png", nil, fmt.Errorf("error %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	writer.Write(NewBatchSummary().Report())
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 21 {
+		t.Fatalf("len(lines) = %d; want 21", len(lines))
+	}
+	for i, line := range lines {
+		var head struct {
+			Type string `json:"type"`
+			Src  string `json:"src"`
+		}
+		if err := json.Unmarshal([]byte(line), &head); err != nil {
+			t.Fatalf("line %d: json.Unmarshal() = %v; want nil", i, err)
+		}
+		expectType := ReportTypeFile
+		if i == len(lines)-1 {
+			expectType = ReportTypeSummary
+		}
+		if head.Type != expectType {
+			t.Errorf("line %d type = %q; want %q", i, head.Type, expectType)
+		}
+		// HTMLのエスケープはしない
+		if head.Type == ReportTypeFile && !strings.Contains(line, `"src":"<`) {
+			t.Errorf("line %d = %s; want unescaped src", i, line)
+		}
+	}
+}
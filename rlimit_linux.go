@@ -0,0 +1,27 @@
+//go:build linux
+
+package png
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// rlimit64 はprlimit64(2)に渡すリソースの上限です。
+type rlimit64 struct {
+	cur uint64
+	max uint64
+}
+
+// limitProcessMemory は、pidのプロセスのデータセグメントの上限（RLIMIT_DATA）をnバイトにします。
+// RLIMIT_DATAはヒープとmmapで確保した書き込み可能な匿名メモリを含むため、
+// libimagequantがCやRustで確保するメモリも制限されます。
+// アドレス空間の予約（PROT_NONE）は含まないため、Goランタイムの予約には影響しません。
+func limitProcessMemory(pid int, n uint64) error {
+	limit := rlimit64{cur: n, max: n}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), syscall.RLIMIT_DATA, uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package png
+
+// limitProcessMemory はprlimitがないプラットフォームでは何もしません。
+func limitProcessMemory(pid int, n uint64) error {
+	return nil
+}
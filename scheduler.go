@@ -0,0 +1,169 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"sync"
+)
+
+// Scheduler は、推定したピークメモリの合計が予算を超えないようにジョブの実行を制限します。
+// ジョブ数を固定する方法と異なり、巨大な画像は少数ずつ、小さな画像は多数を同時に実行できます。
+//
+// 予算に収まるジョブはすぐに実行するため、大きな画像が空きを待っている間も小さな画像は先に処理されます。
+// ただし、待機している先頭のジョブがMaxBypass回追い越された後は、後から来たジョブも待機させて
+// 先頭のジョブのために予算を空けるため、大きな画像が追い越され続けることはありません。
+// 予算より大きなジョブは、他に実行中のジョブがなくなった時点で単独で実行します。
+//
+// Optimizer.Schedulerに設定すると、OptimizerはPNGのIHDRからピークメモリを推定し、
+// デコードの前に予算を確保します。1つのSchedulerを複数のOptimizerやゴルーチンで共有できます。
+type Scheduler struct {
+	// MaxBypass は、待機している先頭のジョブを後から来たジョブが追い越せる回数です。
+	// 0の場合はDefaultSchedulerMaxBypass、負の場合は追い越しを許可せず到着した順に実行します。
+	// Acquireを呼び出す前に設定してください。
+	MaxBypass int
+
+	budget  int64
+	mu      sync.Mutex
+	used    int64
+	running int
+	waiters []*schedulerWaiter
+}
+
+// DefaultSchedulerMaxBypass は、Scheduler.MaxBypassが0の場合に待機中のジョブを追い越せる回数です。
+const DefaultSchedulerMaxBypass = 8
+
+// schedulerWaiter は予算の空きを待っているジョブです。確保できた時点でreadyを閉じます。
+// bypassedは後から来たジョブに追い越された回数です。
+type schedulerWaiter struct {
+	memory   int64
+	bypassed int
+	ready    chan struct{}
+}
+
+// NewScheduler は、ピークメモリの合計がbudgetバイトまでのジョブを同時に実行するSchedulerを作成します。
+func NewScheduler(budget int64) *Scheduler {
+	return &Scheduler{budget: budget}
+}
+
+// Budget はメモリの予算（バイト数）を返します。
+func (s *Scheduler) Budget() int64 {
+	return s.budget
+}
+
+// InUse は実行中のジョブに割り当てているメモリの合計（バイト数）を返します。
+func (s *Scheduler) InUse() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Acquire は、memoryバイトが予算に収まるまで待機してから確保します。
+// 待機しているジョブがあっても、予算に収まり、先頭のジョブの追い越しがMaxBypass回に
+// 達していなければ追い越して開始します。
+// 確保したメモリはジョブの終了後にReleaseで同じ値を指定して解放してください。
+func (s *Scheduler) Acquire(memory int64) {
+	s.mu.Lock()
+	if s.fits(memory) && !s.reserved() {
+		s.bypass(len(s.waiters))
+		s.used += memory
+		s.running++
+		s.mu.Unlock()
+		return
+	}
+	w := &schedulerWaiter{memory: memory, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+	<-w.ready
+}
+
+// Release はAcquireで確保したメモリを解放し、待機中のジョブを予算に収まる限り再開します。
+// 先頭のジョブから順に確認し、収まらないジョブは追い越しの上限に達するまで後のジョブに追い越されます。
+func (s *Scheduler) Release(memory int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= memory
+	s.running--
+
+	for i := 0; i < len(s.waiters); {
+		if i > 0 && s.reserved() {
+			break
+		}
+		w := s.waiters[i]
+		if !s.fits(w.memory) {
+			i++
+			continue
+		}
+		s.bypass(i)
+		s.waiters = slices.Delete(s.waiters, i, i+1)
+		s.used += w.memory
+		s.running++
+		close(w.ready)
+	}
+}
+
+// reserved は、待機している先頭のジョブが追い越しの上限に達し、予算を先頭のジョブのために空けているかを返します。
+func (s *Scheduler) reserved() bool {
+	if len(s.waiters) == 0 {
+		return false
+	}
+	maxBypass := s.MaxBypass
+	if maxBypass == 0 {
+		maxBypass = DefaultSchedulerMaxBypass
+	}
+	return s.waiters[0].bypassed >= max(maxBypass, 0)
+}
+
+// bypass は、待機しているジョブのうち先頭からn個が追い越されたことを記録します。
+func (s *Scheduler) bypass(n int) {
+	for _, w := range s.waiters[:n] {
+		w.bypassed++
+	}
+}
+
+// fits は、memoryバイトのジョブを今すぐ開始できるかを判定します。
+// 実行中のジョブがない場合は、予算を超えるジョブも開始できます。
+func (s *Scheduler) fits(memory int64) bool {
+	return s.running == 0 || s.used+memory <= s.budget
+}
+
+// EstimatePeakMemory は、PNGをデコードせずにIHDRの宣言から最適化のピークメモリ（バイト数）を推定します。
+//
+// 推定値は、展開したIDATのデータ、デコードした画像と減色用のRGBAの画像、最適化の前後で画質を
+// 比較するための2枚の画像、減色後のインデックスの画像、およびファイルのデータのコピーの合計です。
+// libimagequantの内部のバッファやGoのガベージコレクションの余裕は含まないため、予算には余裕を持たせてください。
+//
+// IHDRを読み取れない場合はファイルのデータのコピーだけを見積もります。
+func EstimatePeakMemory(data []byte) int64 {
+	copies := int64(len(data)) * 4
+	header := readHeader(data)
+	if header == nil {
+		return copies
+	}
+
+	pixels := int64(header.Width) * int64(header.Height)
+	decoded := pixels * 4
+	if header.BitDepth == 16 {
+		decoded = pixels * 8
+	}
+	quantize := pixels*4 + pixels*4 // 減色用のRGBAとlibimagequantの作業用の画像
+	compare := pixels * 8 * 2       // 画質の比較に使うNRGBA64の2枚の画像
+	indexed := pixels * 2           // 減色後のインデックスとパレット画像
+	return header.rawDataSize() + decoded + quantize + compare + indexed + copies
+}
+
+// readHeader は先頭のIHDRチャンクを解析します。PNGでない場合やIHDRが不正な場合はnilを返します。
+func readHeader(data []byte) *pngHeader {
+	offset := len(pngSignature)
+	if len(data) < offset+8+13 || !bytes.Equal(data[:offset], pngSignature) {
+		return nil
+	}
+	if binary.BigEndian.Uint32(data[offset:offset+4]) != 13 || string(data[offset+4:offset+8]) != "IHDR" {
+		return nil
+	}
+	header, err := parseIHDR(data[offset+8 : offset+8+13])
+	if err != nil {
+		return nil
+	}
+	return header
+}
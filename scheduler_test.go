@@ -0,0 +1,209 @@
+package png
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEstimatePeakMemory(t *testing.T) {
+	rgba, err := os.ReadFile("testdata/variations/colortype_rgba.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	depth16, err := os.ReadFile("testdata/variations/depth_16bit.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+
+	// 100x100のRGBA（8ビット）: 展開後 100*(1+400) + デコード 40000 + 減色 80000 + 比較 160000 + インデックス 20000
+	small := setIHDRSize(t, rgba, 100, 100)
+	bomb := setIHDRSize(t, rgba, 30000, 30000)
+
+	cases := []struct {
+		name   string
+		data   []byte
+		expect int64
+	}{
+		{"RGBA 100x100", small, 340100 + int64(len(small))*4},
+		{"RGBA 30000x30000", bomb, 30000*(1+120000) + 900000000*30 + int64(len(bomb))*4},
+		{"16ビット 100x100", setIHDRSize(t, depth16, 100, 100), 100*(1+800) + 80000 + 80000 + 160000 + 20000 + int64(len(depth16))*4},
+		{"PNGでないデータ", []byte("not a png"), 9 * 4},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := EstimatePeakMemory(tc.data); actual != tc.expect {
+				t.Errorf("EstimatePeakMemory() = %d; want %d", actual, tc.expect)
+			}
+		})
+	}
+}
+
+// acquireAsync はAcquireを別のゴルーチンで呼び出し、確保できた時点で閉じるチャネルを返します。
+func acquireAsync(s *Scheduler, memory int64) <-chan struct{} {
+	acquired := make(chan struct{})
+	go func() {
+		s.Acquire(memory)
+		close(acquired)
+	}()
+	return acquired
+}
+
+// expectAcquired は確保できたかどうかを確認します。
+func expectAcquired(t *testing.T, name string, acquired <-chan struct{}, expect bool) {
+	t.Helper()
+	timeout := 50 * time.Millisecond
+	if expect {
+		timeout = time.Second
+	}
+	select {
+	case <-acquired:
+		if !expect {
+			t.Fatalf("%s acquired; want waiting", name)
+		}
+	case <-time.After(timeout):
+		if expect {
+			t.Fatalf("%s is waiting; want acquired", name)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler(100)
+
+	s.Acquire(80)
+	big := acquireAsync(s, 80)
+	expectAcquired(t, "2つ目の大きなジョブ", big, false)
+
+	// 大きなジョブが待機していても、予算に収まる小さなジョブは実行できる
+	small := acquireAsync(s, 10)
+	expectAcquired(t, "小さなジョブ", small, true)
+	if s.InUse() != 90 {
+		t.Errorf("InUse() = %d; want 90", s.InUse())
+	}
+
+	s.Release(80)
+	expectAcquired(t, "2つ目の大きなジョブ", big, true)
+	s.Release(10)
+	s.Release(80)
+
+	// 予算を超えるジョブは他のジョブがなくなってから単独で実行する
+	s.Acquire(10)
+	oversized := acquireAsync(s, 1000)
+	expectAcquired(t, "予算を超えるジョブ", oversized, false)
+	s.Release(10)
+	expectAcquired(t, "予算を超えるジョブ", oversized, true)
+	s.Release(1000)
+
+	if s.InUse() != 0 {
+		t.Errorf("InUse() = %d; want 0", s.InUse())
+	}
+}
+
+func TestScheduler_MaxBypass(t *testing.T) {
+	s := NewScheduler(100)
+	s.MaxBypass = 2
+
+	s.Acquire(80)
+	big := acquireAsync(s, 80)
+	expectAcquired(t, "2つ目の大きなジョブ", big, false)
+
+	// 上限の回数までは小さなジョブが大きなジョブを追い越す
+	for i := 0; i < 2; i++ {
+		expectAcquired(t, fmt.Sprintf("%dつ目の小さなジョブ", i+1), acquireAsync(s, 5), true)
+	}
+
+	// 上限に達した後は、予算に収まる小さなジョブも大きなジョブのために待機する
+	small := acquireAsync(s, 5)
+	expectAcquired(t, "3つ目の小さなジョブ", small, false)
+	if s.InUse() != 90 {
+		t.Errorf("InUse() = %d; want 90", s.InUse())
+	}
+
+	// 予算が空くと大きなジョブが先に開始し、続けて待機していた小さなジョブが開始する
+	s.Release(80)
+	expectAcquired(t, "2つ目の大きなジョブ", big, true)
+	expectAcquired(t, "3つ目の小さなジョブ", small, true)
+	if s.InUse() != 95 {
+		t.Errorf("InUse() = %d; want 95", s.InUse())
+	}
+}
+
+func TestScheduler_Starvation(t *testing.T) {
+	s := NewScheduler(100)
+
+	// 常にいずれかが実行中になるように、小さなジョブを途切れなく実行し続ける
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Acquire(30)
+				time.Sleep(time.Millisecond)
+				s.Release(30)
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// 大きなジョブは小さなジョブに追い越され続けずに実行できる
+	big := acquireAsync(s, 80)
+	expectAcquired(t, "大きなジョブ", big, true)
+	s.Release(80)
+}
+
+func TestOptimize_Scheduler(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	src := "testdata/optimize/psnr-will-50.png"
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+
+	// 予算が1ジョブ分に満たないため、ジョブは1つずつ実行される
+	scheduler := NewScheduler(1)
+	optimizer := NewOptimizer("")
+	optimizer.Scheduler = scheduler
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			output, err := optimizer.Run(src, filepath.Join(tempDir, fmt.Sprintf("out-%d.png", i)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if output.PeakMemoryEstimate != EstimatePeakMemory(data) {
+				errs <- fmt.Errorf("PeakMemoryEstimate = %d; want %d", output.PeakMemoryEstimate, EstimatePeakMemory(data))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if scheduler.InUse() != 0 {
+		t.Errorf("InUse() = %d; want 0 after all runs", scheduler.InUse())
+	}
+}
@@ -0,0 +1,141 @@
+package png
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"image/png"
+	"strings"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for signature.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"failed to decode PNG for pixel hash: %v": "ピクセルハッシュ計算のためのPNGデコードに失敗しました: %v",
+	})
+}
+
+// 署名の検証のエラーです。いずれもDataErrorで、CodeOfで対応するコードを取得できます。
+var (
+	// ErrCommentNotFound はLightFileコメントが存在しないことを示します（CodeCommentNotFound）
+	ErrCommentNotFound error = NewDataErrorCodef(CodeCommentNotFound, "lightfile comment not found")
+	// ErrCommentNotSigned はLightFileコメントに署名がないことを示します（CodeCommentNotSigned）
+	ErrCommentNotSigned error = NewDataErrorCodef(CodeCommentNotSigned, "lightfile comment is not signed")
+	// ErrSignatureMismatch はLightFileコメントの署名が一致しないことを示します（CodeSignatureMismatch）
+	ErrSignatureMismatch error = NewDataErrorCodef(CodeSignatureMismatch, "lightfile comment signature mismatch")
+)
+
+// pixelHash はPNGをデコードしたピクセルデータのSHA-256ハッシュを返します。
+// チャンクの構成やコメントの有無に関係なく、同じピクセルであれば同じ値になります。
+func pixelHash(data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, NewDataErrorCodef(decodeErrorCode(err), l10n.T("failed to decode PNG for pixel hash: %v"), err)
+	}
+
+	bounds := img.Bounds()
+	nrgba := toNRGBA64(img)
+
+	h := sha256.New()
+	var size [8]byte
+	binary.BigEndian.PutUint32(size[0:4], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(size[4:8], uint32(bounds.Dy()))
+	h.Write(size[:])
+	h.Write(nrgba.Pix)
+	return h.Sum(nil), nil
+}
+
+// signatureMember は、保存されたコメントのJSONの末尾にある署名のメンバーです。
+// 署名は常にJSONの最後のメンバーとして保存されます（LightFileComment.Signatureは最後のフィールドです）。
+func signatureMember(signature string) string {
+	return `,"sig":"` + signature + `"}`
+}
+
+// unsignedCommentText は、保存されたコメントのテキストから署名のメンバーを取り除いたものを返します。
+// 署名がテキストの最後のメンバーでない場合はfalseを返します。
+func unsignedCommentText(raw string, signature string) (string, bool) {
+	member := signatureMember(signature)
+	if !strings.HasSuffix(raw, member) {
+		return "", false
+	}
+	return raw[:len(raw)-len(member)] + "}", true
+}
+
+// commentSignature は、ピクセルハッシュと署名を除いたコメントのテキストに対する
+// HMAC-SHA256を16進文字列で返します。
+func commentSignature(unsigned []byte, pixels []byte, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(pixels)
+	mac.Write(unsigned)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignComment は、PNGデータのピクセルとコメントの内容に対する鍵付き署名を
+// comment.Signatureに設定します。
+// dataはコメントを埋め込む前後どちらのPNGデータでも構いません（ピクセルが同じであれば署名も同じです）。
+//
+// 署名の対象は、署名のないコメントをJSONにしたテキストそのものです。
+// 検証では保存されたテキストから末尾の署名のメンバーを取り除いて比較するため、
+// 新しいバージョンが追加したフィールドを含むコメントも古いバージョンで検証できます。
+func SignComment(data []byte, comment *LightFileComment, key []byte) error {
+	pixels, err := pixelHash(data)
+	if err != nil {
+		return err
+	}
+
+	unsigned := *comment
+	unsigned.Signature = ""
+	text, err := json.Marshal(&unsigned)
+	if err != nil {
+		return NewDataErrorCodef(CodeCommentFailed, l10n.T("failed to marshal comment to JSON: %v"), err)
+	}
+	comment.Signature = commentSignature(text, pixels, key)
+	return nil
+}
+
+// VerifyComment は、PNGデータに埋め込まれたLightFileコメントの署名を検証します。
+// 検証に成功した場合はコメントを返します。
+// コメントがない場合はErrCommentNotFound、署名がない場合はErrCommentNotSigned、
+// 署名が一致しない場合はErrSignatureMismatchを返します。
+func VerifyComment(data []byte, key []byte) (*LightFileComment, error) {
+	comment, raw, err := ReadComment(data)
+	if err != nil {
+		return nil, err
+	}
+	if comment == nil {
+		return nil, ErrCommentNotFound
+	}
+
+	if err := verifyCommentSignature(data, comment, raw, key); err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+// verifyCommentSignature は、読み込み済みのコメントの署名を、保存されたテキストrawと
+// PNGデータのピクセルに対して検証します。
+func verifyCommentSignature(data []byte, comment *LightFileComment, raw string, key []byte) error {
+	if comment.Signature == "" {
+		return ErrCommentNotSigned
+	}
+	unsigned, ok := unsignedCommentText(raw, comment.Signature)
+	if !ok {
+		return ErrSignatureMismatch
+	}
+
+	pixels, err := pixelHash(data)
+	if err != nil {
+		return err
+	}
+
+	expected := commentSignature([]byte(unsigned), pixels, key)
+	if !hmac.Equal([]byte(expected), []byte(comment.Signature)) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
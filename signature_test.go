@@ -0,0 +1,147 @@
+package png
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignAndVerifyComment(t *testing.T) {
+	key := []byte("secret key")
+
+	data, err := os.ReadFile("testdata/variations/colortype_rgb.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	other, err := os.ReadFile("testdata/variations/colortype_rgba.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+
+	comment := &LightFileComment{
+		Schema: CommentSchemaVersion,
+		By:     "LightFile",
+		Before: 2048,
+		After:  1024,
+		PSNR:   45,
+	}
+	if err := SignComment(data, comment, key); err != nil {
+		t.Fatalf("SignComment() = %v; want nil", err)
+	}
+	if comment.Signature == "" {
+		t.Fatal("Signature should be set")
+	}
+
+	signed, err := defaultPNGMetaManager.WriteComment(data, comment)
+	if err != nil {
+		t.Fatalf("WriteComment() = %v; want nil", err)
+	}
+
+	unsigned := *comment
+	unsigned.Signature = ""
+	unsignedData, err := defaultPNGMetaManager.WriteComment(data, &unsigned)
+	if err != nil {
+		t.Fatalf("WriteComment() = %v; want nil", err)
+	}
+
+	tampered := *comment
+	tampered.After = 1
+	tamperedData, err := defaultPNGMetaManager.WriteComment(data, &tampered)
+	if err != nil {
+		t.Fatalf("WriteComment() = %v; want nil", err)
+	}
+
+	// 他の画像に署名付きコメントを貼り付けたもの
+	pasted, err := defaultPNGMetaManager.WriteComment(other, comment)
+	if err != nil {
+		t.Fatalf("WriteComment() = %v; want nil", err)
+	}
+
+	// 新しいバージョンが未知のフィールドを追加して署名したもの
+	pixels, err := pixelHash(data)
+	if err != nil {
+		t.Fatalf("pixelHash() = %v; want nil", err)
+	}
+	futureText := `{"schema":3,"by":"LightFile","before":2048,"after":1024,"pngquant":false,"psnr":45,"future":{"x":1}}`
+	futureSigned := futureText[:len(futureText)-1] + signatureMember(commentSignature([]byte(futureText), pixels, key))
+	future, err := defaultPNGMetaManager.WriteCommentString(data, futureSigned)
+	if err != nil {
+		t.Fatalf("WriteCommentString() = %v; want nil", err)
+	}
+
+	cases := []struct {
+		name      string
+		data      []byte
+		key       []byte
+		expectErr error
+	}{
+		{"正しい署名", signed, key, nil},
+		{"未知のフィールド", future, key, nil},
+		{"異なる鍵", signed, []byte("other key"), ErrSignatureMismatch},
+		{"コメントなし", data, key, ErrCommentNotFound},
+		{"署名なし", unsignedData, key, ErrCommentNotSigned},
+		{"フィールドの改ざん", tamperedData, key, ErrSignatureMismatch},
+		{"別画像への貼り付け", pasted, key, ErrSignatureMismatch},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			verified, err := VerifyComment(tc.data, tc.key)
+			if !errors.Is(err, tc.expectErr) {
+				t.Fatalf("VerifyComment() = %v; want %v", err, tc.expectErr)
+			}
+			if tc.expectErr == nil && (verified == nil || verified.After != comment.After) {
+				t.Errorf("VerifyComment() returned %+v; want %+v", verified, comment)
+			}
+		})
+	}
+}
+
+func TestOptimize_SigningKey(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	key := []byte("secret key")
+	srcPath := "testdata/optimize/psnr-will-50.png"
+
+	signer := NewOptimizer("")
+	signer.SigningKey = key
+
+	// 鍵を設定した場合、出力のコメントには署名が付く
+	signedPath := filepath.Join(tempDir, "signed.png")
+	if _, err := signer.Run(srcPath, signedPath); err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	data, err := os.ReadFile(signedPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	if _, err := VerifyComment(data, key); err != nil {
+		t.Errorf("VerifyComment(output) = %v; want nil", err)
+	}
+
+	// 署名付きの出力は最適化済みとしてスキップされる
+	result, err := signer.Run(signedPath, filepath.Join(tempDir, "again.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if !result.AlreadyOptimized {
+		t.Error("Signed output should be treated as already optimized")
+	}
+
+	// 署名のないコメントは信頼されない
+	unsignedPath := filepath.Join(tempDir, "unsigned.png")
+	if _, err := NewOptimizer("").Run(srcPath, unsignedPath); err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	result, err = signer.Run(unsignedPath, filepath.Join(tempDir, "resigned.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if result.AlreadyOptimized {
+		t.Error("Unsigned comment should not be trusted")
+	}
+	if !result.UntrustedComment {
+		t.Error("UntrustedComment should be true")
+	}
+}
@@ -0,0 +1,215 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for subprocess.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"frame of %d bytes exceeds limit %d":     "フレームのサイズ %d バイトが上限 %d を超えています",
+		"failed to start quantize process: %w":   "減色プロセスの起動に失敗しました: %w",
+		"quantize process failed: %v: %s":        "減色プロセスが異常終了しました: %v: %s",
+		"invalid response from quantize process": "減色プロセスからの応答が不正です",
+	})
+}
+
+// maxFrameSize は子プロセスとの間で受け渡す1フレームの上限サイズです。
+const maxFrameSize = 1 << 30
+
+// maxStderrSize はエラーメッセージに含める子プロセスの標準エラー出力の上限サイズです。
+const maxStderrSize = 4096
+
+// quantizeResponse は子プロセスが返す減色結果のヘッダです。
+// ヘッダの後に減色後のPNGデータのフレームが続きます。
+type quantizeResponse struct {
+	Quantized bool      `json:"quantized"`
+	Error     string    `json:"error,omitempty"`
+	Code      ErrorCode `json:"code,omitempty"`
+	LiqCode   int       `json:"liqCode,omitempty"`
+	Stack     string    `json:"stack,omitempty"`
+}
+
+// writeFrame は4バイトのビッグエンディアンの長さに続けてpayloadを書き込みます。
+func writeFrame(w io.Writer, payload []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(payload)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame はwriteFrameで書き込まれた1フレームを読み込みます。
+// 長さがmaxFrameSizeを超える場合はCodeLimitExceededのDataErrorを返します。
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxFrameSize {
+		return nil, NewDataErrorCodef(CodeLimitExceeded, l10n.T("frame of %d bytes exceeds limit %d"), size, maxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// ServeQuantize は、減色を子プロセスで行うためのエントリポイントです。
+// rからフレーム化されたPNGデータを1件読み込んでPNGQuantを実行し、結果をwに書き込みます。
+// Optimizer.QuantizeCommandに指定するコマンドは、標準入出力を渡してこの関数を呼び出してください。
+//
+// 例:
+//
+//	if len(os.Args) > 1 && os.Args[1] == "quantize" {
+//	    if err := png.ServeQuantize(os.Stdin, os.Stdout); err != nil {
+//	        os.Exit(1)
+//	    }
+//	    os.Exit(0)
+//	}
+//
+// PNGQuantのエラーやGoのパニックは応答として返します。
+// libimagequant内でのクラッシュなど、応答を返せない異常終了は親プロセスでエラーになります。
+func ServeQuantize(r io.Reader, w io.Writer) error {
+	data, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+
+	return writeQuantizeResponse(w, data)
+}
+
+// writeQuantizeResponse はdataに対してPNGQuantを実行し、応答のヘッダと結果のフレームを書き込みます。
+func writeQuantizeResponse(w io.Writer, data []byte) error {
+	quantized, response := quantizeResponding(data)
+	header, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(w, header); err != nil {
+		return err
+	}
+	return writeFrame(w, quantized)
+}
+
+// quantizeResponding はPNGQuantを実行し、結果を応答の形にします。パニックはエラーとして返します。
+func quantizeResponding(data []byte) (quantized []byte, response quantizeResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := newPanicError(StagePNGQuant, r)
+			quantized = nil
+			response = quantizeResponse{Error: err.Error(), Code: CodePanic, Stack: string(err.Stack())}
+		}
+	}()
+
+	quantized, wasQuantized, err := PNGQuant(data)
+	response.Quantized = wasQuantized
+	if err == nil {
+		if !wasQuantized {
+			// インデックスカラーの画像は入力を送り返す必要がない
+			return nil, response
+		}
+		return quantized, response
+	}
+
+	var quantizeErr *QuantizeError
+	if errors.As(err, &quantizeErr) {
+		response.LiqCode = quantizeErr.Code
+	}
+	response.Error = err.Error()
+	response.Code = CodeOf(err)
+	return nil, response
+}
+
+// quantizeError は子プロセスの応答からPNGQuantと同じ種類のエラーを復元します。
+func (r *quantizeResponse) quantizeError() error {
+	if r.LiqCode != 0 {
+		return &QuantizeError{Code: r.LiqCode}
+	}
+	if r.Error == "" {
+		return nil
+	}
+	err := NewDataErrorCodef(r.Code, "%s", r.Error)
+	if r.Stack != "" {
+		err.stack = []byte(r.Stack)
+	}
+	return err
+}
+
+// quantizeSubprocess は、commandを子プロセスとして起動してPNGQuantを実行します。
+// 戻り値はPNGQuantと同じです。子プロセスが応答を返さずに終了した場合は
+// コードがCodeWorkerCrashedの、起動できない場合はCodeIOのSystemErrorを返します。
+func quantizeSubprocess(command []string, data []byte) ([]byte, bool, error) {
+	var request bytes.Buffer
+	if err := writeFrame(&request, data); err != nil {
+		return nil, false, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = &request
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, false, NewSystemErrorf(CodeIO, l10n.T("failed to start quantize process: %w"), err)
+		}
+		return nil, false, NewSystemErrorf(CodeWorkerCrashed, l10n.T("quantize process failed: %v: %s"), err, tail(stderr.Bytes(), maxStderrSize))
+	}
+
+	response, quantized, err := readQuantizeResponse(&stdout)
+	if err != nil {
+		return nil, false, NewDataErrorCodef(CodeQuantizeFailed, l10n.T("invalid response from quantize process"))
+	}
+	return response.result(data, quantized)
+}
+
+// readQuantizeResponse は子プロセスの応答のヘッダと結果のフレームを読み込みます。
+func readQuantizeResponse(r io.Reader) (*quantizeResponse, []byte, error) {
+	header, err := readFrame(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var response quantizeResponse
+	if err := json.Unmarshal(header, &response); err != nil {
+		return nil, nil, err
+	}
+	quantized, err := readFrame(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &response, quantized, nil
+}
+
+// result は応答をPNGQuantと同じ戻り値に変換します。dataは子プロセスに渡した入力です。
+func (r *quantizeResponse) result(data, quantized []byte) ([]byte, bool, error) {
+	if err := r.quantizeError(); err != nil {
+		return nil, false, err
+	}
+	if !r.Quantized {
+		// インデックスカラーの画像はPNGQuantと同じく入力をそのまま返す
+		return data, false, nil
+	}
+	return quantized, true, nil
+}
+
+// tail はdataの末尾のmaxバイトを文字列で返します。
+func tail(data []byte, max int) string {
+	if len(data) > max {
+		data = data[len(data)-max:]
+	}
+	return string(bytes.TrimSpace(data))
+}
@@ -0,0 +1,179 @@
+package png
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain は、テストのバイナリを減色の子プロセスとしても使えるようにします。
+// 最後の引数が quantize-helper の場合はServeQuantizeを、worker-helper の場合はServeWorkerを実行し、
+// crash-helper の場合はlibimagequant内でのクラッシュを模して応答せずに異常終了します。
+// faulty-worker-helper はジョブの内容に応じて異常を起こすワーカーです（serveFaultyWorkerを参照）。
+func TestMain(m *testing.M) {
+	switch os.Args[len(os.Args)-1] {
+	case "quantize-helper":
+		if err := ServeQuantize(os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "worker-helper":
+		if err := ServeWorker(os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "faulty-worker-helper":
+		if err := serveFaultyWorker(os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "crash-helper":
+		io.Copy(io.Discard, os.Stdin)
+		os.Stderr.WriteString("SIGSEGV: segmentation violation\n")
+		os.Exit(2)
+	}
+	os.Exit(m.Run())
+}
+
+// helperCommand はテストのバイナリを子プロセスとして起動するコマンドを返します。
+func helperCommand(mode string) []string {
+	return []string{os.Args[0], "-test.run=^$", mode}
+}
+
+func TestReadFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("payload")); err != nil {
+		t.Fatalf("writeFrame() = %v; want nil", err)
+	}
+	if payload, err := readFrame(&buf); err != nil || string(payload) != "payload" {
+		t.Errorf("readFrame() = %q, %v; want payload", payload, err)
+	}
+
+	// 上限を超える長さのフレーム
+	oversize := []byte{0xff, 0xff, 0xff, 0xff}
+	if _, err := readFrame(bytes.NewReader(oversize)); AsDataError(err) == nil || CodeOf(err) != CodeLimitExceeded {
+		t.Errorf("readFrame(oversize) = %v; want DataError with code %s", err, CodeLimitExceeded)
+	}
+}
+
+func TestQuantizeSubprocess(t *testing.T) {
+	cases := []struct {
+		name           string
+		file           string
+		command        []string
+		expectCode     ErrorCode
+		expectSystem   bool
+		expectQuantize bool
+	}{
+		{"通常ファイル", "testdata/binding/psnr-will-50.png", helperCommand("quantize-helper"), CodeUnknown, false, true},
+		{"インデックスカラー", "testdata/variations/colortype_palette.png", helperCommand("quantize-helper"), CodeUnknown, false, false},
+		{"実態がJPEGのファイル", "testdata/binding/jpeg.png", helperCommand("quantize-helper"), CodeInvalidSignature, false, false},
+		{"子プロセスのクラッシュ", "testdata/binding/psnr-will-50.png", helperCommand("crash-helper"), CodeWorkerCrashed, true, false},
+		{"起動できないコマンド", "testdata/binding/psnr-will-50.png", []string{filepath.Join(t.TempDir(), "missing")}, CodeIO, true, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+			expectedData, expectedQuantized, expectedErr := PNGQuant(data)
+
+			actualData, quantized, err := quantizeSubprocess(tc.command, data)
+			if tc.expectCode != CodeUnknown {
+				if CodeOf(err) != tc.expectCode || (AsSystemError(err) != nil) != tc.expectSystem {
+					t.Fatalf("quantizeSubprocess() = %v (%v); want %v", err, CodeOf(err), tc.expectCode)
+				}
+				// 子プロセスで起きたエラーはこのプロセスと同じメッセージになる
+				if tc.expectCode == CodeInvalidSignature && err.Error() != expectedErr.Error() {
+					t.Errorf("Error() = %q; want %q", err.Error(), expectedErr.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("quantizeSubprocess() = %v; want nil", err)
+			}
+			if quantized != tc.expectQuantize || quantized != expectedQuantized {
+				t.Errorf("quantized = %v; want %v", quantized, tc.expectQuantize)
+			}
+			if !bytes.Equal(actualData, expectedData) {
+				t.Errorf("output differs from PNGQuant in this process (%d vs %d bytes)", len(actualData), len(expectedData))
+			}
+		})
+	}
+
+	t.Run("クラッシュ時の標準エラー出力", func(t *testing.T) {
+		_, _, err := quantizeSubprocess(helperCommand("crash-helper"), []byte("data"))
+		if err == nil || !strings.Contains(err.Error(), "SIGSEGV") {
+			t.Errorf("quantizeSubprocess() = %v; want error with stderr", err)
+		}
+	})
+}
+
+func TestOptimize_QuantizeCommand(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	inProcess, err := NewOptimizer("").Run("testdata/optimize/psnr-will-50.png", filepath.Join(tempDir, "in.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+
+	optimizer := NewOptimizer("")
+	optimizer.QuantizeCommand = helperCommand("quantize-helper")
+	output, err := optimizer.Run("testdata/optimize/psnr-will-50.png", filepath.Join(tempDir, "out.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if output.SizeAfterPNGQuant != inProcess.SizeAfterPNGQuant || output.PNGQuant != inProcess.PNGQuant {
+		t.Errorf("Run() = %+v; want same result as in process %+v", output, inProcess)
+	}
+
+	// 子プロセスのクラッシュはこのプロセスには影響せず、SystemErrorとして返る
+	optimizer.QuantizeCommand = helperCommand("crash-helper")
+	_, err = optimizer.Run("testdata/optimize/psnr-will-50.png", filepath.Join(tempDir, "crash.png"))
+	if systemErr := AsSystemError(err); systemErr == nil || systemErr.Code() != CodeWorkerCrashed || systemErr.Stage() != StagePNGQuant {
+		t.Errorf("Run() = %v; want SystemError with CodeWorkerCrashed at %q", err, StagePNGQuant)
+	}
+	if _, statErr := os.Stat(filepath.Join(tempDir, "crash.png")); !os.IsNotExist(statErr) {
+		t.Errorf("os.Stat() = %v; want not exist", statErr)
+	}
+}
+
+// panicLogger は特定のメッセージの出力時にパニックを起こすロガーです
+type panicLogger struct {
+	TestLogger
+	message string
+}
+
+func (l *panicLogger) Debug(format string, args ...interface{}) {
+	if format == l.message {
+		panic("unexpected state")
+	}
+}
+
+func TestOptimize_RecoverPanic(t *testing.T) {
+	t.Parallel()
+
+	optimizer := NewOptimizer("")
+	optimizer.SetLogger(&panicLogger{message: "Stripping metadata"})
+	output, err := optimizer.Run("testdata/optimize/psnr-will-50.png", filepath.Join(t.TempDir(), "out.png"))
+	if output != nil {
+		t.Errorf("Run() output = %+v; want nil", output)
+	}
+
+	dataErr := AsDataError(err)
+	if dataErr == nil || dataErr.Code() != CodePanic || dataErr.Stage() != StageStrip {
+		t.Fatalf("Run() = %v; want DataError with CodePanic at %s", err, StageStrip)
+	}
+	if !strings.Contains(err.Error(), "unexpected state") {
+		t.Errorf("Error() = %q; want panic value", err.Error())
+	}
+	if !bytes.Contains(dataErr.Stack(), []byte("panicLogger")) {
+		t.Errorf("Stack() = %s; want the stack of the panic", dataErr.Stack())
+	}
+}
@@ -0,0 +1,209 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for text.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"text chunk missing keyword separator":         "テキストチャンクにキーワードの区切りがありません",
+		"malformed %s chunk":                           "%sチャンクの形式が不正です",
+		"unsupported compression method in %s chunk":   "%sチャンクの圧縮方式はサポートされていません",
+		"failed to decompress %s chunk: %v":            "%sチャンクの展開に失敗しました: %v",
+		"%s chunk exceeds decompressed size limit: %d": "%sチャンクが展開後のサイズ上限を超えています: %d",
+		"failed to compress text chunk: %v":            "テキストチャンクの圧縮に失敗しました: %v",
+	})
+}
+
+// maxTextDecompressedSize は圧縮されたテキストチャンクを展開する際の上限サイズです。
+const maxTextDecompressedSize = 8 << 20
+
+// isTextChunk はチャンクタイプがテキストチャンク（tEXt、zTXt、iTXt）かどうかを判定します。
+func isTextChunk(chunkType string) bool {
+	return chunkType == "tEXt" || chunkType == "zTXt" || chunkType == "iTXt"
+}
+
+// textChunkKeyword は、テキストチャンクのデータ部からキーワードだけを取り出します。
+// 本文の展開を行わないため、目的のキーワードかどうかの判定に使用します。
+func textChunkKeyword(data []byte) (string, bool) {
+	nullIndex := bytes.IndexByte(data, 0)
+	if nullIndex == -1 {
+		return "", false
+	}
+	return string(data[:nullIndex]), true
+}
+
+// decodeTextChunk は、tEXt、zTXt、iTXtチャンクのデータ部をキーワードと本文に分解します。
+// tEXtとzTXtの本文はLatin-1ですが、互換性のためバイト列をそのまま文字列として返します。
+// 圧縮された本文は展開して返します。
+func decodeTextChunk(chunkType string, data []byte) (string, string, error) {
+	keyword, ok := textChunkKeyword(data)
+	if !ok {
+		return "", "", NewDataErrorCodef(CodeMalformedChunk, l10n.T("text chunk missing keyword separator"))
+	}
+	rest := data[len(keyword)+1:]
+
+	switch chunkType {
+	case "tEXt":
+		return keyword, string(rest), nil
+
+	case "zTXt":
+		if len(rest) < 1 {
+			return "", "", NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		if rest[0] != 0 {
+			return "", "", NewDataErrorCodef(CodeMalformedChunk, l10n.T("unsupported compression method in %s chunk"), chunkType)
+		}
+		text, err := inflateText(chunkType, rest[1:])
+		if err != nil {
+			return "", "", err
+		}
+		return keyword, string(text), nil
+
+	case "iTXt":
+		// compression flag, compression method, language tag\0, translated keyword\0, text
+		if len(rest) < 2 {
+			return "", "", NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+		}
+		compressed := rest[0] == 1
+		if compressed && rest[1] != 0 {
+			return "", "", NewDataErrorCodef(CodeMalformedChunk, l10n.T("unsupported compression method in %s chunk"), chunkType)
+		}
+		rest = rest[2:]
+		for i := 0; i < 2; i++ {
+			nullIndex := bytes.IndexByte(rest, 0)
+			if nullIndex == -1 {
+				return "", "", NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+			}
+			rest = rest[nullIndex+1:]
+		}
+		if !compressed {
+			return keyword, string(rest), nil
+		}
+		text, err := inflateText(chunkType, rest)
+		if err != nil {
+			return "", "", err
+		}
+		return keyword, string(text), nil
+	}
+
+	return "", "", NewDataErrorCodef(CodeMalformedChunk, l10n.T("malformed %s chunk"), chunkType)
+}
+
+// itxtAttributes は、iTXtチャンクのデータ部から圧縮フラグ、言語タグ、翻訳済みキーワードを取り出します。
+// 形式が不正な場合はokにfalseを返します。
+func itxtAttributes(data []byte) (compressed bool, language, translatedKeyword string, ok bool) {
+	keyword, found := textChunkKeyword(data)
+	if !found {
+		return false, "", "", false
+	}
+	rest := data[len(keyword)+1:]
+	if len(rest) < 2 {
+		return false, "", "", false
+	}
+	compressed = rest[0] == 1
+	fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+	if len(fields) < 3 {
+		return false, "", "", false
+	}
+	return compressed, string(fields[0]), string(fields[1]), true
+}
+
+// inflateText はzlibで圧縮されたテキストを展開します。
+func inflateText(chunkType string, data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, NewDataErrorCodef(CodeMalformedChunk, l10n.T("failed to decompress %s chunk: %v"), chunkType, err)
+	}
+	defer zr.Close()
+
+	text, err := io.ReadAll(io.LimitReader(zr, maxTextDecompressedSize+1))
+	if err != nil {
+		return nil, NewDataErrorCodef(CodeMalformedChunk, l10n.T("failed to decompress %s chunk: %v"), chunkType, err)
+	}
+	if len(text) > maxTextDecompressedSize {
+		return nil, NewDataErrorCodef(CodeLimitExceeded, l10n.T("%s chunk exceeds decompressed size limit: %d"), chunkType, maxTextDecompressedSize)
+	}
+	return text, nil
+}
+
+// deflateText はテキストをzlibで圧縮します。
+func deflateText(text string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isASCII は文字列がASCII文字のみで構成されているかを判定します。
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeTextChunk は、キーワードと本文をテキストチャンクとしてエンコードします。
+// tEXt、zTXt、圧縮したiTXt、非圧縮のiTXtのうち、最も小さくなるものを選択します。
+// tEXtとzTXtはLatin-1しか扱えないため、本文がASCII以外の文字を含む場合はiTXtのみが候補になります。
+func encodeTextChunk(keyword, text string) (*pngstructure.Chunk, error) {
+	var candidates []*pngstructure.Chunk
+
+	compressed, err := deflateText(text)
+	if err != nil {
+		return nil, NewDataErrorCodef(CodeEncodeFailed, l10n.T("failed to compress text chunk: %v"), err)
+	}
+
+	if isASCII(text) {
+		textData := make([]byte, 0, len(keyword)+1+len(text))
+		textData = append(textData, keyword...)
+		textData = append(textData, 0)
+		textData = append(textData, text...)
+		candidates = append(candidates, &pngstructure.Chunk{Type: "tEXt", Data: textData})
+
+		ztxtData := make([]byte, 0, len(keyword)+2+len(compressed))
+		ztxtData = append(ztxtData, keyword...)
+		ztxtData = append(ztxtData, 0, 0) // null separator, compression method
+		ztxtData = append(ztxtData, compressed...)
+		candidates = append(candidates, &pngstructure.Chunk{Type: "zTXt", Data: ztxtData})
+	}
+
+	for _, compress := range []bool{true, false} {
+		body := []byte(text)
+		flag := byte(0)
+		if compress {
+			body = compressed
+			flag = 1
+		}
+		itxtData := make([]byte, 0, len(keyword)+5+len(body))
+		itxtData = append(itxtData, keyword...)
+		// null separator, compression flag, compression method, empty language tag, empty translated keyword
+		itxtData = append(itxtData, 0, flag, 0, 0, 0)
+		itxtData = append(itxtData, body...)
+		candidates = append(candidates, &pngstructure.Chunk{Type: "iTXt", Data: itxtData})
+	}
+
+	smallest := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if len(candidate.Data) < len(smallest.Data) {
+			smallest = candidate
+		}
+	}
+	return smallest, nil
+}
@@ -0,0 +1,182 @@
+package png
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	pngstructure "github.com/dsoprea/go-png-image-structure/v2"
+)
+
+// insertChunkBeforeIEND はPNGデータのIENDの直前にチャンクを挿入します
+func insertChunkBeforeIEND(t *testing.T, data []byte, chunk *pngstructure.Chunk) []byte {
+	iend := findChunkOffset(t, data, "IEND")
+	var buf bytes.Buffer
+	buf.Write(data[:iend])
+	if err := writeChunk(&buf, chunk); err != nil {
+		t.Fatalf("writeChunk() = %v; want nil", err)
+	}
+	buf.Write(data[iend:])
+	return buf.Bytes()
+}
+
+// countCommentChunks はLightFileキーワードを持つテキストチャンクの数を返します
+func countCommentChunks(t *testing.T, data []byte) int {
+	mediaContext, err := pngstructure.NewPngMediaParser().ParseBytes(data)
+	if err != nil {
+		t.Fatalf("ParseBytes() = %v; want nil", err)
+	}
+	count := 0
+	for _, chunk := range mediaContext.(*pngstructure.ChunkSlice).Chunks() {
+		if keyword, ok := textChunkKeyword(chunk.Data); ok && isTextChunk(chunk.Type) && keyword == commentKeyword {
+			count++
+		}
+	}
+	return count
+}
+
+func TestEncodeTextChunk(t *testing.T) {
+	cases := []struct {
+		name       string
+		text       string
+		expectType string
+	}{
+		{
+			name:       "短いASCII",
+			text:       "{}",
+			expectType: "tEXt",
+		},
+		{
+			name:       "繰り返しの多いASCII",
+			text:       strings.Repeat(`{"by":"LightFile","before":1000,"after":800}`, 10),
+			expectType: "zTXt",
+		},
+		{
+			name:       "短いUTF-8",
+			text:       `{"by":"軽量化"}`,
+			expectType: "iTXt",
+		},
+		{
+			name:       "繰り返しの多いUTF-8",
+			text:       strings.Repeat(`{"by":"軽量化"}`, 20),
+			expectType: "iTXt",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			chunk, err := encodeTextChunk(commentKeyword, tc.text)
+			if err != nil {
+				t.Fatalf("encodeTextChunk() = %v; want nil", err)
+			}
+			if chunk.Type != tc.expectType {
+				t.Errorf("chunk.Type = %s; want %s", chunk.Type, tc.expectType)
+			}
+
+			keyword, text, err := decodeTextChunk(chunk.Type, chunk.Data)
+			if err != nil {
+				t.Fatalf("decodeTextChunk() = %v; want nil", err)
+			}
+			if keyword != commentKeyword {
+				t.Errorf("keyword = %q; want %q", keyword, commentKeyword)
+			}
+			if text != tc.text {
+				t.Errorf("text = %q; want %q", text, tc.text)
+			}
+		})
+	}
+}
+
+func TestReadComment_AllTextChunkTypes(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/metadata_none.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+
+	jsonText := `{"by":"LightFile","before":2048,"after":1024,"pngquant":true,"psnr":44.5}`
+	compressed, err := deflateText(jsonText)
+	if err != nil {
+		t.Fatalf("deflateText() = %v; want nil", err)
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"tEXt", append([]byte("LightFile\x00"), jsonText...)},
+		{"zTXt", append([]byte("LightFile\x00\x00"), compressed...)},
+		{"iTXt", append([]byte("LightFile\x00\x01\x00ja\x00LightFile\x00"), compressed...)},
+		{"iTXt", append([]byte("LightFile\x00\x00\x00\x00\x00"), jsonText...)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := insertChunkBeforeIEND(t, original, &pngstructure.Chunk{Type: tc.name, Data: tc.data})
+
+			comment, raw, err := ReadComment(data)
+			if err != nil {
+				t.Fatalf("ReadComment() = %v; want nil", err)
+			}
+			if comment == nil {
+				t.Fatal("Expected to read LightFile comment, got nil")
+			}
+			if comment.By != "LightFile" || comment.After != 1024 {
+				t.Errorf("comment = %+v; want By=LightFile After=1024", comment)
+			}
+			if raw != jsonText {
+				t.Errorf("raw = %q; want %q", raw, jsonText)
+			}
+
+			// 既存のコメントは種類に関係なく置き換えられる
+			rewritten, err := WriteComment(data, `{"by":"LightFile","before":1,"after":1}`)
+			if err != nil {
+				t.Fatalf("WriteComment() = %v; want nil", err)
+			}
+			if n := countCommentChunks(t, rewritten); n != 1 {
+				t.Errorf("LightFile comment chunks = %d; want 1", n)
+			}
+			comment, _, err = ReadComment(rewritten)
+			if err != nil {
+				t.Fatalf("ReadComment() = %v; want nil", err)
+			}
+			if comment == nil || comment.Before != 1 {
+				t.Errorf("comment = %+v; want Before=1", comment)
+			}
+		})
+	}
+}
+
+func TestBuildComment_SizeMatchesWrittenChunk(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/metadata_none.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+
+	comment := &LightFileComment{
+		Schema:   CommentSchemaVersion,
+		By:       "LightFile",
+		Version:  Version,
+		Profile:  "medium",
+		Before:   2048,
+		After:    1024,
+		PNGQuant: true,
+		Metric:   "psnr",
+		PSNR:     44.5,
+		Stages:   []string{"strip", "pngquant"},
+	}
+
+	_, increase, err := defaultPNGMetaManager.BuildComment(comment)
+	if err != nil {
+		t.Fatalf("BuildComment() = %v; want nil", err)
+	}
+
+	written, err := defaultPNGMetaManager.WriteComment(original, comment)
+	if err != nil {
+		t.Fatalf("WriteComment() = %v; want nil", err)
+	}
+
+	if len(written)-len(original) != increase {
+		t.Errorf("size increase = %d; want %d", len(written)-len(original), increase)
+	}
+}
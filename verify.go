@@ -0,0 +1,141 @@
+package png
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/ideamans/go-l10n"
+	"github.com/ideamans/go-psnr"
+)
+
+func init() {
+	// Register Japanese translations for verify.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"failed to read written file: %v":                               "書き込んだファイルの読み込みに失敗しました: %v",
+		"invalid structure: %v":                                         "構造が不正です: %v",
+		"%s problem in %s chunk at offset %d":                           "%[2]sチャンク（オフセット %[3]d）に%[1]sの問題があります",
+		"failed to decode: %v":                                          "デコードに失敗しました: %v",
+		"LightFile comment does not round-trip":                         "LightFileコメントが正しく読み戻せません",
+		"failed to calculate PSNR: %v":                                  "PSNRの計算に失敗しました: %v",
+		"PSNR %.4f dB does not match recorded %.4f dB":                  "PSNR %.4f dB が記録された値 %.4f dB と一致しません",
+		"failed to restore previous file after failed verification: %w": "検証の失敗後に元のファイルを復元できませんでした: %w",
+	})
+}
+
+// ErrVerificationFailed は、書き込んだ出力ファイルの検証に失敗したことを示します（CodeVerificationFailed）。
+// 実際のエラーは理由を含む形でこのエラーをラップします。
+var ErrVerificationFailed error = NewDataErrorCodef(CodeVerificationFailed, "output verification failed")
+
+// verifyTolerance はPSNRを比較する際の許容誤差です。
+const verifyTolerance = 1e-6
+
+// previousFile は出力先に元々存在したファイルの内容と属性です。
+type previousFile struct {
+	data []byte
+	info os.FileInfo
+}
+
+// readPreviousFile は、検証に失敗した場合に戻せるよう出力先の現在の内容を読み込みます。
+// 出力先が存在しない場合はnilを返します。
+func readPreviousFile(path string) (*previousFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &previousFile{data: data, info: info}, nil
+}
+
+// restore は出力先を元の内容に戻します。元のファイルがなかった場合は出力先を削除します。
+func (p *previousFile) restore(path string) error {
+	if p == nil {
+		target, err := resolveSymlink(path)
+		if err != nil {
+			return err
+		}
+		return os.Remove(target)
+	}
+	return writeFileAtomic(path, p.data, outputAttributes{mode: p.info.Mode().Perm(), mtime: p.info.ModTime()})
+}
+
+// verifyOutput は書き込まれたPNGデータを検証します。
+// 構造とCRC、デコード、LightFileコメントの読み戻し（commentがnilでない場合）、
+// 元の画像とのPSNRが記録された最終PSNRに一致することを確認します。
+// 問題がある場合はErrVerificationFailedをラップしたエラーを返します。
+func verifyOutput(written, original []byte, comment *LightFileComment, finalPSNR float64) error {
+	_, repairs, err := RepairPNG(written)
+	if err != nil {
+		return verificationError(l10n.T("invalid structure: %v"), err)
+	}
+	if len(repairs) > 0 {
+		return verificationError(l10n.T("%s problem in %s chunk at offset %d"), repairs[0].Kind, repairs[0].Chunk, repairs[0].Offset)
+	}
+
+	if _, err := png.Decode(bytes.NewReader(written)); err != nil {
+		return verificationError(l10n.T("failed to decode: %v"), err)
+	}
+
+	if comment != nil {
+		expected, _, err := defaultPNGMetaManager.BuildComment(comment)
+		if err != nil {
+			return err
+		}
+		_, raw, err := ReadComment(written)
+		if err != nil || raw != expected {
+			return verificationError(l10n.T("LightFile comment does not round-trip"))
+		}
+	}
+
+	value, err := psnr.Compute(original, written)
+	if err != nil {
+		return verificationError(l10n.T("failed to calculate PSNR: %v"), err)
+	}
+	if !psnrMatches(value, finalPSNR) {
+		return verificationError(l10n.T("PSNR %.4f dB does not match recorded %.4f dB"), value, finalPSNR)
+	}
+
+	return nil
+}
+
+// psnrMatches は2つのPSNRが一致するかを判定します。無限大同士は一致とみなします。
+func psnrMatches(a, b float64) bool {
+	if math.IsInf(a, 1) || math.IsInf(b, 1) {
+		return math.IsInf(a, 1) && math.IsInf(b, 1)
+	}
+	return math.Abs(a-b) <= verifyTolerance
+}
+
+// verificationError はErrVerificationFailedを理由とともにラップした、
+// CodeVerificationFailedのDataErrorを返します。
+func verificationError(format string, args ...interface{}) error {
+	return NewDataErrorCodef(CodeVerificationFailed, "%w: %s", ErrVerificationFailed, fmt.Sprintf(format, args...))
+}
+
+// verifyWritten は書き込んだファイルを読み込んで検証し、問題がある場合は出力先を元の状態に戻します。
+func (o *Optimizer) verifyWritten(path string, previous *previousFile, original []byte, comment *LightFileComment, finalPSNR float64) error {
+	written, err := os.ReadFile(path)
+	if err != nil {
+		err = NewSystemErrorf(CodeVerificationFailed, "%w: %s", ErrVerificationFailed, fmt.Sprintf(l10n.T("failed to read written file: %v"), err))
+	} else {
+		err = verifyOutput(written, original, comment, finalPSNR)
+	}
+	if err == nil {
+		return nil
+	}
+
+	o.logWarn("Verification failed, restoring previous file: %v", err)
+	if restoreErr := previous.restore(path); restoreErr != nil {
+		return NewSystemErrorf(CodeIO, l10n.T("failed to restore previous file after failed verification: %w"), errors.Join(err, restoreErr))
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package png
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyOutput(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/metadata_none.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	comment := &LightFileComment{Schema: CommentSchemaVersion, By: "LightFile", Before: 2048, After: 1024}
+	written, err := defaultPNGMetaManager.WriteComment(original, comment)
+	if err != nil {
+		t.Fatalf("WriteComment() = %v; want nil", err)
+	}
+
+	badCRC := bytes.Clone(written)
+	iend := findChunkOffset(t, badCRC, "IEND")
+	badCRC[iend+8] ^= 0xff
+
+	cases := []struct {
+		name        string
+		data        []byte
+		comment     *LightFileComment
+		finalPSNR   float64
+		expectError bool
+	}{
+		{"正常", written, comment, math.Inf(1), false},
+		{"コメントの確認なし", original, nil, math.Inf(1), false},
+		{"CRCの不一致", badCRC, comment, math.Inf(1), true},
+		{"途切れたファイル", written[:len(written)/2], comment, math.Inf(1), true},
+		{"コメントの不一致", written, &LightFileComment{By: "LightFile", Before: 1}, math.Inf(1), true},
+		{"コメントなし", original, comment, math.Inf(1), true},
+		{"PSNRの不一致", written, comment, 40, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyOutput(tc.data, original, tc.comment, tc.finalPSNR)
+			if tc.expectError {
+				if !errors.Is(err, ErrVerificationFailed) || AsDataError(err) == nil || CodeOf(err) != CodeVerificationFailed {
+					t.Errorf("verifyOutput() = %v (%v); want ErrVerificationFailed with code %s", err, CodeOf(err), CodeVerificationFailed)
+				}
+			} else if err != nil {
+				t.Errorf("verifyOutput() = %v; want nil", err)
+			}
+		})
+	}
+}
+
+func TestVerifyWritten_Restore(t *testing.T) {
+	original, err := os.ReadFile("testdata/variations/metadata_none.png")
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v; want nil", err)
+	}
+	optimizer := NewOptimizer("")
+
+	t.Run("元のファイルに戻す", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "a.png")
+		copyTestFile(t, "testdata/variations/metadata_none.png", path, 0644)
+		previous, err := readPreviousFile(path)
+		if err != nil {
+			t.Fatalf("readPreviousFile() = %v; want nil", err)
+		}
+
+		if err := os.WriteFile(path, original[:100], 0600); err != nil {
+			t.Fatalf("os.WriteFile() = %v; want nil", err)
+		}
+		err = optimizer.verifyWritten(path, previous, original, nil, math.Inf(1))
+		if !errors.Is(err, ErrVerificationFailed) {
+			t.Fatalf("verifyWritten() = %v; want ErrVerificationFailed", err)
+		}
+
+		restored, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(restored, original) {
+			t.Errorf("restored file differs from original (err = %v)", err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+			t.Errorf("restored mode = %v, %v; want 0644", info, err)
+		}
+	})
+
+	t.Run("新規ファイルは削除", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "new.png")
+		if err := os.WriteFile(path, original[:100], 0600); err != nil {
+			t.Fatalf("os.WriteFile() = %v; want nil", err)
+		}
+		err := optimizer.verifyWritten(path, nil, original, nil, math.Inf(1))
+		if !errors.Is(err, ErrVerificationFailed) {
+			t.Fatalf("verifyWritten() = %v; want ErrVerificationFailed", err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("os.Stat() = %v; want not exist", err)
+		}
+	})
+}
+
+func TestOptimize_Verify(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	for _, storage := range []MarkerStorage{MarkerEmbedded, MarkerSidecar} {
+		t.Run(storage.String(), func(t *testing.T) {
+			optimizer := NewOptimizer("")
+			optimizer.Verify = true
+			optimizer.MarkerStorage = storage
+			output, err := optimizer.Run("testdata/optimize/psnr-will-50.png", filepath.Join(tempDir, storage.String()+".png"))
+			if err != nil {
+				t.Fatalf("Run() = %v; want nil", err)
+			}
+			if output.CantOptimize || output.InspectionFailed || output.AfterSize == 0 {
+				t.Errorf("Unexpected result: %+v", output)
+			}
+		})
+	}
+}
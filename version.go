@@ -0,0 +1,5 @@
+package png
+
+// Version はこのライブラリのバージョンです。
+// 最適化済みPNGのコメントに記録され、どのバージョンで処理されたかの判別に使用されます。
+const Version = "6.1.0"
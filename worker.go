@@ -0,0 +1,401 @@
+package png
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ideamans/go-l10n"
+)
+
+func init() {
+	// Register Japanese translations for worker.go error messages
+	l10n.Register("ja", l10n.LexiconMap{
+		"quantize process timed out after %v": "減色プロセスが %v 以内に応答しませんでした",
+		"worker pool is closed":               "ワーカープールは終了しています",
+		"invalid worker memory limit %q: %v":  "ワーカーのメモリ上限 %q が不正です: %v",
+
+		// WorkerPool.MemoryLimit
+		"failed to limit memory of quantize process: %w":             "減色プロセスのメモリの制限に失敗しました: %w",
+		"quantize process exceeded memory limit of %d bytes: %v: %s": "減色プロセスがメモリの上限 %d バイトを超えました: %v: %s",
+	})
+}
+
+// workerMemoryLimitEnv は、親プロセスがワーカーにメモリの上限（バイト数）を渡す環境変数です。
+const workerMemoryLimitEnv = "LIGHTFILE_PNG_WORKER_MEMORY_LIMIT"
+
+// WorkerPool は、減色を常駐する子プロセス（ワーカー）で行うためのプールです。
+// Optimizer.QuantizeCommandと異なり、ワーカーは画像ごとに起動せず複数のジョブを処理します。
+// libimagequant内でのクラッシュや応答しないジョブはワーカーだけを終了させ、
+// 次のジョブでは新しいワーカーを起動します。
+//
+// ワーカーは必要になった時点でSize個まで起動します。使い終わったらCloseを呼び出してください。
+// 1つのWorkerPoolを複数のOptimizerやゴルーチンから同時に使用できます。
+type WorkerPool struct {
+	// Command はワーカーのコマンドと引数です。コマンドは標準入出力を渡してServeWorkerを呼び出す必要があります。
+	Command []string
+	// Size は同時に起動するワーカーの最大数です。0以下の場合はCPU数です。
+	Size int
+	// Timeout は1つのジョブの制限時間です。超えた場合はワーカーを終了し、
+	// コードがCodeWorkerTimeoutのSystemErrorを返します。0の場合は制限しません。
+	Timeout time.Duration
+	// MemoryLimit はワーカーのメモリの上限（バイト数）です。0の場合は制限しません。
+	// Linuxでは起動したワーカーのRLIMIT_DATAをprlimitで設定するため、libimagequantが
+	// CやRustで確保するメモリも含めて制限されます。上限を超えてワーカーが終了した場合は
+	// コードがCodeWorkerMemoryLimitのSystemErrorを返します。
+	// ワーカーのGoランタイムにも同じ値をdebug.SetMemoryLimitで設定し、上限の手前でGCを行わせます。
+	// Linux以外ではGoランタイムのソフトな上限のみです。
+	MemoryLimit uint64
+
+	once     sync.Once
+	slots    chan struct{}
+	mu       sync.Mutex
+	idle     []*worker
+	closed   bool
+	restarts atomic.Int64
+}
+
+// NewWorkerPool は、commandをワーカーとして最大size個まで起動するWorkerPoolを作成します。
+func NewWorkerPool(command []string, size int) *WorkerPool {
+	return &WorkerPool{Command: command, Size: size}
+}
+
+// Quantize は空いているワーカーでPNGQuantを実行します。戻り値はPNGQuantと同じです。
+//
+// ワーカーが応答せずに終了した場合はコードがCodeWorkerCrashedの、
+// MemoryLimitを超えて終了した場合はCodeWorkerMemoryLimitの、
+// 制限時間を超えた場合はCodeWorkerTimeoutのSystemErrorを返します。
+// ワーカーを起動できない場合もSystemErrorを返します。
+func (p *WorkerPool) Quantize(data []byte) ([]byte, bool, error) {
+	p.once.Do(func() {
+		size := p.Size
+		if size <= 0 {
+			size = runtime.NumCPU()
+		}
+		p.slots = make(chan struct{}, size)
+	})
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	w, err := p.acquire()
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, quantized, err := w.exchange(data, p.Timeout)
+	if err != nil {
+		// exchangeがワーカーを終了させているので、次のジョブでは新しいワーカーを起動する
+		p.restarts.Add(1)
+		return nil, false, err
+	}
+	p.release(w)
+	return response.result(data, quantized)
+}
+
+// Restarts は、異常終了または制限時間の超過により破棄したワーカーの数を返します。
+// 破棄したワーカーは次のジョブで起動し直します。
+func (p *WorkerPool) Restarts() int {
+	return int(p.restarts.Load())
+}
+
+// Close は待機中のワーカーを終了させます。処理中のワーカーはジョブの完了後に終了します。
+// Close以降のQuantizeはコードがCodeWorkerPoolClosedのSystemErrorを返します。
+func (p *WorkerPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	var errs []error
+	for _, w := range idle {
+		if err := w.stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// acquire は待機中のワーカーを取り出します。待機中のワーカーがなければ新しく起動します。
+func (p *WorkerPool) acquire() (*worker, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, NewSystemErrorf(CodeWorkerPoolClosed, l10n.T("worker pool is closed"))
+	}
+	if n := len(p.idle); n > 0 {
+		w := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return w, nil
+	}
+	p.mu.Unlock()
+
+	return startWorker(p.Command, p.MemoryLimit)
+}
+
+// release はジョブを終えたワーカーを待機中に戻します。プールが終了している場合はワーカーを終了させます。
+func (p *WorkerPool) release(w *worker) {
+	p.mu.Lock()
+	if !p.closed {
+		p.idle = append(p.idle, w)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	w.stop()
+}
+
+// worker は起動中のワーカーの子プロセスです。
+type worker struct {
+	cmd         *exec.Cmd
+	stdin       *os.File
+	stdout      *os.File
+	reader      *bufio.Reader
+	stderr      tailBuffer
+	memoryLimit uint64
+	done        chan struct{}
+	err         error
+}
+
+// startWorker はcommandをワーカーとして起動します。
+func startWorker(command []string, memoryLimit uint64) (*worker, error) {
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, NewSystemErrorf(CodeIO, l10n.T("failed to start quantize process: %w"), err)
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
+		return nil, NewSystemErrorf(CodeIO, l10n.T("failed to start quantize process: %w"), err)
+	}
+
+	w := &worker{
+		stdin:       stdinWriter,
+		stdout:      stdoutReader,
+		reader:      bufio.NewReader(stdoutReader),
+		memoryLimit: memoryLimit,
+		done:        make(chan struct{}),
+	}
+	w.stderr.max = maxStderrSize
+	w.cmd = exec.Command(command[0], command[1:]...)
+	w.cmd.Stdin = stdinReader
+	w.cmd.Stdout = stdoutWriter
+	w.cmd.Stderr = &w.stderr
+	if memoryLimit > 0 {
+		w.cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", workerMemoryLimitEnv, memoryLimit))
+	}
+
+	err = w.cmd.Start()
+	// 子プロセスに渡した側のパイプは親では使わない
+	stdinReader.Close()
+	stdoutWriter.Close()
+	if err != nil {
+		stdinWriter.Close()
+		stdoutReader.Close()
+		return nil, NewSystemErrorf(CodeIO, l10n.T("failed to start quantize process: %w"), err)
+	}
+
+	go func() {
+		w.err = w.cmd.Wait()
+		close(w.done)
+	}()
+
+	// ジョブを送る前に、子プロセスのメモリをOSの上限で制限する
+	if memoryLimit > 0 {
+		if err := limitProcessMemory(w.cmd.Process.Pid, memoryLimit); err != nil {
+			w.kill()
+			return nil, NewSystemErrorf(CodeIO, l10n.T("failed to limit memory of quantize process: %w"), err)
+		}
+	}
+	return w, nil
+}
+
+// exchange はdataをワーカーに送り、応答を受け取ります。
+// エラーを返した場合、ワーカーは使用できない状態です。
+func (w *worker) exchange(data []byte, timeout time.Duration) (*quantizeResponse, []byte, error) {
+	type result struct {
+		response  *quantizeResponse
+		quantized []byte
+		err       error
+	}
+	results := make(chan result, 1)
+	go func() {
+		if err := writeFrame(w.stdin, data); err != nil {
+			results <- result{err: err}
+			return
+		}
+		response, quantized, err := readQuantizeResponse(w.reader)
+		results <- result{response, quantized, err}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case r := <-results:
+		if r.err == nil {
+			return r.response, r.quantized, nil
+		}
+		w.kill()
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if AsDataError(r.err) != nil || errors.As(r.err, &syntaxErr) || errors.As(r.err, &typeErr) {
+			// ワーカーは応答したが、内容を解釈できない
+			return nil, nil, NewDataErrorCodef(CodeQuantizeFailed, l10n.T("invalid response from quantize process"))
+		}
+		stderr := w.stderr.String()
+		if w.memoryLimit > 0 && w.stderr.OutOfMemory() {
+			return nil, nil, NewSystemErrorf(CodeWorkerMemoryLimit, l10n.T("quantize process exceeded memory limit of %d bytes: %v: %s"), w.memoryLimit, w.err, stderr)
+		}
+		return nil, nil, NewSystemErrorf(CodeWorkerCrashed, l10n.T("quantize process failed: %v: %s"), w.err, stderr)
+	case <-expired:
+		w.kill()
+		<-results
+		return nil, nil, NewSystemErrorf(CodeWorkerTimeout, l10n.T("quantize process timed out after %v"), timeout)
+	}
+}
+
+// isOutOfMemory は、ワーカーの標準エラー出力がメモリの確保の失敗を示すかを判定します。
+// Goランタイム（fatal error: runtime: out of memory）とRustのアロケータ
+// （memory allocation of N bytes failed）、Cのstrerror（Cannot allocate memory）のメッセージを対象とします。
+func isOutOfMemory(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, message := range []string{"out of memory", "memory allocation of", "cannot allocate memory"} {
+		if strings.Contains(stderr, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// kill はワーカーを強制終了し、終了を待ちます。
+func (w *worker) kill() {
+	w.cmd.Process.Kill()
+	<-w.done
+	w.stdin.Close()
+	w.stdout.Close()
+}
+
+// stop は標準入力を閉じてワーカーに終了を促し、終了を待ちます。
+func (w *worker) stop() error {
+	w.stdin.Close()
+	<-w.done
+	w.stdout.Close()
+	return w.err
+}
+
+// tailBuffer は書き込まれたデータの末尾のmaxバイトだけを保持します。
+// メモリの確保の失敗を示すメッセージは、その後のスタックトレースで末尾から押し出されることがあるため、
+// 書き込みの時点で検出して記録します。
+type tailBuffer struct {
+	mu          sync.Mutex
+	max         int
+	data        []byte
+	outOfMemory bool
+}
+
+// Write はio.Writerを実装します。
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// 書き込みの境界で分かれたメッセージも検出できるよう、直前のデータの末尾を含めて調べる
+	start := max(len(b.data)-64, 0)
+	b.data = append(b.data, p...)
+	if !b.outOfMemory && isOutOfMemory(string(b.data[start:])) {
+		b.outOfMemory = true
+	}
+	if len(b.data) > b.max {
+		b.data = append(b.data[:0], b.data[len(b.data)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+// OutOfMemory は、書き込まれたデータにメモリの確保の失敗を示すメッセージがあったかを返します。
+func (b *tailBuffer) OutOfMemory() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.outOfMemory
+}
+
+// String は保持しているデータを返します。
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return tail(b.data, b.max)
+}
+
+// ServeWorker は、WorkerPoolのワーカーのエントリポイントです。
+// rからフレーム化されたPNGデータを読み込むたびにPNGQuantを実行し、結果をwに書き込みます。
+// rが終端に達すると nil を返します。WorkerPool.Commandに指定するコマンドは、
+// 標準入出力を渡してこの関数を呼び出してください。
+//
+// 例:
+//
+//	if len(os.Args) > 1 && os.Args[1] == "worker" {
+//	    if err := png.ServeWorker(os.Stdin, os.Stdout); err != nil {
+//	        os.Exit(1)
+//	    }
+//	    os.Exit(0)
+//	}
+//
+// WorkerPool.MemoryLimitが設定されている場合は、最初にGoランタイムのソフトな上限を
+// debug.SetMemoryLimitで設定します（OSの上限は親プロセスが設定します）。
+func ServeWorker(r io.Reader, w io.Writer) error {
+	if err := applyWorkerMemoryLimit(); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+	for {
+		data, err := readFrame(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeQuantizeResponse(writer, data); err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// applyWorkerMemoryLimit は親プロセスから渡されたメモリの上限をGoランタイムに設定します。
+// OSの上限（RLIMIT_DATA）を超える前にGCを行い、Goのヒープだけで上限に達することを避けます。
+func applyWorkerMemoryLimit() error {
+	value := os.Getenv(workerMemoryLimitEnv)
+	if value == "" {
+		return nil
+	}
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return NewSystemErrorf(CodeUnknown, l10n.T("invalid worker memory limit %q: %v"), value, err)
+	}
+	if limit > math.MaxInt64 {
+		limit = math.MaxInt64
+	}
+	debug.SetMemoryLimit(int64(limit))
+	return nil
+}
@@ -0,0 +1,220 @@
+package png
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFaultyWorker はServeWorkerと同じく応答しますが、ジョブの内容が
+// crash の場合は応答せずに異常終了し、hang の場合は応答せずに停止し、
+// allocate の場合は16GiBのメモリを確保します。
+func serveFaultyWorker(r io.Reader, w io.Writer) error {
+	if err := applyWorkerMemoryLimit(); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+	for {
+		data, err := readFrame(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch string(data) {
+		case "crash":
+			os.Stderr.WriteString("SIGSEGV: segmentation violation\n")
+			os.Exit(2)
+		case "hang":
+			select {}
+		case "allocate":
+			buf := make([]byte, 16<<30)
+			data = buf[:len(data)]
+		}
+		if err := writeQuantizeResponse(writer, data); err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	pool := NewWorkerPool(helperCommand("worker-helper"), 2)
+	defer pool.Close()
+
+	cases := []struct {
+		name       string
+		file       string
+		expectCode ErrorCode
+	}{
+		{"通常ファイル", "testdata/binding/psnr-will-50.png", CodeUnknown},
+		{"インデックスカラー", "testdata/variations/colortype_palette.png", CodeUnknown},
+		{"実態がJPEGのファイル", "testdata/binding/jpeg.png", CodeInvalidSignature},
+		{"2回目の通常ファイル", "testdata/binding/psnr-will-50.png", CodeUnknown},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+			expectedData, expectedQuantized, expectedErr := PNGQuant(data)
+
+			actualData, quantized, err := pool.Quantize(data)
+			if tc.expectCode != CodeUnknown {
+				if CodeOf(err) != tc.expectCode || err.Error() != expectedErr.Error() {
+					t.Fatalf("Quantize() = %v; want %v", err, expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Quantize() = %v; want nil", err)
+			}
+			if quantized != expectedQuantized {
+				t.Errorf("quantized = %v; want %v", quantized, expectedQuantized)
+			}
+			if !bytes.Equal(actualData, expectedData) {
+				t.Errorf("output differs from PNGQuant in this process (%d vs %d bytes)", len(actualData), len(expectedData))
+			}
+		})
+	}
+
+	// ジョブを順に処理した場合は1つのワーカーを使い回す
+	if len(pool.idle) != 1 || pool.Restarts() != 0 {
+		t.Errorf("idle workers = %d, Restarts() = %d; want 1 and 0", len(pool.idle), pool.Restarts())
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Errorf("Close() = %v; want nil", err)
+	}
+	if _, _, err := pool.Quantize([]byte("data")); AsSystemError(err) == nil || CodeOf(err) != CodeWorkerPoolClosed {
+		t.Errorf("Quantize() after Close() = %v; want SystemError with code %s", err, CodeWorkerPoolClosed)
+	}
+}
+
+func TestWorkerPool_Faults(t *testing.T) {
+	cases := []struct {
+		name        string
+		job         string
+		timeout     time.Duration
+		memoryLimit uint64
+		expectCode  ErrorCode
+		expectText  string
+	}{
+		{"クラッシュ", "crash", 0, 0, CodeWorkerCrashed, "SIGSEGV"},
+		{"タイムアウト", "hang", 200 * time.Millisecond, 0, CodeWorkerTimeout, "200ms"},
+		{"メモリの上限", "allocate", 0, 4 << 30, CodeWorkerMemoryLimit, "4294967296"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.memoryLimit > 0 && runtime.GOOS != "linux" {
+				t.Skip("memory limit is enforced on linux only")
+			}
+			t.Parallel()
+
+			pool := NewWorkerPool(helperCommand("faulty-worker-helper"), 1)
+			pool.Timeout = tc.timeout
+			pool.MemoryLimit = tc.memoryLimit
+			defer pool.Close()
+
+			_, _, err := pool.Quantize([]byte(tc.job))
+			if systemErr := AsSystemError(err); systemErr == nil || systemErr.Code() != tc.expectCode {
+				t.Fatalf("Quantize() = %v (%v); want %v", err, CodeOf(err), tc.expectCode)
+			}
+			if !strings.Contains(err.Error(), tc.expectText) {
+				t.Errorf("Error() = %q; want to contain %q", err.Error(), tc.expectText)
+			}
+			if pool.Restarts() != 1 {
+				t.Errorf("Restarts() = %d; want 1", pool.Restarts())
+			}
+
+			// 新しいワーカーで次のジョブを処理できる（実際の減色には短い制限時間を適用しない）
+			pool.Timeout = 0
+			data, err := os.ReadFile("testdata/binding/psnr-will-50.png")
+			if err != nil {
+				t.Fatalf("os.ReadFile() = %v; want nil", err)
+			}
+			if _, quantized, err := pool.Quantize(data); err != nil || !quantized {
+				t.Errorf("Quantize() after restart = %v, %v; want quantized", quantized, err)
+			}
+		})
+	}
+}
+
+func TestTailBuffer_OutOfMemory(t *testing.T) {
+	buf := tailBuffer{max: 16}
+	// 書き込みの境界で分かれたメッセージを、末尾から押し出された後も記録している
+	buf.Write([]byte("fatal error: out of "))
+	buf.Write([]byte("memory\n"))
+	buf.Write([]byte(strings.Repeat("goroutine trace\n", 8)))
+	if !buf.OutOfMemory() {
+		t.Error("OutOfMemory() = false; want true")
+	}
+	if strings.Contains(buf.String(), "memory") {
+		t.Errorf("String() = %q; want only the tail", buf.String())
+	}
+
+	other := tailBuffer{max: 16}
+	other.Write([]byte("SIGSEGV: segmentation violation\n"))
+	if other.OutOfMemory() {
+		t.Error("OutOfMemory() = true; want false")
+	}
+}
+
+func TestApplyWorkerMemoryLimit(t *testing.T) {
+	previous := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(previous)
+
+	t.Setenv(workerMemoryLimitEnv, "1073741824")
+	if err := applyWorkerMemoryLimit(); err != nil {
+		t.Fatalf("applyWorkerMemoryLimit() = %v; want nil", err)
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != 1<<30 {
+		t.Errorf("debug.SetMemoryLimit(-1) = %d; want %d", limit, 1<<30)
+	}
+
+	t.Setenv(workerMemoryLimitEnv, "2GiB")
+	if err := applyWorkerMemoryLimit(); AsSystemError(err) == nil {
+		t.Errorf("applyWorkerMemoryLimit() = %v; want SystemError", err)
+	}
+}
+
+func TestOptimize_Workers(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+
+	inProcess, err := NewOptimizer("").Run("testdata/optimize/psnr-will-50.png", filepath.Join(tempDir, "in.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+
+	pool := NewWorkerPool(helperCommand("worker-helper"), 1)
+	defer pool.Close()
+
+	optimizer := NewOptimizer("")
+	optimizer.Workers = pool
+	// Workersが指定されている場合はQuantizeCommandを使わない
+	optimizer.QuantizeCommand = helperCommand("crash-helper")
+	output, err := optimizer.Run("testdata/optimize/psnr-will-50.png", filepath.Join(tempDir, "out.png"))
+	if err != nil {
+		t.Fatalf("Run() = %v; want nil", err)
+	}
+	if output.PNGQuantError != nil || output.SizeAfterPNGQuant != inProcess.SizeAfterPNGQuant || output.PNGQuant != inProcess.PNGQuant {
+		t.Errorf("Run() = %+v; want same result as in process %+v", output, inProcess)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+package png
+
+import (
+	"errors"
+	"syscall"
+)
+
+// getXattr はファイルの拡張属性を読み込みます。
+// 属性が存在しない場合や、ファイルシステムが拡張属性に対応していない場合はnilを返します。
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if noXattr(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(path, name, buf)
+		if errors.Is(err, syscall.ERANGE) {
+			// 読み込みの間に属性が大きくなった場合はやり直す
+			continue
+		}
+		if noXattr(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// noXattr はGetxattrのエラーが、属性を読み込めるマーカーがないことを示すかを返します。
+func noXattr(err error) bool {
+	return errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// setXattr はファイルの拡張属性を書き込みます。
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package png
+
+// getXattr は拡張属性に対応していないプラットフォームではErrXattrUnsupportedを返します。
+func getXattr(path, name string) ([]byte, error) {
+	return nil, ErrXattrUnsupported
+}
+
+// setXattr は拡張属性に対応していないプラットフォームではErrXattrUnsupportedを返します。
+func setXattr(path, name string, value []byte) error {
+	return ErrXattrUnsupported
+}